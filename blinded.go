@@ -0,0 +1,79 @@
+package rendezvous
+
+import (
+	"context"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/status-im/rendezvous/protocol"
+)
+
+// BlindedTopic is a topic hidden from the server. Its name is known only to peers sharing
+// the secret and the opaque topic sent to the server changes every period.
+type BlindedTopic struct {
+	Secret []byte
+	Name   string
+	// Period of the topic rotation. Registrations are discoverable for two periods at most,
+	// so TTL should not be longer than the period.
+	Period time.Duration
+}
+
+// At returns opaque topic used at t. Error is returned if period is not positive.
+func (b BlindedTopic) At(t time.Time) (string, error) {
+	epoch, err := protocol.Epoch(t, b.Period)
+	if err != nil {
+		return "", err
+	}
+	return protocol.BlindTopic(b.Secret, b.Name, epoch), nil
+}
+
+// previous returns opaque topic of the period before t, period must be valid.
+func (b BlindedTopic) previous(t time.Time) string {
+	epoch, _ := protocol.Epoch(t, b.Period)
+	return protocol.BlindTopic(b.Secret, b.Name, epoch-1)
+}
+
+// RegisterBlinded registers record under the opaque topic of the current period. It should be
+// repeated at least every period to keep the record discoverable.
+func (c Client) RegisterBlinded(ctx context.Context, srv ma.Multiaddr, topic BlindedTopic, record enr.Record, ttl time.Duration) error {
+	current, err := topic.At(time.Now())
+	if err != nil {
+		return err
+	}
+	return c.Register(ctx, srv, current, record, ttl)
+}
+
+// DiscoverBlinded returns up to limit records registered under the blinded topic. Records
+// registered in the previous period are returned too if the current period has not enough.
+func (c Client) DiscoverBlinded(ctx context.Context, srv ma.Multiaddr, topic BlindedTopic, limit int) ([]enr.Record, error) {
+	now := time.Now()
+	current, err := topic.At(now)
+	if err != nil {
+		return nil, err
+	}
+	rst, err := c.Discover(ctx, srv, current, limit)
+	if err != nil || len(rst) >= limit {
+		return rst, err
+	}
+	previous, err := c.Discover(ctx, srv, topic.previous(now), limit)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]struct{}, len(rst))
+	for i := range rst {
+		seen[string(protocol.ValidSchemes.NodeAddr(&rst[i]))] = struct{}{}
+	}
+	for i := range previous {
+		if len(rst) == limit {
+			break
+		}
+		id := string(protocol.ValidSchemes.NodeAddr(&previous[i]))
+		if _, exist := seen[id]; exist {
+			continue
+		}
+		seen[id] = struct{}{}
+		rst = append(rst, previous[i])
+	}
+	return rst, nil
+}
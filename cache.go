@@ -0,0 +1,195 @@
+package rendezvous
+
+import (
+	"container/list"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/status-im/rendezvous/protocol"
+)
+
+// CacheConfig controls client-side cache of discovered records.
+type CacheConfig struct {
+	// MaxEntries limits the number of cached server and topic pairs.
+	// Least recently used pairs are evicted first.
+	MaxEntries int
+	// MaxRecords limits the number of records cached for a single server and topic pair.
+	MaxRecords int
+	// MaxStaleness is how long cached entry is used before it is refreshed from the server,
+	// even if records in it are still valid. It is also used as a TTL for records returned
+	// by servers that don't report remaining TTL.
+	MaxStaleness time.Duration
+	// MinTTL is the minimal remaining TTL for a record to be returned from cache. Zero returns
+	// records until they expire, default is used only if the whole config is zero.
+	MinTTL time.Duration
+}
+
+// DefaultCacheConfig is used for zero fields of the CacheConfig, except MinTTL.
+var DefaultCacheConfig = CacheConfig{
+	MaxEntries:   256,
+	MaxRecords:   100,
+	MaxStaleness: 10 * time.Second,
+	MinTTL:       time.Second,
+}
+
+// WithCache enables caching of discovered records until their registrations expire.
+func WithCache(cfg CacheConfig) ClientOption {
+	if cfg == (CacheConfig{}) {
+		cfg = DefaultCacheConfig
+	}
+	if cfg.MaxEntries == 0 {
+		cfg.MaxEntries = DefaultCacheConfig.MaxEntries
+	}
+	if cfg.MaxRecords == 0 {
+		cfg.MaxRecords = DefaultCacheConfig.MaxRecords
+	}
+	if cfg.MaxStaleness == 0 {
+		cfg.MaxStaleness = DefaultCacheConfig.MaxStaleness
+	}
+	return func(c *Client) {
+		c.cache = newDiscoveryCache(cfg)
+	}
+}
+
+type cachedRecord struct {
+	registration Registration
+	id           enode.ID
+	expires      time.Time
+	// hasTTL is false if server didn't report remaining TTL of the record.
+	hasTTL bool
+}
+
+type cacheEntry struct {
+	key     string
+	fetched time.Time
+	records []cachedRecord
+	// complete is true if server returned fewer records than requested and than its MaxLimit,
+	// so it had no more.
+	complete bool
+}
+
+func newDiscoveryCache(cfg CacheConfig) *discoveryCache {
+	return &discoveryCache{
+		cfg:     cfg,
+		infos:   &infoCache{infos: map[string]cachedInfo{}},
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// discoveryCache keeps discovered records keyed by server and topic.
+type discoveryCache struct {
+	cfg CacheConfig
+	// infos keeps limits of servers, so that responses capped by the server are not complete.
+	infos *infoCache
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+func cacheKey(srv ma.Multiaddr, topic string) string {
+	return srv.String() + "/" + topic
+}
+
+// get returns up to limit valid records in random order. ok is false if entry is stale, empty or
+// doesn't have enough records while server may have more, and server should be queried.
+func (c *discoveryCache) get(srv ma.Multiaddr, topic string, limit int, now time.Time) (rst []Registration, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, exist := c.entries[cacheKey(srv, topic)]
+	if !exist {
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if now.Sub(entry.fetched) > c.cfg.MaxStaleness {
+		return nil, false
+	}
+	valid := entry.records[:0]
+	for _, r := range entry.records {
+		if r.expires.Sub(now) >= c.cfg.MinTTL {
+			valid = append(valid, r)
+		}
+	}
+	entry.records = valid
+	if len(valid) < limit {
+		// nothing to return, server may have new records
+		if !entry.complete || len(valid) == 0 {
+			return nil, false
+		}
+		limit = len(valid)
+	}
+	c.lru.MoveToFront(el)
+	for _, i := range rand.Perm(len(valid))[:limit] {
+		reg := valid[i].registration
+		if valid[i].hasTTL {
+			reg.TTL = valid[i].expires.Sub(now)
+		}
+		rst = append(rst, reg)
+	}
+	return rst, true
+}
+
+// put replaces cached records for the server and topic. complete is true if server had no more
+// records. Records without TTL are kept for MaxStaleness.
+func (c *discoveryCache) put(srv ma.Multiaddr, topic string, regs []Registration, complete bool, now time.Time) {
+	entry := &cacheEntry{key: cacheKey(srv, topic), fetched: now, complete: complete}
+	for i := range regs {
+		if len(entry.records) == c.cfg.MaxRecords {
+			break
+		}
+		n, err := enode.New(protocol.ValidSchemes, &regs[i].Record)
+		if err != nil {
+			continue
+		}
+		cached := cachedRecord{registration: regs[i], id: n.ID(), expires: now.Add(c.cfg.MaxStaleness)}
+		if regs[i].TTL != 0 {
+			cached.expires = now.Add(regs[i].TTL)
+			cached.hasTTL = true
+		}
+		entry.records = append(entry.records, cached)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, exist := c.entries[entry.key]; exist {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.cfg.MaxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// invalidateNode removes records of the node from all entries.
+func (c *discoveryCache) invalidateNode(id enode.ID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, el := range c.entries {
+		entry := el.Value.(*cacheEntry)
+		valid := entry.records[:0]
+		for _, r := range entry.records {
+			if r.id != id {
+				valid = append(valid, r)
+			}
+		}
+		entry.records = valid
+	}
+}
+
+// invalidateTopic removes entry for the server and topic.
+func (c *discoveryCache) invalidateTopic(srv ma.Multiaddr, topic string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKey(srv, topic)
+	if el, exist := c.entries[key]; exist {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+}
@@ -3,10 +3,13 @@ package rendezvous
 import (
 	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/ethereum/go-ethereum/p2p/enr"
 	"github.com/ethereum/go-ethereum/rlp"
 	libp2p "github.com/libp2p/go-libp2p"
@@ -14,6 +17,7 @@ import (
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	libp2pprotocol "github.com/libp2p/go-libp2p/core/protocol"
 	ma "github.com/multiformats/go-multiaddr"
 	ethv4 "github.com/status-im/go-multiaddr-ethv4"
 	"github.com/status-im/rendezvous/protocol"
@@ -21,132 +25,456 @@ import (
 
 var logger = log.New("package", "rendezvous/client")
 
-func NewEphemeral() (c Client, err error) {
+const (
+	defaultDialTimeout  = 10 * time.Second
+	defaultReadTimeout  = 10 * time.Second
+	defaultWriteTimeout = 10 * time.Second
+	// maxRedirects limits how many times request follows E_REDIRECT of cluster members.
+	maxRedirects = 3
+)
+
+// RetryPolicy controls how failed requests are retried. Only transient errors are retried,
+// see IsTransient.
+type RetryPolicy struct {
+	// MaxAttempts is a total number of attempts, including the first one.
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+}
+
+// DefaultRetryPolicy makes a single attempt.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    1,
+	InitialBackoff: 200 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+	Multiplier:     2,
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := float64(p.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		d *= p.Multiplier
+		if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+			return p.MaxBackoff
+		}
+	}
+	return time.Duration(d)
+}
+
+// ClientOption configures Client.
+type ClientOption func(*Client)
+
+// WithDialTimeout limits time spent on connecting to the server and opening a stream.
+// Zero disables the timeout.
+func WithDialTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.dialTimeout = timeout
+	}
+}
+
+// WithReadTimeout limits time spent waiting for the response. Zero disables the timeout.
+func WithReadTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.readTimeout = timeout
+	}
+}
+
+// WithWriteTimeout limits time spent on sending the request. Zero disables the timeout.
+func WithWriteTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.writeTimeout = timeout
+	}
+}
+
+// WithProtocols restricts protocol versions that client negotiates with the server.
+// Versions should be ordered by preference. By default all known versions are used.
+func WithProtocols(versions ...string) ClientOption {
+	return func(c *Client) {
+		c.protocols = nil
+		for _, v := range versions {
+			c.protocols = append(c.protocols, libp2pprotocol.ID(v))
+		}
+	}
+}
+
+// WithRetryPolicy sets policy for retrying failed requests.
+func WithRetryPolicy(policy RetryPolicy) ClientOption {
+	return func(c *Client) {
+		c.retry = policy
+	}
+}
+
+// WithToken attaches token to Register and Discover requests for the private topic and
+// topics under it. Token is issued by the topic owner, see protocol.NewToken.
+func WithToken(topic string, token []byte) ClientOption {
+	return func(c *Client) {
+		if c.tokens == nil {
+			c.tokens = map[string][]byte{}
+		}
+		c.tokens[strings.TrimSuffix(topic, protocol.TopicSeparator)] = token
+	}
+}
+
+func NewEphemeral(opts ...ClientOption) (c Client, err error) {
 	priv, _, err := crypto.GenerateKeyPairWithReader(crypto.Secp256k1, 0, rand.Reader) // bits are ignored with edwards or secp251k1
 	if err != nil {
 		return Client{}, err
 	}
-	return New(priv)
+	return New(priv, opts...)
 }
 
-func New(identity crypto.PrivKey) (c Client, err error) {
-	opts := []libp2p.Option{
+func New(identity crypto.PrivKey, opts ...ClientOption) (c Client, err error) {
+	libp2pOpts := []libp2p.Option{
 		libp2p.Identity(identity),
 	}
-	h, err := libp2p.New(opts...)
+	h, err := libp2p.New(libp2pOpts...)
 	if err != nil {
 		return c, err
 	}
-	return Client{
-		h: h,
-	}, nil
+	return NewWithHost(h, opts...)
 }
 
-func NewWithHost(h host.Host) (c Client, err error) {
-	return Client{
-		h: h,
-	}, nil
+func NewWithHost(h host.Host, opts ...ClientOption) (c Client, err error) {
+	c = Client{
+		h:            h,
+		dialTimeout:  defaultDialTimeout,
+		readTimeout:  defaultReadTimeout,
+		writeTimeout: defaultWriteTimeout,
+		retry:        DefaultRetryPolicy,
+	}
+	for _, codec := range protocol.Codecs {
+		c.protocols = append(c.protocols, libp2pprotocol.ID(codec.ID))
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c, nil
 }
 
 type Client struct {
 	h host.Host
+
+	dialTimeout  time.Duration
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	retry        RetryPolicy
+	protocols    []libp2pprotocol.ID
+
+	cache  *discoveryCache
+	infos  *infoCache
+	tokens map[string][]byte
 }
 
+// Register registers record under the topic for ttl. If TTL clamping is enabled ttl is lowered
+// to the longest TTL accepted by the server.
 func (c Client) Register(ctx context.Context, srv ma.Multiaddr, topic string, record enr.Record, ttl time.Duration) error {
-	s, err := c.newStream(ctx, srv)
+	if c.infos != nil {
+		ttl = c.clampTTL(ctx, srv, ttl)
+	}
+	return c.request(ctx, srv, "register", func(s network.Stream) error {
+		if err := c.send(s, protocol.REGISTER, protocol.Register{Topic: topic, Record: record, TTL: uint64(ttl), Token: c.token(topic)}); err != nil {
+			return err
+		}
+		var val protocol.RegisterResponse
+		if err := c.receive(s, protocol.REGISTER_RESPONSE, &val); err != nil {
+			return err
+		}
+		logger.Debug("received response to register", "status", val.Status, "message", val.Message)
+		if val.Status != protocol.OK {
+			return protocol.NewError(val.Status, val.Message)
+		}
+		return nil
+	})
+}
+
+// Registration is a discovered record together with details reported by the server.
+type Registration struct {
+	Record enr.Record
+	// TTL is the remaining time before registration expires. Zero if server didn't report it.
+	TTL time.Duration
+	// Registered is when the record was first registered. Zero if server didn't report it.
+	Registered time.Time
+}
+
+// Discover returns up to limit random records registered under the topic. If cache is enabled
+// records are served from it while they are valid.
+func (c Client) Discover(ctx context.Context, srv ma.Multiaddr, topic string, limit int) (rst []enr.Record, err error) {
+	if c.cache == nil {
+		regs, err := c.discover(ctx, srv, topic, limit, false)
+		if err != nil {
+			return nil, err
+		}
+		return records(regs), nil
+	}
+	regs, err := c.DiscoverRegistrations(ctx, srv, topic, limit)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer s.Close()
-	if err = rlp.Encode(s, protocol.REGISTER); err != nil {
-		return err
+	return records(regs), nil
+}
+
+// DiscoverRegistrations is the same as Discover but returns remaining TTL and time of the first
+// registration for each record, so that fresh peers can be preferred. These details are zero if
+// server is too old to report them.
+func (c Client) DiscoverRegistrations(ctx context.Context, srv ma.Multiaddr, topic string, limit int) (rst []Registration, err error) {
+	if c.cache == nil {
+		return c.discoverExtended(ctx, srv, topic, limit)
 	}
-	if err = rlp.Encode(s, protocol.Register{Topic: topic, Record: record, TTL: uint64(ttl)}); err != nil {
-		return err
+	if rst, ok := c.cache.get(srv, topic, limit, time.Now()); ok {
+		return rst, nil
 	}
-	rs := rlp.NewStream(s, 0)
-	typ, err := rs.Uint()
+	rst, err = c.discoverExtended(ctx, srv, topic, c.cache.cfg.MaxRecords)
 	if err != nil {
-		return err
-	}
-	if protocol.MessageType(typ) != protocol.REGISTER_RESPONSE {
-		return fmt.Errorf("expected %v as response, but got %v", protocol.REGISTER_RESPONSE, typ)
+		return nil, err
 	}
-	var val protocol.RegisterResponse
-	if err = rs.Decode(&val); err != nil {
-		return err
+	// servers cap the number of returned records, response is complete only if it is below the cap,
+	// caps of servers without Info request are unknown
+	complete := len(rst) < c.cache.cfg.MaxRecords && len(rst) < c.serverInfo(ctx, c.cache.infos, srv).MaxLimit
+	c.cache.put(srv, topic, rst, complete, time.Now())
+	if len(rst) > limit {
+		rst = rst[:limit]
 	}
-	logger.Debug("received response to register", "status", val.Status, "message", val.Message)
-	if val.Status != protocol.OK {
-		return fmt.Errorf("register failed. status code %v", val.Status)
+	return rst, nil
+}
+
+// InvalidateNode removes all cached records of the node. Use it when node can't be dialed.
+func (c Client) InvalidateNode(id enode.ID) {
+	if c.cache != nil {
+		c.cache.invalidateNode(id)
 	}
-	return nil
 }
 
-func (c Client) Discover(ctx context.Context, srv ma.Multiaddr, topic string, limit int) (rst []enr.Record, err error) {
-	s, err := c.newStream(ctx, srv)
-	if err != nil {
-		return
+// InvalidateTopic drops cached records for the topic received from the server.
+func (c Client) InvalidateTopic(srv ma.Multiaddr, topic string) {
+	if c.cache != nil {
+		c.cache.invalidateTopic(srv, topic)
 	}
-	defer s.Close()
+}
 
-	if err = rlp.Encode(s, protocol.DISCOVER); err != nil {
-		return
+func records(regs []Registration) []enr.Record {
+	rst := make([]enr.Record, len(regs))
+	for i := range regs {
+		rst[i] = regs[i].Record
 	}
-	if err = rlp.Encode(s, protocol.Discover{Topic: topic, Limit: uint(limit)}); err != nil {
-		return
+	return rst
+}
+
+// discoverExtended asks server for record details. Servers that speak only VERSION and
+// don't support extended request are queried with the plain one.
+func (c Client) discoverExtended(ctx context.Context, srv ma.Multiaddr, topic string, limit int) ([]Registration, error) {
+	rst, err := c.discover(ctx, srv, topic, limit, true)
+	if errors.Is(err, protocol.ErrInvalidContent) {
+		return c.discover(ctx, srv, topic, limit, false)
 	}
-	rs := rlp.NewStream(s, 0)
-	typ, err := rs.Uint()
-	if err != nil {
+	return rst, err
+}
+
+// discover sends discover request. If extended is true server is asked for remaining TTLs
+// and registration times of the records.
+func (c Client) discover(ctx context.Context, srv ma.Multiaddr, topic string, limit int, extended bool) (rst []Registration, err error) {
+	err = c.request(ctx, srv, "discover", func(s network.Stream) error {
+		if s.Protocol() == protocol.VERSION2 {
+			rst, err = c.discoverV2(s, topic, limit)
+			return err
+		}
+		if err := c.send(s, protocol.DISCOVER, protocol.Discover{Topic: topic, Limit: uint(limit), Extended: extended, Token: c.token(topic)}); err != nil {
+			return err
+		}
+		var val protocol.DiscoverResponse
+		if err := c.receive(s, protocol.DISCOVER_RESPONSE, &val); err != nil {
+			return err
+		}
+		if val.Status != protocol.OK {
+			return protocol.NewError(val.Status, val.Message)
+		}
+		logger.Debug("received response to discover request", "status", val.Status, "records lth", len(val.Records))
+		rst = make([]Registration, len(val.Records))
+		for i := range val.Records {
+			rst[i].Record = val.Records[i]
+			if len(val.TTLs) == len(val.Records) {
+				rst[i].TTL = time.Duration(val.TTLs[i])
+			}
+			if len(val.Registered) == len(val.Records) && val.Registered[i] != 0 {
+				rst[i].Registered = time.Unix(int64(val.Registered[i]), 0)
+			}
+		}
+		return nil
+	})
+	return rst, err
+}
+
+func (c Client) discoverV2(s network.Stream, topic string, limit int) ([]Registration, error) {
+	if err := c.send(s, protocol.DISCOVER, protocol.DiscoverV2{Topic: topic, Limit: uint(limit), Token: c.token(topic)}); err != nil {
 		return nil, err
 	}
-	if protocol.MessageType(typ) != protocol.DISCOVER_RESPONSE {
-		return nil, fmt.Errorf("expected %v as response, but got %v", protocol.REGISTER_RESPONSE, typ)
-	}
-	var val protocol.DiscoverResponse
-	if err = rs.Decode(&val); err != nil {
-		return
+	var val protocol.DiscoverResponseV2
+	if err := c.receive(s, protocol.DISCOVER_RESPONSE, &val); err != nil {
+		return nil, err
 	}
 	if val.Status != protocol.OK {
-		return nil, fmt.Errorf("discover request failed. status code %v", val.Status)
+		return nil, protocol.NewError(val.Status, val.Message)
 	}
 	logger.Debug("received response to discover request", "status", val.Status, "records lth", len(val.Records))
-	return val.Records, nil
+	rst := make([]Registration, len(val.Records))
+	for i, r := range val.Records {
+		rst[i] = Registration{Record: r.Record, TTL: time.Duration(r.TTL)}
+		if r.Registered != 0 {
+			rst[i].Registered = time.Unix(int64(r.Registered), 0)
+		}
+	}
+	return rst, nil
 }
 
 func (c Client) RemoteIp(ctx context.Context, srv ma.Multiaddr) (value string, err error) {
-	s, err := c.newStream(ctx, srv)
+	err = c.request(ctx, srv, "remoteip", func(s network.Stream) error {
+		if err := c.send(s, protocol.REMOTEIP, nil); err != nil {
+			return err
+		}
+		var val protocol.RemoteIpResponse
+		if err := c.receive(s, protocol.REMOTEIP_RESPONSE, &val); err != nil {
+			return err
+		}
+		if val.Status != protocol.OK {
+			return protocol.NewError(val.Status, val.Message)
+		}
+		logger.Debug("received response to remoteip request", "status", val.Status, "ip", val.IP)
+		value = val.IP
+		return nil
+	})
+	return value, err
+}
+
+// TopicStat is a topic with the number of active registrations under it.
+type TopicStat struct {
+	Topic string
+	Count int
+}
+
+// Topics returns topics with active registrations on the server, sorted by name. If prefix
+// is not empty only topics that start with it are returned. Server may limit the number
+// of returned topics. It requires VERSION2, ErrNotSupported is returned for older servers.
+func (c Client) Topics(ctx context.Context, srv ma.Multiaddr, prefix string) (rst []TopicStat, err error) {
+	err = c.request(ctx, srv, "topics", func(s network.Stream) error {
+		codec := protocol.CodecFor(string(s.Protocol()))
+		if codec == nil || !codec.Supports(protocol.TOPICS) {
+			return ErrNotSupported
+		}
+		if err := c.send(s, protocol.TOPICS, protocol.Topics{Prefix: prefix}); err != nil {
+			return err
+		}
+		var val protocol.TopicsResponse
+		if err := c.receive(s, protocol.TOPICS_RESPONSE, &val); err != nil {
+			return err
+		}
+		if val.Status != protocol.OK {
+			return protocol.NewError(val.Status, val.Message)
+		}
+		logger.Debug("received response to topics request", "status", val.Status, "topics lth", len(val.Topics))
+		rst = make([]TopicStat, len(val.Topics))
+		for i, t := range val.Topics {
+			rst[i] = TopicStat{Topic: t.Topic, Count: int(t.Count)}
+		}
+		return nil
+	})
+	return rst, err
+}
+
+// token returns token of the most specific namespace of the topic, nil if there is none.
+func (c Client) token(topic string) []byte {
+	if namespace, wildcard, _ := protocol.ParseWildcard(topic); wildcard {
+		topic = namespace
+	}
+	for _, ns := range protocol.Namespaces(topic) {
+		if token, exist := c.tokens[ns]; exist {
+			return token
+		}
+	}
+	return nil
+}
+
+// request opens a new stream for every attempt and retries transient failures
+// according to the retry policy. Redirects to the owner of the topic are followed up to
+// maxRedirects times.
+func (c Client) request(ctx context.Context, srv ma.Multiaddr, op string, fn func(s network.Stream) error) error {
+	attempts := c.retry.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	redirects := 0
+	for attempt := 1; ; attempt++ {
+		err = c.attempt(ctx, srv, fn)
+		if err == nil {
+			return nil
+		}
+		if owner, redirect := protocol.RedirectAddr(err); redirect && redirects < maxRedirects {
+			logger.Debug("following redirect", "op", op, "server", srv, "owner", owner)
+			redirects++
+			srv = owner
+			attempt--
+			continue
+		}
+		if attempt >= attempts || !IsTransient(err) || ctx.Err() != nil {
+			return &RequestError{Op: op, Server: srv, Attempts: attempt, Err: err}
+		}
+		backoff := c.retry.backoff(attempt)
+		logger.Debug("retrying request", "op", op, "server", srv, "attempt", attempt, "backoff", backoff, "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return &RequestError{Op: op, Server: srv, Attempts: attempt, Err: ctx.Err()}
+		}
+	}
+}
+
+func (c Client) attempt(ctx context.Context, srv ma.Multiaddr, fn func(s network.Stream) error) error {
+	dialCtx := ctx
+	if c.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, c.dialTimeout)
+		defer cancel()
+	}
+	s, err := c.newStream(dialCtx, srv)
 	if err != nil {
-		return
+		return err
 	}
 	defer s.Close()
+	return fn(s)
+}
 
-	if err = rlp.Encode(s, protocol.REMOTEIP); err != nil {
-		return
+// send writes message type followed by the message. Message is omitted if nil.
+func (c Client) send(s network.Stream, typ protocol.MessageType, msg interface{}) error {
+	if c.writeTimeout > 0 {
+		if err := s.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+			return err
+		}
+	}
+	if err := rlp.Encode(s, typ); err != nil {
+		return err
+	}
+	if msg == nil {
+		return nil
 	}
+	return rlp.Encode(s, msg)
+}
 
+// receive reads response of the expected type into val.
+func (c Client) receive(s network.Stream, expected protocol.MessageType, val interface{}) error {
+	if c.readTimeout > 0 {
+		if err := s.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
+			return err
+		}
+	}
 	rs := rlp.NewStream(s, 0)
 	typ, err := rs.Uint()
 	if err != nil {
-		return
-	}
-	if protocol.MessageType(typ) != protocol.REMOTEIP_RESPONSE {
-		err = fmt.Errorf("expected %v as response, but got %v", protocol.REMOTEIP_RESPONSE, typ)
-		return
+		return err
 	}
-	var val protocol.RemoteIpResponse
-	if err = rs.Decode(&val); err != nil {
-		return
+	if protocol.MessageType(typ) != expected {
+		return fmt.Errorf("%w: expected %v as response, but got %v", ErrUnexpectedResponse, expected, typ)
 	}
-	if val.Status != protocol.OK {
-		err = fmt.Errorf("remoteip request failed. status code %v", val.Status)
-		return
-	}
-	logger.Debug("received response to remoteip request", "status", val.Status, "ip", val.IP)
-	value = val.IP
-
-	return
+	return rs.Decode(val)
 }
 
 func (c Client) newStream(ctx context.Context, srv ma.Multiaddr) (rw network.Stream, err error) {
@@ -165,7 +493,13 @@ func (c Client) newStream(ctx context.Context, srv ma.Multiaddr) (rw network.Str
 	}
 	targetAddr := srv.Decapsulate(targetPeerAddr)
 	c.h.Peerstore().AddAddr(peerid, targetAddr, 5*time.Second)
-	s, err := c.h.NewStream(ctx, peerid, "/rend/0.1.0")
+	if c.dialTimeout > 0 {
+		ctx = network.WithDialPeerTimeout(ctx, c.dialTimeout)
+	}
+	// requests are retried with the retry policy, libp2p dial backoff would fail them without dialing
+	ctx = network.WithForceDirectDial(ctx, "rendezvous")
+	// multistream select picks the first version from the list that server supports
+	s, err := c.h.NewStream(ctx, peerid, c.protocols...)
 	if err != nil {
 		return nil, err
 	}
@@ -1,16 +1,23 @@
 package main
 
 import (
+	"context"
+	"crypto/ecdsa"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	btcec "github.com/btcsuite/btcd/btcec/v2"
 
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/log"
 	golog "github.com/ipfs/go-log/v2"
 	lcrypto "github.com/libp2p/go-libp2p/core/crypto"
@@ -35,8 +42,33 @@ var (
 	verbosity = pflag.StringP("verbosity", "v", "info",
 		"verbosity level, options: crit, error, warn, info, debug")
 	metricsAddress = pflag.StringP("metrics-address", "m", "127.0.0.1:8080", "http server for exposing prometheus metrics")
+	disableTopics  = pflag.Bool("disable-topics", false, "reject requests for the list of topics")
+	policyPath     = pflag.String("policy", "", "path to JSON file with topic access rules, reloaded on SIGHUP")
+	privateTopics  = pflag.StringArray("private-topic", nil,
+		"topic=owner, requests for the topic require token signed by the owner key (hex of secp256k1 public key)")
+	adminToken   = pflag.String("admin-token", "", "bearer token of the admin API, API is disabled if empty")
+	adminAddress = pflag.String("admin-address", "", "http server for admin API, metrics address is used if empty")
+	listen       = pflag.StringArray("listen", nil,
+		"listen multiaddr, e.g. /ip6/::/tcp/9090, /ip4/0.0.0.0/udp/9090/quic-v1 or /ip4/0.0.0.0/tcp/9091/ws, overrides --address and --port")
+	announce        = pflag.StringArray("announce", nil, "public multiaddr advertised instead of listen addresses, e.g. /ip4/203.0.113.7/tcp/9090")
+	natPortMap      = pflag.Bool("nat", false, "map listen ports on the NAT device with UPnP or NAT-PMP")
+	relay           = pflag.Bool("relay", false, "act as circuit relay v2 with strict reservation limits")
+	streamsPerPeer  = pflag.Int("max-streams-per-peer", server.DefaultResourceLimits.StreamsPerPeer, "inbound streams of a single peer per rendezvous protocol")
+	maxStreams      = pflag.Int("max-streams", server.DefaultResourceLimits.Streams, "inbound streams of all peers per rendezvous protocol")
+	connsLow        = pflag.Int("conns-low", server.DefaultResourceLimits.LowWater, "connection manager trims connections down to this number")
+	connsHigh       = pflag.Int("conns-high", server.DefaultResourceLimits.HighWater, "connection manager starts trimming above this number, disabled if zero")
+	idleTimeout     = pflag.Duration("idle-timeout", server.DefaultResourceLimits.IdleTimeout, "streams without requests for this long are closed")
+	federationPeers = pflag.StringArray("federation-peer", nil, "address of federated server with its identity, e.g. /ip4/10.0.0.2/tcp/9090/ethv4/<id>")
+	federationSync  = pflag.Duration("federation-sync", server.DefaultFederationConfig.SyncInterval, "how often topic digests are compared with federated servers")
+	federationHops  = pflag.Uint("federation-hops", server.DefaultFederationConfig.MaxHops, "how many servers a registration travels through from the one where it was made")
+	clusterMembers  = pflag.StringArray("cluster-member", nil, "address of cluster member with its identity, including this server, topics are sharded between members")
+	clusterProxy    = pflag.Bool("cluster-proxy", false, "forward requests for topics owned by other members instead of redirecting clients")
+	shutdownTimeout = pflag.Duration("shutdown-timeout", 10*time.Second, "how long in-flight requests are waited for on shutdown")
 )
 
+// secretFlags are not exposed by admin API.
+var secretFlags = map[string]struct{}{"keyhex": {}, "admin-token": {}}
+
 func normalizeForGolog(lvl string) string {
 	switch lvl {
 	case "crit":
@@ -59,25 +91,193 @@ func main() {
 	filteredHandler := log.LvlFilterHandler(level, log.StderrHandler)
 	log.Root().SetHandler(filteredHandler)
 
+	if pflag.NArg() != 0 {
+		must(runCommand(pflag.Args()))
+		return
+	}
+
 	priv, err := getKey()
 	must(err)
 	if *generate {
 		fmt.Println(hex.EncodeToString((*btcec.PrivateKey)(priv.(*lcrypto.Secp256k1PrivateKey)).Serialize()))
 		os.Exit(0)
 	}
-	laddr, err := ma.NewMultiaddr(fmt.Sprintf("/ip4/%s/tcp/%d", *address, *port))
+	laddrs, err := listenAddrs()
 	must(err)
 	db, err := leveldb.OpenFile(*data, &opt.Options{OpenFilesCacheCapacity: 3})
 	must(err)
-	srv := server.NewServer(laddr, priv, server.NewStorage(db))
+	opts := []server.ServerOption{server.WithListenAddrs(laddrs...)}
+	for _, value := range *announce {
+		addr, err := ma.NewMultiaddr(value)
+		must(err)
+		opts = append(opts, server.WithAnnounceAddrs(addr))
+	}
+	if *natPortMap {
+		opts = append(opts, server.WithNATPortMap())
+	}
+	if *relay {
+		opts = append(opts, server.WithRelay(server.DefaultRelayResources))
+	}
+	if len(*federationPeers) != 0 {
+		cfg := server.FederationConfig{SyncInterval: *federationSync, MaxHops: *federationHops}
+		for _, value := range *federationPeers {
+			addr, err := ma.NewMultiaddr(value)
+			must(err)
+			cfg.Peers = append(cfg.Peers, addr)
+		}
+		opts = append(opts, server.WithFederation(cfg))
+	}
+	if len(*clusterMembers) != 0 {
+		cfg := server.DefaultClusterConfig
+		cfg.Proxy = *clusterProxy
+		for _, value := range *clusterMembers {
+			addr, err := ma.NewMultiaddr(value)
+			must(err)
+			cfg.Members = append(cfg.Members, addr)
+		}
+		opts = append(opts, server.WithCluster(cfg))
+	}
+	limits := server.DefaultResourceLimits
+	limits.StreamsPerPeer = *streamsPerPeer
+	limits.Streams = *maxStreams
+	limits.LowWater = *connsLow
+	limits.HighWater = *connsHigh
+	limits.IdleTimeout = *idleTimeout
+	opts = append(opts, server.WithResourceLimits(limits))
+	if *disableTopics {
+		opts = append(opts, server.DisableTopics())
+	}
+	for _, private := range *privateTopics {
+		opt, err := privateTopic(private)
+		must(err)
+		opts = append(opts, opt)
+	}
+	if len(*policyPath) != 0 {
+		policy, err := server.NewFilePolicy(*policyPath)
+		must(err)
+		opts = append(opts, server.WithPolicy(policy))
+		go reloadOnSignal(policy)
+	}
+	srv := server.NewServer(nil, priv, server.NewStorage(db), opts...)
 	must(srv.Start())
 
-	defer srv.Stop()
-
 	prometheus.UsePrometheus()
-	http.Handle("/metrics", promhttp.Handler())
-	if err := http.ListenAndServe(*metricsAddress, nil); err != nil {
-		log.Crit(err.Error())
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", server.HealthHandler(srv.Healthy))
+	mux.Handle("/readyz", server.HealthHandler(srv.Ready))
+	servers := []*http.Server{{Addr: *metricsAddress, Handler: mux}}
+	if len(*adminToken) != 0 {
+		admin := srv.AdminHandler(*adminToken, flagValues())
+		if len(*adminAddress) == 0 || *adminAddress == *metricsAddress {
+			mux.Handle("/admin/", admin)
+		} else {
+			servers = append(servers, &http.Server{Addr: *adminAddress, Handler: admin})
+		}
+	}
+	for _, hs := range servers {
+		go func(hs *http.Server) {
+			if err := hs.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Crit(err.Error())
+			}
+		}(hs)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	log.Info("shutting down", "signal", <-sig)
+	shutdown(srv, servers, db)
+}
+
+// shutdown drains in-flight requests up to shutdown timeout, then stops http servers
+// and closes the database.
+func shutdown(srv *server.Server, servers []*http.Server, db *leveldb.DB) {
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Warn("in-flight requests were interrupted", "error", err)
+	}
+	for _, hs := range servers {
+		if err := hs.Shutdown(ctx); err != nil {
+			log.Warn("failed to shutdown http server", "address", hs.Addr, "error", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		log.Error("failed to close database", "error", err)
+	}
+}
+
+// listenAddrs parses --listen addresses, TCP address built from --address and --port is used
+// if none is given.
+func listenAddrs() ([]ma.Multiaddr, error) {
+	if len(*listen) == 0 {
+		ip := net.ParseIP(*address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", *address)
+		}
+		family := "ip4"
+		if ip.To4() == nil {
+			family = "ip6"
+		}
+		laddr, err := ma.NewMultiaddr(fmt.Sprintf("/%s/%s/tcp/%d", family, ip, *port))
+		if err != nil {
+			return nil, err
+		}
+		return []ma.Multiaddr{laddr}, nil
+	}
+	laddrs := make([]ma.Multiaddr, len(*listen))
+	for i, value := range *listen {
+		laddr, err := ma.NewMultiaddr(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen address %q: %w", value, err)
+		}
+		laddrs[i] = laddr
+	}
+	return laddrs, nil
+}
+
+// flagValues returns values of all flags except secrets.
+func flagValues() map[string]string {
+	rst := map[string]string{}
+	pflag.VisitAll(func(f *pflag.Flag) {
+		if _, secret := secretFlags[f.Name]; !secret {
+			rst[f.Name] = f.Value.String()
+		}
+	})
+	return rst
+}
+
+func privateTopic(value string) (server.ServerOption, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("private topic %q must be in topic=owner format", value)
+	}
+	raw, err := hex.DecodeString(strings.TrimPrefix(parts[1], "0x"))
+	if err != nil {
+		return nil, err
+	}
+	var owner *ecdsa.PublicKey
+	if len(raw) == 33 {
+		owner, err = crypto.DecompressPubkey(raw)
+	} else {
+		owner, err = crypto.UnmarshalPubkey(raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid owner key of %q: %w", parts[0], err)
+	}
+	return server.WithPrivateTopic(parts[0], owner), nil
+}
+
+// reloadOnSignal reloads policy every time process receives SIGHUP.
+func reloadOnSignal(policy *server.FilePolicy) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		if err := policy.Reload(); err != nil {
+			log.Error("failed to reload policy, previous rules are kept", "path", *policyPath, "error", err)
+			continue
+		}
+		log.Info("policy reloaded", "path", *policyPath)
 	}
 }
 
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/status-im/rendezvous/server"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// runCommand runs export or import subcommand on the database at --data path. Snapshot is
+// written to or read from the file, stdout or stdin are used if file is "-" or omitted.
+func runCommand(args []string) error {
+	if len(args) > 2 {
+		return fmt.Errorf("unexpected arguments %v", args[2:])
+	}
+	path := "-"
+	if len(args) == 2 {
+		path = args[1]
+	}
+	switch args[0] {
+	case "export":
+		return exportSnapshot(path)
+	case "import":
+		return importSnapshot(path)
+	default:
+		return fmt.Errorf("unknown command %q, expected export or import", args[0])
+	}
+}
+
+func exportSnapshot(path string) error {
+	db, err := leveldb.OpenFile(*data, &opt.Options{OpenFilesCacheCapacity: 3, ErrorIfMissing: true, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	storage := server.NewStorage(db)
+	count, err := storage.Export(w, time.Now())
+	if err != nil {
+		return err
+	}
+	log.Info("snapshot exported", "records", count, "path", path)
+	return nil
+}
+
+func importSnapshot(path string) error {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	db, err := leveldb.OpenFile(*data, &opt.Options{OpenFilesCacheCapacity: 3})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	storage := server.NewStorage(db)
+	stats, err := storage.Import(r, time.Now())
+	if err != nil {
+		return err
+	}
+	log.Info("snapshot imported", "imported", stats.Imported, "kept", stats.Kept, "expired", stats.Expired, "invalid", stats.Invalid)
+	return nil
+}
@@ -0,0 +1,25 @@
+package e2e
+
+import (
+	"testing"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/status-im/rendezvous/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnounceAddrs(t *testing.T) {
+	public := ma.StringCast("/ip4/203.0.113.7/tcp/9090")
+	srv := startServer(t, 7818, server.WithAnnounceAddrs(public))
+	require.Len(t, srv.Addrs(), 1)
+	require.Equal(t, public.String(), srv.Addr().Decapsulate(ma.StringCast("/ethv4/"+ethv4Value(t, srv.Addr()))).String())
+}
+
+func TestUnspecifiedListenAddr(t *testing.T) {
+	srv := startServer(t, 7819, server.WithListenAddrs(ma.StringCast("/ip4/0.0.0.0/tcp/7820")))
+	require.NotEmpty(t, srv.Addrs())
+	for _, addr := range srv.Addrs() {
+		require.False(t, manet.IsIPUnspecified(addr), addr.String())
+	}
+}
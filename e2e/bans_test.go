@@ -0,0 +1,30 @@
+package e2e
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/status-im/rendezvous"
+	"github.com/status-im/rendezvous/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientBanned(t *testing.T) {
+	srv := startServer(t, 7810)
+	client, err := rendezvous.NewEphemeral()
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.Register(context.TODO(), srv.Addr(), "any", signedRecord(t), 5*time.Second))
+
+	require.NoError(t, srv.Ban(server.Ban{Kind: server.BanIP, Target: "127.0.0.1"}))
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err = client.Discover(ctx, srv.Addr(), "any", 1)
+	require.Error(t, err)
+
+	require.NoError(t, srv.Unban(server.BanIP, "127.0.0.1"))
+	records, err := client.Discover(context.TODO(), srv.Addr(), "any", 1)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+}
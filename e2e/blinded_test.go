@@ -0,0 +1,39 @@
+package e2e
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/status-im/rendezvous"
+	"github.com/status-im/rendezvous/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientBlindedTopic(t *testing.T) {
+	srv := startServer(t, 7809)
+	client, err := rendezvous.NewEphemeral()
+	require.NoError(t, err)
+	defer client.Close()
+
+	topic := rendezvous.BlindedTopic{Secret: []byte("secret"), Name: "/app/chat", Period: time.Hour}
+	require.NoError(t, client.RegisterBlinded(context.TODO(), srv.Addr(), topic, signedRecord(t), 5*time.Second))
+	records, err := client.DiscoverBlinded(context.TODO(), srv.Addr(), topic, 2)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+
+	records, err = client.Discover(context.TODO(), srv.Addr(), "/app/chat", 2)
+	require.NoError(t, err)
+	require.Empty(t, records)
+
+	other := topic
+	other.Secret = []byte("other")
+	records, err = client.DiscoverBlinded(context.TODO(), srv.Addr(), other, 2)
+	require.NoError(t, err)
+	require.Empty(t, records)
+
+	other.Period = 0
+	require.ErrorIs(t, client.RegisterBlinded(context.TODO(), srv.Addr(), other, signedRecord(t), 5*time.Second), protocol.ErrInvalidPeriod)
+	_, err = client.DiscoverBlinded(context.TODO(), srv.Addr(), other, 2)
+	require.ErrorIs(t, err, protocol.ErrInvalidPeriod)
+}
@@ -0,0 +1,123 @@
+package e2e
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/status-im/rendezvous"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientCache(t *testing.T) {
+	srv := startServer(t, 7795)
+	client, err := rendezvous.NewEphemeral(rendezvous.WithCache(rendezvous.CacheConfig{
+		MaxStaleness: time.Minute,
+		MinTTL:       100 * time.Millisecond,
+	}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	record := signedRecord(t)
+	node, err := enode.New(enode.ValidSchemes, &record)
+	require.NoError(t, err)
+	require.NoError(t, client.Register(context.TODO(), srv.Addr(), "any", record, time.Second))
+	records, err := client.Discover(context.TODO(), srv.Addr(), "any", 1)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+
+	srv.Stop()
+	records, err = client.Discover(context.TODO(), srv.Addr(), "any", 1)
+	require.NoError(t, err, "record must be served from cache")
+	require.Len(t, records, 1)
+
+	client.InvalidateNode(node.ID())
+	_, err = client.Discover(context.TODO(), srv.Addr(), "any", 1)
+	require.Error(t, err)
+}
+
+func TestClientCacheExpiresWithTTL(t *testing.T) {
+	srv := startServer(t, 7796)
+	client, err := rendezvous.NewEphemeral(rendezvous.WithCache(rendezvous.CacheConfig{
+		MaxStaleness: time.Minute,
+		MinTTL:       time.Millisecond,
+	}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	require.NoError(t, client.Register(context.TODO(), srv.Addr(), "any", signedRecord(t), 200*time.Millisecond))
+	records, err := client.Discover(context.TODO(), srv.Addr(), "any", 1)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+
+	srv.Stop()
+	time.Sleep(300 * time.Millisecond)
+	_, err = client.Discover(context.TODO(), srv.Addr(), "any", 1)
+	require.Error(t, err)
+}
+
+func TestClientCacheCompleteTopic(t *testing.T) {
+	srv := startServer(t, 7849)
+	client, err := rendezvous.NewEphemeral(rendezvous.WithCache(rendezvous.CacheConfig{
+		MaxStaleness: time.Minute,
+		MinTTL:       100 * time.Millisecond,
+	}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	require.NoError(t, client.Register(context.TODO(), srv.Addr(), "any", signedRecord(t), time.Second))
+	records, err := client.Discover(context.TODO(), srv.Addr(), "any", 10)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+
+	// server had no more records, so the smaller result is served from cache too
+	srv.Stop()
+	records, err = client.Discover(context.TODO(), srv.Addr(), "any", 10)
+	require.NoError(t, err, "record must be served from cache")
+	require.Len(t, records, 1)
+}
+
+func TestClientCacheServerLimit(t *testing.T) {
+	srv := startServer(t, 7856)
+	client, err := rendezvous.NewEphemeral(rendezvous.WithCache(rendezvous.CacheConfig{
+		MaxStaleness: time.Minute,
+		MinTTL:       100 * time.Millisecond,
+	}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	info, err := client.Info(context.TODO(), srv.Addr())
+	require.NoError(t, err)
+	for i := 0; i <= info.MaxLimit; i++ {
+		require.NoError(t, client.Register(context.TODO(), srv.Addr(), "any", signedRecord(t), 10*time.Second))
+	}
+	records, err := client.Discover(context.TODO(), srv.Addr(), "any", info.MaxLimit)
+	require.NoError(t, err)
+	require.Len(t, records, info.MaxLimit)
+
+	// response was capped by the server, so it may have more records
+	srv.Stop()
+	_, err = client.Discover(context.TODO(), srv.Addr(), "any", info.MaxLimit+1)
+	require.Error(t, err)
+}
+
+func TestClientCacheZeroMinTTL(t *testing.T) {
+	srv := startServer(t, 7857)
+	client, err := rendezvous.NewEphemeral(rendezvous.WithCache(rendezvous.CacheConfig{
+		MaxStaleness: time.Minute,
+	}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	require.NoError(t, client.Register(context.TODO(), srv.Addr(), "any", signedRecord(t), time.Second))
+	records, err := client.Discover(context.TODO(), srv.Addr(), "any", 1)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+
+	// remaining TTL is below default MinTTL
+	srv.Stop()
+	records, err = client.Discover(context.TODO(), srv.Addr(), "any", 1)
+	require.NoError(t, err, "record must be served from cache")
+	require.Len(t, records, 1)
+}
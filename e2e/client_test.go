@@ -0,0 +1,191 @@
+package e2e
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	lcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/status-im/rendezvous"
+	"github.com/status-im/rendezvous/protocol"
+	"github.com/status-im/rendezvous/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientRejectedNotRetried(t *testing.T) {
+	srv := startServer(t, 7791)
+	client, err := rendezvous.NewEphemeral(rendezvous.WithRetryPolicy(rendezvous.RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 10 * time.Millisecond,
+	}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	err = client.Register(context.TODO(), srv.Addr(), "any", signedRecord(t), time.Hour)
+	require.ErrorIs(t, err, protocol.ErrInvalidTTL)
+	var perr *protocol.Error
+	require.True(t, errors.As(err, &perr))
+	require.NotEmpty(t, perr.Message)
+	var rerr *rendezvous.RequestError
+	require.True(t, errors.As(err, &rerr))
+	require.Equal(t, 1, rerr.Attempts)
+	require.False(t, rendezvous.IsTransient(err))
+}
+
+func TestClientReadTimeoutRetried(t *testing.T) {
+	// server that accepts streams but never replies
+	priv, _, err := lcrypto.GenerateSecp256k1Key(rand.Reader)
+	require.NoError(t, err)
+	h, err := libp2p.New(libp2p.Identity(priv), libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/7792"))
+	require.NoError(t, err)
+	defer h.Close()
+	h.SetStreamHandler(protocol.VERSION, func(s network.Stream) {
+		time.Sleep(time.Second)
+		s.Reset()
+	})
+	addr, err := ma.NewMultiaddr(fmt.Sprintf("/ip4/127.0.0.1/tcp/7792/ethv4/%s", h.ID()))
+	require.NoError(t, err)
+
+	client, err := rendezvous.NewEphemeral(
+		rendezvous.WithReadTimeout(50*time.Millisecond),
+		rendezvous.WithRetryPolicy(rendezvous.RetryPolicy{
+			MaxAttempts:    2,
+			InitialBackoff: 10 * time.Millisecond,
+		}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	start := time.Now()
+	_, err = client.Discover(context.TODO(), addr, "any", 1)
+	require.Less(t, time.Since(start), time.Second)
+	var rerr *rendezvous.RequestError
+	require.True(t, errors.As(err, &rerr))
+	require.Equal(t, 2, rerr.Attempts)
+	require.True(t, rendezvous.IsTransient(err))
+}
+
+func TestClientDiscoverRegistrations(t *testing.T) {
+	srv := startServer(t, 7793)
+	client, err := rendezvous.NewEphemeral()
+	require.NoError(t, err)
+	defer client.Close()
+
+	require.NoError(t, client.Register(context.TODO(), srv.Addr(), "any", signedRecord(t), 5*time.Second))
+	regs, err := client.DiscoverRegistrations(context.TODO(), srv.Addr(), "any", 1)
+	require.NoError(t, err)
+	require.Len(t, regs, 1)
+	require.True(t, regs[0].TTL > 4*time.Second && regs[0].TTL <= 5*time.Second)
+	require.WithinDuration(t, time.Now(), regs[0].Registered, 2*time.Second)
+}
+
+func TestClientProtocolVersions(t *testing.T) {
+	srv := startServer(t, 7794)
+	for _, versions := range [][]string{
+		{protocol.VERSION2, protocol.VERSION},
+		{protocol.VERSION},
+		{"/rend/9.0.0", protocol.VERSION},
+	} {
+		t.Run(versions[0], func(t *testing.T) {
+			client, err := rendezvous.NewEphemeral(rendezvous.WithProtocols(versions...))
+			require.NoError(t, err)
+			defer client.Close()
+
+			record := signedRecord(t)
+			require.NoError(t, client.Register(context.TODO(), srv.Addr(), versions[0], record, 5*time.Second))
+			regs, err := client.DiscoverRegistrations(context.TODO(), srv.Addr(), versions[0], 1)
+			require.NoError(t, err)
+			require.Len(t, regs, 1)
+			require.NotZero(t, regs[0].TTL)
+			require.False(t, regs[0].Registered.IsZero())
+		})
+	}
+
+	client, err := rendezvous.NewEphemeral(rendezvous.WithProtocols("/rend/9.0.0"))
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Discover(context.TODO(), srv.Addr(), "any", 1)
+	require.Error(t, err)
+}
+
+func TestClientTopics(t *testing.T) {
+	srv := startServer(t, 7804)
+	client, err := rendezvous.NewEphemeral()
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.Register(context.TODO(), srv.Addr(), "app/chat", signedRecord(t), 5*time.Second))
+	require.NoError(t, client.Register(context.TODO(), srv.Addr(), "app/chat", signedRecord(t), 5*time.Second))
+	require.NoError(t, client.Register(context.TODO(), srv.Addr(), "mail", signedRecord(t), 5*time.Second))
+
+	topics, err := client.Topics(context.TODO(), srv.Addr(), "")
+	require.NoError(t, err)
+	require.Equal(t, []rendezvous.TopicStat{{Topic: "app/chat", Count: 2}, {Topic: "mail", Count: 1}}, topics)
+	topics, err = client.Topics(context.TODO(), srv.Addr(), "app/")
+	require.NoError(t, err)
+	require.Equal(t, []rendezvous.TopicStat{{Topic: "app/chat", Count: 2}}, topics)
+
+	old, err := rendezvous.NewEphemeral(rendezvous.WithProtocols(protocol.VERSION))
+	require.NoError(t, err)
+	defer old.Close()
+	_, err = old.Topics(context.TODO(), srv.Addr(), "")
+	require.ErrorIs(t, err, rendezvous.ErrNotSupported)
+	require.False(t, rendezvous.IsTransient(err))
+}
+
+func TestClientTopicsDisabled(t *testing.T) {
+	srv := startServer(t, 7805, server.DisableTopics())
+	client, err := rendezvous.NewEphemeral()
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Topics(context.TODO(), srv.Addr(), "")
+	require.ErrorIs(t, err, protocol.ErrNotAuthorized)
+}
+
+func TestClientInfo(t *testing.T) {
+	srv := startServer(t, 7806)
+	client, err := rendezvous.NewEphemeral()
+	require.NoError(t, err)
+	defer client.Close()
+	info, err := client.Info(context.TODO(), srv.Addr())
+	require.NoError(t, err)
+	require.Equal(t, server.Version, info.Version)
+	require.Equal(t, 20*time.Second, info.LongestTTL)
+	require.Contains(t, info.Requests, protocol.INFO)
+	require.True(t, info.HasFeature(protocol.FeatureTopics))
+
+	old, err := rendezvous.NewEphemeral(rendezvous.WithProtocols(protocol.VERSION))
+	require.NoError(t, err)
+	defer old.Close()
+	_, err = old.Info(context.TODO(), srv.Addr())
+	require.ErrorIs(t, err, rendezvous.ErrNotSupported)
+}
+
+func TestClientTTLClamping(t *testing.T) {
+	srv := startServer(t, 7807)
+	client, err := rendezvous.NewEphemeral()
+	require.NoError(t, err)
+	defer client.Close()
+	err = client.Register(context.TODO(), srv.Addr(), "any", signedRecord(t), time.Hour)
+	require.ErrorIs(t, err, protocol.ErrInvalidTTL)
+
+	clamping, err := rendezvous.NewEphemeral(rendezvous.WithTTLClamping())
+	require.NoError(t, err)
+	defer clamping.Close()
+	require.NoError(t, clamping.Register(context.TODO(), srv.Addr(), "any", signedRecord(t), time.Hour))
+	regs, err := clamping.DiscoverRegistrations(context.TODO(), srv.Addr(), "any", 1)
+	require.NoError(t, err)
+	require.Len(t, regs, 1)
+	require.LessOrEqual(t, regs[0].TTL, 20*time.Second)
+
+	// servers without info request get ttl unchanged
+	old, err := rendezvous.NewEphemeral(rendezvous.WithProtocols(protocol.VERSION), rendezvous.WithTTLClamping())
+	require.NoError(t, err)
+	defer old.Close()
+	err = old.Register(context.TODO(), srv.Addr(), "any", signedRecord(t), time.Hour)
+	require.ErrorIs(t, err, protocol.ErrInvalidTTL)
+}
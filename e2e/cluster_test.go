@@ -0,0 +1,285 @@
+package e2e
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/rlp"
+	lcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	libp2pprotocol "github.com/libp2p/go-libp2p/core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/status-im/rendezvous"
+	"github.com/status-im/rendezvous/protocol"
+	"github.com/status-im/rendezvous/protocol/pb"
+	"github.com/status-im/rendezvous/server"
+	"github.com/stretchr/testify/require"
+)
+
+const clusterTopics = 20
+
+func clusterConfig(proxy bool, members ...federatedNode) server.ClusterConfig {
+	cfg := server.DefaultClusterConfig
+	cfg.Proxy = proxy
+	for _, m := range members {
+		cfg.Members = append(cfg.Members, m.addr)
+	}
+	return cfg
+}
+
+// localTopics returns topics stored by the server, TOPICS requests are not sharded.
+func localTopics(t *testing.T, client rendezvous.Client, srv *server.Server) []string {
+	stats, err := client.Topics(context.TODO(), srv.Addr(), "")
+	require.NoError(t, err)
+	rst := make([]string, len(stats))
+	for i := range stats {
+		rst[i] = stats[i].Topic
+	}
+	return rst
+}
+
+// topicCounts returns number of registrations stored by the server for every topic.
+func topicCounts(t *testing.T, client rendezvous.Client, srv *server.Server) map[string]int {
+	stats, err := client.Topics(context.TODO(), srv.Addr(), "")
+	require.NoError(t, err)
+	rst := make(map[string]int, len(stats))
+	for _, stat := range stats {
+		rst[stat.Topic] = stat.Count
+	}
+	return rst
+}
+
+// rawRegister sends REGISTER without following redirects and returns the response.
+func rawRegister(t *testing.T, srv *server.Server, topic string) protocol.RegisterResponse {
+	c := newSpecClient(t, mustGenerateKey(t))
+	info, err := peer.AddrInfoFromP2pAddr(p2pAddr(t, srv))
+	require.NoError(t, err)
+	require.NoError(t, c.h.Connect(context.TODO(), *info))
+	s, err := c.h.NewStream(context.TODO(), info.ID, libp2pprotocol.ID(protocol.CodecV2.ID))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, rlp.Encode(s, protocol.REGISTER))
+	require.NoError(t, rlp.Encode(s, protocol.Register{Topic: topic, Record: signedRecord(t), TTL: uint64(10 * time.Second)}))
+	rs := rlp.NewStream(s, 0)
+	typ, err := rs.Uint()
+	require.NoError(t, err)
+	require.Equal(t, protocol.REGISTER_RESPONSE, protocol.MessageType(typ))
+	var resp protocol.RegisterResponse
+	require.NoError(t, rs.Decode(&resp))
+	return resp
+}
+
+func TestClusterRedirect(t *testing.T) {
+	a, b := newFederatedNode(t, 7832), newFederatedNode(t, 7833)
+	srvA := a.serve(t, server.WithCluster(clusterConfig(false, a, b)))
+	srvB := b.serve(t, server.WithCluster(clusterConfig(false, a, b)))
+
+	client, err := rendezvous.NewEphemeral()
+	require.NoError(t, err)
+	defer client.Close()
+	for i := 0; i < clusterTopics; i++ {
+		require.NoError(t, client.Register(context.TODO(), srvA.Addr(), fmt.Sprintf("/t%d/chat", i), signedRecord(t), 10*time.Second))
+	}
+	onA, onB := localTopics(t, client, srvA), localTopics(t, client, srvB)
+	require.NotEmpty(t, onA)
+	require.NotEmpty(t, onB)
+	require.Len(t, append(onA, onB...), clusterTopics)
+	for i := 0; i < clusterTopics; i++ {
+		records, err := client.Discover(context.TODO(), srvB.Addr(), fmt.Sprintf("/t%d/*", i), 10)
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+	}
+
+	resp := rawRegister(t, srvA, onB[0])
+	require.Equal(t, protocol.E_REDIRECT, resp.Status)
+	owner, err := ma.NewMultiaddr(resp.Message)
+	require.NoError(t, err)
+	require.Equal(t, b.addr.String(), owner.String())
+	require.Equal(t, protocol.OK, rawRegister(t, srvA, onA[0]).Status)
+}
+
+func TestClusterProxy(t *testing.T) {
+	a, b := newFederatedNode(t, 7834), newFederatedNode(t, 7835)
+	srvA := a.serve(t, server.WithCluster(clusterConfig(true, a, b)))
+	srvB := b.serve(t, server.WithCluster(clusterConfig(true, a, b)))
+
+	client, err := rendezvous.NewEphemeral()
+	require.NoError(t, err)
+	defer client.Close()
+	for i := 0; i < clusterTopics; i++ {
+		require.Equal(t, protocol.OK, rawRegister(t, srvA, fmt.Sprintf("/t%d", i)).Status)
+	}
+	onB := localTopics(t, client, srvB)
+	require.NotEmpty(t, onB)
+	require.Len(t, append(localTopics(t, client, srvA), onB...), clusterTopics)
+	records, err := client.Discover(context.TODO(), srvA.Addr(), onB[0], 10)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+}
+
+func TestClusterRebalance(t *testing.T) {
+	a, b, c := newFederatedNode(t, 7836), newFederatedNode(t, 7837), newFederatedNode(t, 7838)
+	srvA := a.serve(t, server.WithCluster(clusterConfig(false, a, b)))
+	srvB := b.serve(t, server.WithCluster(clusterConfig(false, a, b)))
+
+	client, err := rendezvous.NewEphemeral()
+	require.NoError(t, err)
+	defer client.Close()
+	for i := 0; i < clusterTopics; i++ {
+		require.NoError(t, client.Register(context.TODO(), srvA.Addr(), fmt.Sprintf("/t%d", i), signedRecord(t), 10*time.Second))
+	}
+
+	// c joins the cluster
+	srvC := c.serve(t, server.WithCluster(clusterConfig(false, a, b, c)))
+	for _, srv := range []*server.Server{srvA, srvB} {
+		require.NoError(t, srv.SetClusterMembers([]ma.Multiaddr{a.addr, b.addr, c.addr}))
+	}
+	require.Eventually(t, func() bool {
+		return len(localTopics(t, client, srvC)) != 0 &&
+			len(localTopics(t, client, srvA))+len(localTopics(t, client, srvB))+len(localTopics(t, client, srvC)) == clusterTopics
+	}, 5*time.Second, 50*time.Millisecond)
+	for i := 0; i < clusterTopics; i++ {
+		records, err := client.Discover(context.TODO(), srvA.Addr(), fmt.Sprintf("/t%d", i), 10)
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+	}
+
+	// c is drained first, while other members still accept its records
+	require.NoError(t, srvC.SetClusterMembers([]ma.Multiaddr{a.addr, b.addr}))
+	require.Eventually(t, func() bool {
+		return len(localTopics(t, client, srvC)) == 0 &&
+			len(localTopics(t, client, srvA))+len(localTopics(t, client, srvB)) == clusterTopics
+	}, 5*time.Second, 50*time.Millisecond)
+	for _, srv := range []*server.Server{srvA, srvB} {
+		require.NoError(t, srv.SetClusterMembers([]ma.Multiaddr{a.addr, b.addr}))
+	}
+	for i := 0; i < clusterTopics; i++ {
+		records, err := client.Discover(context.TODO(), srvB.Addr(), fmt.Sprintf("/t%d", i), 10)
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+	}
+}
+
+func TestClusterHandoffRejected(t *testing.T) {
+	a, b := newFederatedNode(t, 7839), newFederatedNode(t, 7840)
+	srvA := a.serve(t, server.WithCluster(clusterConfig(false, a)))
+	srvB := b.serve(t, server.WithCluster(clusterConfig(false, a, b)))
+
+	client, err := rendezvous.NewEphemeral()
+	require.NoError(t, err)
+	defer client.Close()
+	banned := signedRecord(t)
+	require.NoError(t, srvB.Ban(server.Ban{Kind: server.BanNode, Target: hex.EncodeToString(enode.ValidSchemes.NodeAddr(&banned))}))
+	for i := 0; i < clusterTopics; i++ {
+		topic := fmt.Sprintf("/t%d", i)
+		require.NoError(t, client.Register(context.TODO(), srvA.Addr(), topic, banned, 10*time.Second))
+		require.NoError(t, client.Register(context.TODO(), srvA.Addr(), topic, signedRecord(t), 10*time.Second))
+	}
+
+	// b refuses records of the banned node, a keeps them
+	require.NoError(t, srvA.SetClusterMembers([]ma.Multiaddr{a.addr, b.addr}))
+	require.Eventually(t, func() bool {
+		onA, onB := topicCounts(t, client, srvA), topicCounts(t, client, srvB)
+		if len(onB) == 0 || len(onA) != clusterTopics {
+			return false
+		}
+		for topic, count := range onB {
+			if count != 1 || onA[topic] != 1 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestClusterProxyPrivateTopics(t *testing.T) {
+	owner, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	k, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	var record enr.Record
+	require.NoError(t, enode.SignV4(&record, k))
+	identity, err := lcrypto.UnmarshalSecp256k1PrivateKey(crypto.FromECDSA(k))
+	require.NoError(t, err)
+
+	var (
+		private []server.ServerOption
+		tokens  []rendezvous.ClientOption
+	)
+	for i := 0; i < clusterTopics; i++ {
+		namespace := fmt.Sprintf("/p%d", i)
+		private = append(private, server.WithPrivateTopic(namespace, &owner.PublicKey))
+		token, err := protocol.NewToken(owner, namespace, time.Now().Add(time.Hour), enode.PubkeyToIDV4(&k.PublicKey))
+		require.NoError(t, err)
+		tokens = append(tokens, rendezvous.WithToken(namespace, token))
+	}
+	a, b := newFederatedNode(t, 7843), newFederatedNode(t, 7844)
+	srvA := a.serve(t, append(private, server.WithCluster(clusterConfig(true, a, b)))...)
+	b.serve(t, append(private, server.WithCluster(clusterConfig(true, a, b)))...)
+
+	// owner checks the token against the client, not against the member that proxies the request
+	member, err := rendezvous.New(identity, tokens...)
+	require.NoError(t, err)
+	defer member.Close()
+	for i := 0; i < clusterTopics; i++ {
+		topic := fmt.Sprintf("/p%d/chat", i)
+		require.NoError(t, member.Register(context.TODO(), srvA.Addr(), topic, record, 10*time.Second))
+		records, err := member.Discover(context.TODO(), srvA.Addr(), topic, 1)
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+	}
+}
+
+func TestClusterProxyBannedPeer(t *testing.T) {
+	a, b := newFederatedNode(t, 7845), newFederatedNode(t, 7846)
+	srvA := a.serve(t, server.WithCluster(clusterConfig(true, a, b)))
+	srvB := b.serve(t, server.WithCluster(clusterConfig(true, a, b)))
+
+	client, err := rendezvous.NewEphemeral()
+	require.NoError(t, err)
+	defer client.Close()
+	for i := 0; i < clusterTopics; i++ {
+		require.NoError(t, client.Register(context.TODO(), srvA.Addr(), fmt.Sprintf("/t%d", i), signedRecord(t), 10*time.Second))
+	}
+	onB := localTopics(t, client, srvB)
+	require.NotEmpty(t, onB)
+
+	// client is banned only by the owner, it reaches it through the member
+	stranger := newSpecClient(t, mustGenerateKey(t))
+	require.NoError(t, srvB.Ban(server.Ban{Kind: server.BanPeer, Target: stranger.h.ID().String()}))
+	banned, err := rendezvous.NewWithHost(stranger.h)
+	require.NoError(t, err)
+	_, err = banned.Discover(context.TODO(), srvA.Addr(), onB[0], 1)
+	require.ErrorIs(t, err, protocol.ErrNotAuthorized)
+	require.ErrorIs(t, banned.Register(context.TODO(), srvA.Addr(), onB[0], signedRecord(t), 10*time.Second), protocol.ErrNotAuthorized)
+}
+
+func TestClusterSpecUnavailable(t *testing.T) {
+	a, b := newFederatedNode(t, 7847), newFederatedNode(t, 7848)
+	srvA := a.serve(t, server.WithCluster(clusterConfig(true, a, b)))
+	srvB := b.serve(t, server.WithCluster(clusterConfig(true, a, b)))
+
+	spec := newSpecClient(t, mustGenerateKey(t))
+	served := 0
+	for i := 0; i < clusterTopics; i++ {
+		topic := fmt.Sprintf("/t%d", i)
+		resp := spec.request(srvA, &pb.Message{Type: pb.REGISTER, Register: &pb.Register{Ns: topic, SignedPeerRecord: spec.envelope(), Ttl: 60}})
+		if resp.RegisterResponse.Status == pb.OK {
+			served++
+			continue
+		}
+		// namespace is owned by b and must be registered there
+		require.Equal(t, pb.E_UNAVAILABLE, resp.RegisterResponse.Status)
+		require.Contains(t, resp.RegisterResponse.StatusText, b.addr.String())
+		resp = spec.request(srvB, &pb.Message{Type: pb.REGISTER, Register: &pb.Register{Ns: topic, SignedPeerRecord: spec.envelope(), Ttl: 60}})
+		require.Equal(t, pb.OK, resp.RegisterResponse.Status, resp.RegisterResponse.StatusText)
+	}
+	require.NotZero(t, served)
+	require.Less(t, served, clusterTopics)
+}
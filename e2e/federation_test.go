@@ -0,0 +1,154 @@
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+
+	lcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/status-im/rendezvous"
+	"github.com/status-im/rendezvous/protocol"
+	"github.com/status-im/rendezvous/protocol/pb"
+	"github.com/status-im/rendezvous/server"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+type federatedNode struct {
+	priv lcrypto.PrivKey
+	port int
+	addr ma.Multiaddr
+}
+
+func newFederatedNode(t *testing.T, port int) federatedNode {
+	priv, pub, err := lcrypto.GenerateSecp256k1Key(rand.Reader)
+	require.NoError(t, err)
+	id, err := peer.IDFromPublicKey(pub)
+	require.NoError(t, err)
+	return federatedNode{priv: priv, port: port, addr: ma.StringCast(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d/ethv4/%s", port, id))}
+}
+
+func (n federatedNode) start(t *testing.T, cfg server.FederationConfig, peers ...federatedNode) *server.Server {
+	for _, p := range peers {
+		cfg.Peers = append(cfg.Peers, p.addr)
+	}
+	return n.serve(t, server.WithFederation(cfg))
+}
+
+// serve starts server with the identity and port of the node.
+func (n federatedNode) serve(t *testing.T, opts ...server.ServerOption) *server.Server {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	require.NoError(t, err)
+	srv := server.NewServer(ma.StringCast(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", n.port)), n.priv, server.NewStorage(db), opts...)
+	require.NoError(t, srv.Start())
+	t.Cleanup(srv.Stop)
+	return srv
+}
+
+// waitStartupSync waits until servers sync with their peers on start. Records fetched by sync
+// are not forwarded, so sync racing with a push would stop the record on the first hop.
+func waitStartupSync() {
+	time.Sleep(200 * time.Millisecond)
+}
+
+func discovered(t *testing.T, client rendezvous.Client, srv *server.Server, topic string) func() int {
+	return func() int {
+		records, err := client.Discover(context.TODO(), srv.Addr(), topic, 10)
+		require.NoError(t, err)
+		return len(records)
+	}
+}
+
+func TestFederationPush(t *testing.T) {
+	cfg := server.FederationConfig{SyncInterval: time.Hour, MaxHops: 2}
+	a, b, c := newFederatedNode(t, 7824), newFederatedNode(t, 7825), newFederatedNode(t, 7826)
+	srvA := a.start(t, cfg, b)
+	srvB := b.start(t, cfg, a, c)
+	srvC := c.start(t, cfg, b)
+	waitStartupSync()
+
+	client, err := rendezvous.NewEphemeral()
+	require.NoError(t, err)
+	defer client.Close()
+	record := signedRecord(t)
+	require.NoError(t, client.Register(context.TODO(), srvA.Addr(), "/app/chat", record, 10*time.Second))
+
+	for _, srv := range []*server.Server{srvB, srvC} {
+		count := discovered(t, client, srv, "/app/chat")
+		require.Eventually(t, func() bool { return count() == 1 }, 5*time.Second, 50*time.Millisecond)
+	}
+	regs, err := client.DiscoverRegistrations(context.TODO(), srvC.Addr(), "/app/chat", 1)
+	require.NoError(t, err)
+	require.Len(t, regs, 1)
+	require.True(t, regs[0].TTL > 0 && regs[0].TTL <= 10*time.Second, regs[0].TTL)
+
+	node := hex.EncodeToString(protocol.ValidSchemes.NodeAddr(&record))
+	require.NoError(t, srvA.Ban(server.Ban{Kind: server.BanNode, Target: node}))
+	for _, srv := range []*server.Server{srvB, srvC} {
+		count := discovered(t, client, srv, "/app/chat")
+		require.Eventually(t, func() bool { return count() == 0 }, 5*time.Second, 50*time.Millisecond)
+	}
+}
+
+func TestFederationHopLimit(t *testing.T) {
+	cfg := server.FederationConfig{SyncInterval: time.Hour, MaxHops: 1}
+	a, b, c := newFederatedNode(t, 7827), newFederatedNode(t, 7828), newFederatedNode(t, 7829)
+	srvA := a.start(t, cfg, b)
+	srvB := b.start(t, cfg, a, c)
+	srvC := c.start(t, cfg, b)
+	waitStartupSync()
+
+	client, err := rendezvous.NewEphemeral()
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.Register(context.TODO(), srvA.Addr(), "/app/chat", signedRecord(t), 10*time.Second))
+	count := discovered(t, client, srvB, "/app/chat")
+	require.Eventually(t, func() bool { return count() == 1 }, 5*time.Second, 50*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, 0, discovered(t, client, srvC, "/app/chat")())
+}
+
+func TestFederationSync(t *testing.T) {
+	cfg := server.FederationConfig{SyncInterval: 100 * time.Millisecond, MaxHops: 1}
+	a, b := newFederatedNode(t, 7830), newFederatedNode(t, 7831)
+	srvA := a.start(t, cfg, b)
+
+	client, err := rendezvous.NewEphemeral()
+	require.NoError(t, err)
+	defer client.Close()
+	// b is down, so the push is lost
+	require.NoError(t, client.Register(context.TODO(), srvA.Addr(), "/app/chat", signedRecord(t), 10*time.Second))
+	time.Sleep(100 * time.Millisecond)
+
+	srvB := b.start(t, cfg, a)
+	count := discovered(t, client, srvB, "/app/chat")
+	require.Eventually(t, func() bool { return count() == 1 }, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestFederationSpecRegistration(t *testing.T) {
+	cfg := server.FederationConfig{SyncInterval: time.Hour, MaxHops: 1}
+	a, b := newFederatedNode(t, 7841), newFederatedNode(t, 7842)
+	srvA := a.start(t, cfg, b)
+	srvB := b.start(t, cfg, a)
+
+	// libp2p rendezvous registrations live longer than rlp ones, envelope is replicated
+	// with the detached record
+	spec := newSpecClient(t, mustGenerateKey(t))
+	envelope := spec.envelope(manyAddrs(t)...)
+	resp := spec.request(srvA, &pb.Message{Type: pb.REGISTER, Register: &pb.Register{Ns: "/app/chat", SignedPeerRecord: envelope, Ttl: 3600}})
+	require.Equal(t, pb.OK, resp.RegisterResponse.Status, resp.RegisterResponse.StatusText)
+
+	other := newSpecClient(t, mustGenerateKey(t))
+	require.Eventually(t, func() bool {
+		resp := other.request(srvB, &pb.Message{Type: pb.DISCOVER, Discover: &pb.Discover{Ns: "/app/chat"}})
+		return resp.DiscoverResponse.Status == pb.OK && len(resp.DiscoverResponse.Registrations) == 1 &&
+			bytes.Equal(envelope, resp.DiscoverResponse.Registrations[0].SignedPeerRecord)
+	}, 5*time.Second, 50*time.Millisecond)
+}
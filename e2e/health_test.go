@@ -0,0 +1,43 @@
+package e2e
+
+import (
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	lcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/status-im/rendezvous/server"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func probe(h http.Handler) int {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	return rec.Code
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	priv, _, err := lcrypto.GenerateSecp256k1Key(rand.Reader)
+	require.NoError(t, err)
+	laddr, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/7811")
+	require.NoError(t, err)
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	require.NoError(t, err)
+	srv := server.NewServer(laddr, priv, server.NewStorage(db))
+	healthz, readyz := server.HealthHandler(srv.Healthy), server.HealthHandler(srv.Ready)
+
+	require.Equal(t, http.StatusOK, probe(healthz))
+	require.Equal(t, http.StatusServiceUnavailable, probe(readyz))
+
+	require.NoError(t, srv.Start())
+	defer srv.Stop()
+	require.Equal(t, http.StatusOK, probe(healthz))
+	require.Equal(t, http.StatusOK, probe(readyz))
+
+	require.NoError(t, db.Close())
+	require.Equal(t, http.StatusServiceUnavailable, probe(readyz))
+}
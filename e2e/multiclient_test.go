@@ -0,0 +1,110 @@
+package e2e
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	lcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/status-im/rendezvous"
+	"github.com/status-im/rendezvous/server"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func startServer(t *testing.T, port int, opts ...server.ServerOption) *server.Server {
+	priv, _, err := lcrypto.GenerateSecp256k1Key(rand.Reader)
+	require.NoError(t, err)
+	laddr, err := ma.NewMultiaddr(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", port))
+	require.NoError(t, err)
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	require.NoError(t, err)
+	srv := server.NewServer(laddr, priv, server.NewStorage(db), opts...)
+	require.NoError(t, srv.Start())
+	t.Cleanup(srv.Stop)
+	return srv
+}
+
+// unreachableAddr returns address of the server that is not running.
+func unreachableAddr(t *testing.T, port int) ma.Multiaddr {
+	_, pub, err := lcrypto.GenerateSecp256k1Key(rand.Reader)
+	require.NoError(t, err)
+	id, err := peer.IDFromPublicKey(pub)
+	require.NoError(t, err)
+	addr, err := ma.NewMultiaddr(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d/ethv4/%s", port, id))
+	require.NoError(t, err)
+	return addr
+}
+
+func signedRecord(t *testing.T) enr.Record {
+	k, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	record := enr.Record{}
+	record.Set(enr.IP{10, 0, 10, 24})
+	record.Set(enr.TCP(8087))
+	require.NoError(t, enode.SignV4(&record, k))
+	return record
+}
+
+func TestMultiClientQuorum(t *testing.T) {
+	first := startServer(t, 7781)
+	second := startServer(t, 7782)
+	servers := []ma.Multiaddr{first.Addr(), second.Addr(), unreachableAddr(t, 7783)}
+
+	client, err := rendezvous.NewEphemeral()
+	require.NoError(t, err)
+	defer client.Close()
+
+	mc, err := rendezvous.NewMultiClient(client, servers, rendezvous.WithReplicas(3), rendezvous.WithQuorum(2))
+	require.NoError(t, err)
+	record := signedRecord(t)
+	require.NoError(t, mc.Register(context.TODO(), "any", record, 5*time.Second))
+
+	records, err := mc.Discover(context.TODO(), "any", 10)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, enode.ValidSchemes.NodeAddr(&record), enode.ValidSchemes.NodeAddr(&records[0]))
+
+	mc, err = rendezvous.NewMultiClient(client, servers, rendezvous.WithReplicas(3), rendezvous.WithQuorum(3))
+	require.NoError(t, err)
+	require.ErrorIs(t, mc.Register(context.TODO(), "any", record, 5*time.Second), rendezvous.ErrQuorumNotReached)
+}
+
+func TestMultiClientDiscoverLimit(t *testing.T) {
+	first := startServer(t, 7784)
+	second := startServer(t, 7785)
+
+	client, err := rendezvous.NewEphemeral()
+	require.NoError(t, err)
+	defer client.Close()
+
+	for _, srv := range []*server.Server{first, second} {
+		for i := 0; i < 3; i++ {
+			require.NoError(t, client.Register(context.TODO(), srv.Addr(), "any", signedRecord(t), 5*time.Second))
+		}
+	}
+	mc, err := rendezvous.NewMultiClient(client, []ma.Multiaddr{first.Addr(), second.Addr()}, rendezvous.WithParallelism(1))
+	require.NoError(t, err)
+	records, err := mc.Discover(context.TODO(), "any", 5)
+	require.NoError(t, err)
+	require.Len(t, records, 5)
+}
+
+func TestMultiClientAllServersFailed(t *testing.T) {
+	client, err := rendezvous.NewEphemeral()
+	require.NoError(t, err)
+	defer client.Close()
+
+	mc, err := rendezvous.NewMultiClient(client, []ma.Multiaddr{unreachableAddr(t, 7786)})
+	require.NoError(t, err)
+	_, err = mc.Discover(context.TODO(), "any", 1)
+	require.Error(t, err)
+}
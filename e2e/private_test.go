@@ -0,0 +1,48 @@
+package e2e
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	lcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/status-im/rendezvous"
+	"github.com/status-im/rendezvous/protocol"
+	"github.com/status-im/rendezvous/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientPrivateTopic(t *testing.T) {
+	owner, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	srv := startServer(t, 7808, server.WithPrivateTopic("/app", &owner.PublicKey))
+
+	// the same key is used for the record and for the client identity, so that
+	// token issued for the node can be used for both requests
+	k, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	var record enr.Record
+	require.NoError(t, enode.SignV4(&record, k))
+	identity, err := lcrypto.UnmarshalSecp256k1PrivateKey(crypto.FromECDSA(k))
+	require.NoError(t, err)
+	token, err := protocol.NewToken(owner, "/app", time.Now().Add(time.Hour), enode.PubkeyToIDV4(&k.PublicKey))
+	require.NoError(t, err)
+
+	member, err := rendezvous.New(identity, rendezvous.WithToken("/app", token))
+	require.NoError(t, err)
+	defer member.Close()
+	require.NoError(t, member.Register(context.TODO(), srv.Addr(), "/app/chat", record, 5*time.Second))
+	records, err := member.Discover(context.TODO(), srv.Addr(), "/app/chat", 1)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+
+	stranger, err := rendezvous.NewEphemeral(rendezvous.WithToken("/app", token))
+	require.NoError(t, err)
+	defer stranger.Close()
+	_, err = stranger.Discover(context.TODO(), srv.Addr(), "/app/chat", 1)
+	require.ErrorIs(t, err, protocol.ErrNotAuthorized)
+	require.ErrorIs(t, stranger.Register(context.TODO(), srv.Addr(), "/app/chat", signedRecord(t), 5*time.Second), protocol.ErrNotAuthorized)
+}
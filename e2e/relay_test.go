@@ -0,0 +1,96 @@
+package e2e
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/status-im/rendezvous"
+	"github.com/status-im/rendezvous/protocol"
+	"github.com/status-im/rendezvous/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterRelayed(t *testing.T) {
+	srv := startServer(t, 7822, server.WithRelay(server.DefaultRelayResources))
+
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	require.NoError(t, err)
+	natted, err := rendezvous.NewWithHost(h)
+	require.NoError(t, err)
+	defer natted.Close()
+	info, err := natted.Info(context.TODO(), srv.Addr())
+	require.NoError(t, err)
+	require.Contains(t, info.Features, protocol.FeatureRelay)
+	k, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	var record enr.Record
+	require.NoError(t, enode.SignV4(&record, k))
+	expiry, err := natted.RegisterRelayed(context.TODO(), srv.Addr(), "/app/chat", record, k, 10*time.Second)
+	require.NoError(t, err)
+	require.True(t, expiry.After(time.Now()))
+
+	peerh, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	require.NoError(t, err)
+	other, err := rendezvous.NewWithHost(peerh)
+	require.NoError(t, err)
+	defer other.Close()
+	records, err := other.Discover(context.TODO(), srv.Addr(), "/app/chat", 1)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	relayed, err := protocol.RelayAddr(&records[0])
+	require.NoError(t, err)
+	target, err := peer.AddrInfoFromP2pAddr(relayed)
+	require.NoError(t, err)
+	require.Equal(t, h.ID(), target.ID)
+	require.NoError(t, peerh.Connect(context.TODO(), *target))
+	conns := peerh.Network().ConnsToPeer(h.ID())
+	require.NotEmpty(t, conns)
+	_, err = conns[0].RemoteMultiaddr().ValueForProtocol(ma.P_CIRCUIT)
+	require.NoError(t, err)
+}
+
+func TestInvalidRelayAddr(t *testing.T) {
+	srv := startServer(t, 7823, server.WithRelay(server.DefaultRelayResources))
+	client, err := rendezvous.NewEphemeral()
+	require.NoError(t, err)
+	defer client.Close()
+	k, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	var record enr.Record
+	record.Set(protocol.Relay(ma.StringCast("/ip4/127.0.0.1/tcp/7823").Bytes()))
+	require.NoError(t, enode.SignV4(&record, k))
+	require.ErrorIs(t, client.Register(context.TODO(), srv.Addr(), "/app/chat", record, 10*time.Second), protocol.ErrInvalidENR)
+}
+
+func TestForeignRelayAddr(t *testing.T) {
+	srv := startServer(t, 7850, server.WithRelay(server.DefaultRelayResources))
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	require.NoError(t, err)
+	client, err := rendezvous.NewWithHost(h)
+	require.NoError(t, err)
+	defer client.Close()
+	other, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	require.NoError(t, err)
+	defer other.Close()
+
+	register := func(relayed string) error {
+		k, err := crypto.GenerateKey()
+		require.NoError(t, err)
+		var record enr.Record
+		require.NoError(t, protocol.SetRelayAddr(&record, ma.StringCast(relayed)))
+		require.NoError(t, enode.SignV4(&record, k))
+		return client.Register(context.TODO(), srv.Addr(), "/app/chat", record, 10*time.Second)
+	}
+	// relayed through a third party
+	require.ErrorIs(t, register("/ip4/127.0.0.1/tcp/7850/p2p/"+other.ID().String()+"/p2p-circuit/p2p/"+h.ID().String()), protocol.ErrInvalidENR)
+	// relayed to another peer
+	require.ErrorIs(t, register(p2pAddr(t, srv).String()+"/p2p-circuit/p2p/"+other.ID().String()), protocol.ErrInvalidENR)
+	require.NoError(t, register(p2pAddr(t, srv).String()+"/p2p-circuit/p2p/"+h.ID().String()))
+}
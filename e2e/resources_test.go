@@ -0,0 +1,43 @@
+package e2e
+
+import (
+	"testing"
+	"time"
+
+	"github.com/status-im/rendezvous/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamsPerPeerLimit(t *testing.T) {
+	limits := server.DefaultResourceLimits
+	limits.StreamsPerPeer = 1
+	srv := startServer(t, 7821, server.WithResourceLimits(limits))
+	c := newSpecClient(t, mustGenerateKey(t))
+	_, err := openStreamFrom(c, srv)
+	require.NoError(t, err)
+	_, err = openStreamFrom(c, srv)
+	require.Error(t, err)
+
+	// other peers are not affected
+	_, err = openStreamFrom(newSpecClient(t, mustGenerateKey(t)), srv)
+	require.NoError(t, err)
+}
+
+func TestStreamsPerPeerLimitBan(t *testing.T) {
+	limits := server.DefaultResourceLimits
+	limits.StreamsPerPeer = 1
+	scoring := server.DefaultScoreConfig
+	scoring.Penalties = map[server.Penalty]float64{server.PenaltyRateLimit: 60}
+	srv := startServer(t, 7855, server.WithResourceLimits(limits), server.WithScoring(scoring))
+	c := newSpecClient(t, mustGenerateKey(t))
+	_, err := openStreamFrom(c, srv)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = openStreamFrom(c, srv)
+		require.Error(t, err)
+	}
+	require.Eventually(t, func() bool {
+		bans := srv.Bans()
+		return len(bans) == 1 && bans[0].Kind == server.BanPeer && bans[0].Target == c.h.ID().String()
+	}, 5*time.Second, 50*time.Millisecond)
+}
@@ -0,0 +1,71 @@
+package e2e
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	libp2pprotocol "github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/status-im/rendezvous/protocol"
+	"github.com/status-im/rendezvous/server"
+	"github.com/stretchr/testify/require"
+)
+
+// openStream opens rlp protocol stream and serves one INFO request on it, so that handler
+// waits for the next request.
+func openStream(t *testing.T, srv *server.Server) network.Stream {
+	s, err := openStreamFrom(newSpecClient(t, mustGenerateKey(t)), srv)
+	require.NoError(t, err)
+	return s
+}
+
+func openStreamFrom(c *specClient, srv *server.Server) (network.Stream, error) {
+	info, err := peer.AddrInfoFromP2pAddr(p2pAddr(c.t, srv))
+	if err != nil {
+		return nil, err
+	}
+	if err := c.h.Connect(context.TODO(), *info); err != nil {
+		return nil, err
+	}
+	s, err := c.h.NewStream(context.TODO(), info.ID, libp2pprotocol.ID(protocol.CodecV2.ID))
+	if err != nil {
+		return nil, err
+	}
+	if err := rlp.Encode(s, protocol.INFO); err != nil {
+		return nil, err
+	}
+	if err := rlp.Encode(s, protocol.Info{}); err != nil {
+		return nil, err
+	}
+	rs := rlp.NewStream(s, 0)
+	if _, err := rs.Uint(); err != nil {
+		return nil, err
+	}
+	var resp protocol.InfoResponse
+	return s, rs.Decode(&resp)
+}
+
+func TestShutdownClosesIdleStreams(t *testing.T) {
+	srv := startServer(t, 7812)
+	openStream(t, srv)
+	start := time.Now()
+	require.NoError(t, srv.Shutdown(context.TODO()))
+	require.Less(t, time.Since(start), time.Second)
+	require.Error(t, srv.Ready())
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	srv := startServer(t, 7813)
+	s := openStream(t, srv)
+	// request type without body keeps the handler busy until read timeout
+	require.NoError(t, rlp.Encode(s, protocol.REGISTER))
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	require.ErrorIs(t, srv.Shutdown(ctx), context.DeadlineExceeded)
+	require.Less(t, time.Since(start), time.Second)
+}
@@ -0,0 +1,243 @@
+package e2e
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	lcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/record"
+	"github.com/libp2p/go-msgio"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/status-im/rendezvous"
+	"github.com/status-im/rendezvous/protocol"
+	"github.com/status-im/rendezvous/protocol/pb"
+	"github.com/status-im/rendezvous/server"
+	"github.com/stretchr/testify/require"
+)
+
+// specClient speaks libp2p rendezvous protocol.
+type specClient struct {
+	t    *testing.T
+	h    host.Host
+	priv lcrypto.PrivKey
+}
+
+func newSpecClient(t *testing.T, priv lcrypto.PrivKey) *specClient {
+	h, err := libp2p.New(libp2p.Identity(priv), libp2p.NoListenAddrs)
+	require.NoError(t, err)
+	t.Cleanup(func() { h.Close() })
+	return &specClient{t: t, h: h, priv: priv}
+}
+
+func (c *specClient) envelope(addrs ...ma.Multiaddr) []byte {
+	rec := peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: c.h.ID(), Addrs: addrs})
+	env, err := record.Seal(rec, c.priv)
+	require.NoError(c.t, err)
+	data, err := env.Marshal()
+	require.NoError(c.t, err)
+	return data
+}
+
+func (c *specClient) request(srv *server.Server, req *pb.Message) *pb.Message {
+	info, err := peer.AddrInfoFromP2pAddr(p2pAddr(c.t, srv))
+	require.NoError(c.t, err)
+	require.NoError(c.t, c.h.Connect(context.TODO(), *info))
+	s, err := c.h.NewStream(context.TODO(), info.ID, pb.PROTOCOL)
+	require.NoError(c.t, err)
+	defer s.Close()
+	require.NoError(c.t, msgio.NewVarintWriter(s).WriteMsg(req.Marshal()))
+	if req.Type == pb.UNREGISTER {
+		return nil
+	}
+	data, err := msgio.NewVarintReaderSize(s, 1<<16).ReadMsg()
+	require.NoError(c.t, err)
+	var resp pb.Message
+	require.NoError(c.t, resp.Unmarshal(data))
+	return &resp
+}
+
+func p2pAddr(t *testing.T, srv *server.Server) ma.Multiaddr {
+	id, err := peer.Decode(ethv4Value(t, srv.Addr()))
+	require.NoError(t, err)
+	parts := ma.Split(srv.Addr())
+	addr, err := ma.NewMultiaddr(parts[0].String() + parts[1].String() + "/p2p/" + id.String())
+	require.NoError(t, err)
+	return addr
+}
+
+func ethv4Value(t *testing.T, addr ma.Multiaddr) string {
+	parts := ma.Split(addr)
+	v := parts[len(parts)-1].String()
+	return v[len("/ethv4/"):]
+}
+
+func TestSpecClientDiscoveredByRLPClient(t *testing.T) {
+	srv := startServer(t, 7801)
+	spec := newSpecClient(t, mustGenerateKey(t))
+	addr, err := ma.NewMultiaddr("/ip4/10.0.0.1/tcp/4001")
+	require.NoError(t, err)
+
+	resp := spec.request(srv, &pb.Message{Type: pb.REGISTER, Register: &pb.Register{Ns: "any", SignedPeerRecord: spec.envelope(addr), Ttl: 60}})
+	require.Equal(t, pb.OK, resp.RegisterResponse.Status, resp.RegisterResponse.StatusText)
+	require.Equal(t, uint64(60), resp.RegisterResponse.Ttl)
+
+	client, err := rendezvous.NewEphemeral()
+	require.NoError(t, err)
+	defer client.Close()
+	records, err := client.Discover(context.TODO(), srv.Addr(), "any", 1)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, protocol.PeerRecordID, records[0].IdentityScheme())
+	_, pr, err := protocol.ConsumePeerRecord(&records[0])
+	require.NoError(t, err)
+	require.Equal(t, spec.h.ID(), pr.PeerID)
+	require.Equal(t, []ma.Multiaddr{addr}, pr.Addrs)
+
+	spec.request(srv, &pb.Message{Type: pb.UNREGISTER, Unregister: &pb.Unregister{Ns: "any"}})
+	require.Eventually(t, func() bool {
+		records, err := client.Discover(context.TODO(), srv.Addr(), "any", 1)
+		return err == nil && len(records) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRLPClientDiscoveredBySpecClient(t *testing.T) {
+	srv := startServer(t, 7802)
+	spec := newSpecClient(t, mustGenerateKey(t))
+	addr, err := ma.NewMultiaddr("/ip4/10.0.0.1/tcp/4001")
+	require.NoError(t, err)
+
+	// rlp client registers signed peer record wrapped into enr
+	r, err := protocol.WrapPeerRecord(spec.envelope(addr))
+	require.NoError(t, err)
+	client, err := rendezvous.NewEphemeral()
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.Register(context.TODO(), srv.Addr(), "any", r, 5*time.Second))
+	// registration without signed peer record is not visible to libp2p clients
+	require.NoError(t, client.Register(context.TODO(), srv.Addr(), "any", signedRecord(t), 5*time.Second))
+
+	other := newSpecClient(t, mustGenerateKey(t))
+	resp := other.request(srv, &pb.Message{Type: pb.DISCOVER, Discover: &pb.Discover{Ns: "any"}})
+	require.Equal(t, pb.OK, resp.DiscoverResponse.Status, resp.DiscoverResponse.StatusText)
+	require.Len(t, resp.DiscoverResponse.Registrations, 1)
+	_, rec, err := record.ConsumeEnvelope(resp.DiscoverResponse.Registrations[0].SignedPeerRecord, peer.PeerRecordEnvelopeDomain)
+	require.NoError(t, err)
+	require.Equal(t, spec.h.ID(), rec.(*peer.PeerRecord).PeerID)
+
+	// cookie returns only new registrations
+	resp = other.request(srv, &pb.Message{Type: pb.DISCOVER, Discover: &pb.Discover{Ns: "any", Cookie: resp.DiscoverResponse.Cookie}})
+	require.Equal(t, pb.OK, resp.DiscoverResponse.Status)
+	require.Empty(t, resp.DiscoverResponse.Registrations)
+
+	resp = other.request(srv, &pb.Message{Type: pb.DISCOVER, Discover: &pb.Discover{Ns: "other", Cookie: resp.DiscoverResponse.Cookie}})
+	require.Equal(t, pb.E_INVALID_COOKIE, resp.DiscoverResponse.Status)
+}
+
+func TestSpecRegisterForeignRecord(t *testing.T) {
+	srv := startServer(t, 7803)
+	owner := newSpecClient(t, mustGenerateKey(t))
+	other := newSpecClient(t, mustGenerateKey(t))
+	resp := other.request(srv, &pb.Message{Type: pb.REGISTER, Register: &pb.Register{Ns: "any", SignedPeerRecord: owner.envelope()}})
+	require.Equal(t, pb.E_NOT_AUTHORIZED, resp.RegisterResponse.Status)
+}
+
+func TestSpecMissingMessage(t *testing.T) {
+	srv := startServer(t, 7852)
+	spec := newSpecClient(t, mustGenerateKey(t))
+	resp := spec.request(srv, &pb.Message{Type: pb.REGISTER})
+	require.Equal(t, pb.E_INVALID_SIGNED_PEER_RECORD, resp.RegisterResponse.Status)
+	// discover without message asks for all namespaces
+	resp = spec.request(srv, &pb.Message{Type: pb.DISCOVER})
+	require.Equal(t, pb.OK, resp.DiscoverResponse.Status)
+}
+
+func TestSpecDiscoverAllNamespaces(t *testing.T) {
+	srv := startServer(t, 7854)
+	for _, ns := range []string{"a", "b", "/app/chat"} {
+		spec := newSpecClient(t, mustGenerateKey(t))
+		resp := spec.request(srv, &pb.Message{Type: pb.REGISTER, Register: &pb.Register{Ns: ns, SignedPeerRecord: spec.envelope(), Ttl: 60}})
+		require.Equal(t, pb.OK, resp.RegisterResponse.Status, resp.RegisterResponse.StatusText)
+	}
+
+	other := newSpecClient(t, mustGenerateKey(t))
+	var (
+		namespaces []string
+		cookie     []byte
+	)
+	for i := 0; i < 3; i++ {
+		resp := other.request(srv, &pb.Message{Type: pb.DISCOVER, Discover: &pb.Discover{Limit: 1, Cookie: cookie}})
+		require.Equal(t, pb.OK, resp.DiscoverResponse.Status, resp.DiscoverResponse.StatusText)
+		require.Len(t, resp.DiscoverResponse.Registrations, 1)
+		namespaces = append(namespaces, resp.DiscoverResponse.Registrations[0].Ns)
+		cookie = resp.DiscoverResponse.Cookie
+	}
+	require.Equal(t, []string{"a", "b", "/app/chat"}, namespaces)
+
+	resp := other.request(srv, &pb.Message{Type: pb.DISCOVER, Discover: &pb.Discover{Cookie: cookie}})
+	require.Equal(t, pb.OK, resp.DiscoverResponse.Status)
+	require.Empty(t, resp.DiscoverResponse.Registrations)
+
+	// cookie of all namespaces can't be used for a single one
+	resp = other.request(srv, &pb.Message{Type: pb.DISCOVER, Discover: &pb.Discover{Ns: "a", Cookie: cookie}})
+	require.Equal(t, pb.E_INVALID_COOKIE, resp.DiscoverResponse.Status)
+}
+
+// manyAddrs are addresses of an ordinary go-libp2p host, its signed peer record doesn't fit into enr.
+func manyAddrs(t *testing.T) []ma.Multiaddr {
+	var addrs []ma.Multiaddr
+	for _, s := range []string{
+		"/ip4/10.0.0.1/tcp/4001",
+		"/ip4/10.0.0.1/udp/4001/quic-v1",
+		"/ip4/10.0.0.1/udp/4001/quic-v1/webtransport/certhash/uEiDDq4_xNyDorZBH3TlGazyJdOWSwvo4PUo5YHFMrvDE8g/certhash/uEiBfa9mPg7o4hMaXb0gjeYbENhG0Ztd4Am0-JY5KT49eCw",
+		"/ip4/192.168.1.10/tcp/4001",
+		"/ip6/2001:db8::1/tcp/4001",
+		"/ip6/2001:db8::1/udp/4001/quic-v1",
+	} {
+		addr, err := ma.NewMultiaddr(s)
+		require.NoError(t, err)
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+func TestSpecManyAddresses(t *testing.T) {
+	srv := startServer(t, 7853)
+	spec := newSpecClient(t, mustGenerateKey(t))
+	envelope := spec.envelope(manyAddrs(t)...)
+	_, err := protocol.WrapPeerRecord(envelope)
+	require.Error(t, err)
+
+	resp := spec.request(srv, &pb.Message{Type: pb.REGISTER, Register: &pb.Register{Ns: "any", SignedPeerRecord: envelope, Ttl: 60}})
+	require.Equal(t, pb.OK, resp.RegisterResponse.Status, resp.RegisterResponse.StatusText)
+
+	other := newSpecClient(t, mustGenerateKey(t))
+	resp = other.request(srv, &pb.Message{Type: pb.DISCOVER, Discover: &pb.Discover{Ns: "any"}})
+	require.Equal(t, pb.OK, resp.DiscoverResponse.Status, resp.DiscoverResponse.StatusText)
+	require.Len(t, resp.DiscoverResponse.Registrations, 1)
+	require.Equal(t, envelope, resp.DiscoverResponse.Registrations[0].SignedPeerRecord)
+
+	// rlp clients can't verify detached records
+	client, err := rendezvous.NewEphemeral()
+	require.NoError(t, err)
+	defer client.Close()
+	records, err := client.Discover(context.TODO(), srv.Addr(), "any", 10)
+	require.NoError(t, err)
+	require.Empty(t, records)
+
+	// record that fits into enr replaces the detached one
+	resp = spec.request(srv, &pb.Message{Type: pb.REGISTER, Register: &pb.Register{Ns: "any", SignedPeerRecord: spec.envelope(manyAddrs(t)[0]), Ttl: 60}})
+	require.Equal(t, pb.OK, resp.RegisterResponse.Status, resp.RegisterResponse.StatusText)
+	records, err = client.Discover(context.TODO(), srv.Addr(), "any", 10)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+}
+
+func mustGenerateKey(t *testing.T) lcrypto.PrivKey {
+	priv, _, err := lcrypto.GenerateSecp256k1Key(nil)
+	require.NoError(t, err)
+	return priv
+}
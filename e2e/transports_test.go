@@ -0,0 +1,49 @@
+package e2e
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/status-im/rendezvous"
+	"github.com/status-im/rendezvous/server"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestMultipleTransports(t *testing.T) {
+	addrs := []string{"/ip4/127.0.0.1/udp/7815/quic-v1", "/ip4/127.0.0.1/tcp/7816/ws"}
+	if l, err := net.Listen("tcp6", "[::1]:0"); err == nil {
+		l.Close()
+		addrs = append(addrs, "/ip6/::1/tcp/7817")
+	}
+	laddrs := make([]ma.Multiaddr, len(addrs))
+	for i := range addrs {
+		laddrs[i] = ma.StringCast(addrs[i])
+	}
+	srv := startServer(t, 7814, server.WithListenAddrs(laddrs...))
+	require.Len(t, srv.Addrs(), len(addrs)+1)
+	require.Equal(t, srv.Addrs()[0], srv.Addr())
+
+	for i, addr := range srv.Addrs() {
+		client, err := rendezvous.NewEphemeral()
+		require.NoError(t, err)
+		topic := "transport" + string(rune('a'+i))
+		require.NoError(t, client.Register(context.TODO(), addr, topic, signedRecord(t), 5*time.Second), addr.String())
+		records, err := client.Discover(context.TODO(), addr, topic, 1)
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+		require.NoError(t, client.Close())
+	}
+}
+
+func TestUnsupportedTransport(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	require.NoError(t, err)
+	srv := server.NewServer(ma.StringCast("/ip4/127.0.0.1/tcp/7851"), mustGenerateKey(t), server.NewStorage(db),
+		server.WithListenAddrs(ma.StringCast("/ip4/127.0.0.1/udp/7815")))
+	require.Error(t, srv.Start())
+}
@@ -0,0 +1,50 @@
+package rendezvous
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/status-im/rendezvous/protocol"
+)
+
+var (
+	// ErrUnexpectedResponse is returned when server replied with a message of the wrong type.
+	ErrUnexpectedResponse = errors.New("unexpected response type")
+	// ErrNotSupported is returned when negotiated protocol version doesn't have the request.
+	ErrNotSupported = errors.New("request is not supported by the server")
+)
+
+// RequestError wraps the last error of a request after all attempts were made.
+type RequestError struct {
+	Op       string
+	Server   ma.Multiaddr
+	Attempts int
+	Err      error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("%s request to %s failed after %d attempt(s): %v", e.Op, e.Server, e.Attempts, e.Err)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// IsTransient reports whether the request that failed with err may succeed if retried.
+// Network failures and E_INTERNAL_ERROR responses are transient, requests rejected
+// with any other status, unsupported requests and cancelled contexts are not.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, ErrUnexpectedResponse) || errors.Is(err, ErrNotSupported) {
+		return false
+	}
+	var perr *protocol.Error
+	if errors.As(err, &perr) {
+		return perr.Status == protocol.E_INTERNAL_ERROR
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+package rendezvous
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/status-im/rendezvous/protocol"
+)
+
+// infoRefreshPeriod is how long server info is used for clamping TTLs before it is requested again.
+const infoRefreshPeriod = 10 * time.Minute
+
+// ServerInfo describes server version, limits and capabilities.
+type ServerInfo struct {
+	Version string
+	// LongestTTL is the maximal TTL accepted by Register.
+	LongestTTL time.Duration
+	// MaxLimit is the maximal number of records returned by Discover.
+	MaxLimit       int
+	MaxTopicLength int
+	// Requests are request types supported by negotiated protocol version.
+	Requests []protocol.MessageType
+	// Features are enabled optional features, see protocol.Feature constants.
+	Features []string
+	Uptime   time.Duration
+}
+
+// HasFeature returns true if server reported the feature as enabled.
+func (i ServerInfo) HasFeature(feature string) bool {
+	for _, f := range i.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// WithTTLClamping makes Register lower TTL to the longest TTL accepted by the server instead
+// of failing with E_INVALID_TTL. Limits are learned with Info request and kept for a while.
+// Servers that don't support Info request, or fail to answer it, get TTL unchanged.
+func WithTTLClamping() ClientOption {
+	return func(c *Client) {
+		c.infos = &infoCache{infos: map[string]cachedInfo{}}
+	}
+}
+
+// Info returns server version, limits and capabilities. It requires VERSION2, ErrNotSupported
+// is returned for older servers.
+func (c Client) Info(ctx context.Context, srv ma.Multiaddr) (info ServerInfo, err error) {
+	err = c.request(ctx, srv, "info", func(s network.Stream) error {
+		codec := protocol.CodecFor(string(s.Protocol()))
+		if codec == nil || !codec.Supports(protocol.INFO) {
+			return ErrNotSupported
+		}
+		if err := c.send(s, protocol.INFO, protocol.Info{}); err != nil {
+			return err
+		}
+		var val protocol.InfoResponse
+		if err := c.receive(s, protocol.INFO_RESPONSE, &val); err != nil {
+			return err
+		}
+		if val.Status != protocol.OK {
+			return protocol.NewError(val.Status, val.Message)
+		}
+		logger.Debug("received response to info request", "status", val.Status, "version", val.Version)
+		info = ServerInfo{
+			Version:        val.Version,
+			LongestTTL:     time.Duration(val.LongestTTL),
+			MaxLimit:       int(val.MaxLimit),
+			MaxTopicLength: int(val.MaxTopicLength),
+			Requests:       val.Requests,
+			Features:       val.Features,
+			Uptime:         time.Duration(val.Uptime) * time.Second,
+		}
+		return nil
+	})
+	return info, err
+}
+
+// clampTTL lowers ttl to the longest TTL accepted by the server.
+func (c Client) clampTTL(ctx context.Context, srv ma.Multiaddr, ttl time.Duration) time.Duration {
+	info := c.serverInfo(ctx, c.infos, srv)
+	if info.LongestTTL > 0 && ttl > info.LongestTTL {
+		return info.LongestTTL
+	}
+	return ttl
+}
+
+// serverInfo returns info of the server from infos or requests it. Failed Info request is cached
+// as info without limits, so that servers without Info request are not asked every time.
+func (c Client) serverInfo(ctx context.Context, infos *infoCache, srv ma.Multiaddr) ServerInfo {
+	info, ok := infos.get(srv, time.Now())
+	if ok {
+		return info
+	}
+	info, err := c.Info(ctx, srv)
+	if err != nil {
+		logger.Debug("can't get server info", "server", srv, "error", err)
+		if ctx.Err() != nil {
+			return ServerInfo{}
+		}
+		info = ServerInfo{}
+	}
+	infos.put(srv, info, time.Now())
+	return info
+}
+
+type cachedInfo struct {
+	info    ServerInfo
+	fetched time.Time
+}
+
+type infoCache struct {
+	mu    sync.Mutex
+	infos map[string]cachedInfo
+}
+
+func (c *infoCache) get(srv ma.Multiaddr, now time.Time) (ServerInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, exist := c.infos[srv.String()]
+	if !exist || now.Sub(cached.fetched) > infoRefreshPeriod {
+		return ServerInfo{}, false
+	}
+	return cached.info, true
+}
+
+func (c *infoCache) put(srv ma.Multiaddr, info ServerInfo, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.infos[srv.String()] = cachedInfo{info: info, fetched: now}
+}
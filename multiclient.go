@@ -0,0 +1,257 @@
+package rendezvous
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/status-im/rendezvous/protocol"
+)
+
+const (
+	defaultReplicas    = 3
+	defaultParallelism = 3
+	defaultQuorum      = 1
+
+	maxHealthScore = 10
+	minHealthScore = -10
+	successReward  = 1
+	failurePenalty = 3
+
+	// failing server gets its score reset after this period, so that it is tried again.
+	healthRecoveryPeriod = time.Minute
+)
+
+// ErrQuorumNotReached is returned by MultiClient.Register when less servers than
+// required accepted the registration.
+var ErrQuorumNotReached = errors.New("registration quorum not reached")
+
+// MultiClientOption configures MultiClient.
+type MultiClientOption func(*MultiClient)
+
+// WithReplicas sets how many servers each registration is sent to.
+func WithReplicas(n int) MultiClientOption {
+	return func(mc *MultiClient) {
+		mc.replicas = n
+	}
+}
+
+// WithParallelism limits how many requests are in flight at the same time.
+func WithParallelism(n int) MultiClientOption {
+	return func(mc *MultiClient) {
+		mc.parallelism = n
+	}
+}
+
+// WithQuorum sets how many servers must accept a registration for it to succeed.
+func WithQuorum(n int) MultiClientOption {
+	return func(mc *MultiClient) {
+		mc.quorum = n
+	}
+}
+
+// NewMultiClient creates a client that spreads requests over a set of rendezvous servers.
+func NewMultiClient(c Client, servers []ma.Multiaddr, opts ...MultiClientOption) (*MultiClient, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("at least one server is required")
+	}
+	mc := &MultiClient{
+		client:      c,
+		replicas:    defaultReplicas,
+		parallelism: defaultParallelism,
+		quorum:      defaultQuorum,
+	}
+	for _, opt := range opts {
+		opt(mc)
+	}
+	if mc.replicas < 1 || mc.parallelism < 1 || mc.quorum < 1 {
+		return nil, errors.New("replicas, parallelism and quorum must be positive")
+	}
+	if mc.quorum > mc.replicas {
+		return nil, fmt.Errorf("quorum %d is higher than the number of replicas %d", mc.quorum, mc.replicas)
+	}
+	for _, addr := range servers {
+		mc.servers = append(mc.servers, &serverHealth{addr: addr})
+	}
+	return mc, nil
+}
+
+// MultiClient registers and discovers records using several rendezvous servers.
+// Servers that fail are penalized and tried after the healthy ones.
+type MultiClient struct {
+	client Client
+
+	replicas    int
+	parallelism int
+	quorum      int
+
+	mu      sync.Mutex
+	servers []*serverHealth
+}
+
+type serverHealth struct {
+	addr        ma.Multiaddr
+	score       int
+	lastFailure time.Time
+}
+
+type serverResult struct {
+	addr    ma.Multiaddr
+	records []enr.Record
+	err     error
+}
+
+// Register sends registration to the configured number of replicas, moving on to the
+// next server when one fails. It fails if less than quorum servers accepted the record.
+func (mc *MultiClient) Register(ctx context.Context, topic string, record enr.Record, ttl time.Duration) error {
+	servers := mc.ordered()
+	target := mc.replicas
+	if target > len(servers) {
+		target = len(servers)
+	}
+	quorum := mc.quorum
+	if quorum > target {
+		quorum = target
+	}
+	results := make(chan serverResult)
+	var (
+		next, inflight, succeeded int
+		lastErr                   error
+	)
+	for succeeded < target {
+		for inflight < mc.parallelism && next < len(servers) && succeeded+inflight < target {
+			go func(addr ma.Multiaddr) {
+				results <- serverResult{addr: addr, err: mc.client.Register(ctx, addr, topic, record, ttl)}
+			}(servers[next])
+			next++
+			inflight++
+		}
+		if inflight == 0 {
+			break
+		}
+		r := <-results
+		inflight--
+		mc.report(r.addr, r.err)
+		if r.err != nil {
+			logger.Debug("registration failed", "server", r.addr, "error", r.err)
+			lastErr = r.err
+			continue
+		}
+		succeeded++
+	}
+	if succeeded < quorum {
+		return fmt.Errorf("%w: %d of %d servers accepted registration, last error: %v", ErrQuorumNotReached, succeeded, quorum, lastErr)
+	}
+	return nil
+}
+
+// Discover queries servers until limit unique records are collected or all servers were asked.
+// Records are deduplicated by node ID. Error is returned only if every server failed.
+func (mc *MultiClient) Discover(ctx context.Context, topic string, limit int) (rst []enr.Record, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	servers := mc.ordered()
+	// buffered so that requests which are still running after limit was reached don't block
+	results := make(chan serverResult, len(servers))
+	seen := map[string]struct{}{}
+	var (
+		next, inflight, failed int
+		lastErr                error
+	)
+	for len(rst) < limit {
+		for inflight < mc.parallelism && next < len(servers) {
+			go func(addr ma.Multiaddr) {
+				records, err := mc.client.Discover(ctx, addr, topic, limit)
+				results <- serverResult{addr: addr, records: records, err: err}
+			}(servers[next])
+			next++
+			inflight++
+		}
+		if inflight == 0 {
+			break
+		}
+		r := <-results
+		inflight--
+		mc.report(r.addr, r.err)
+		if r.err != nil {
+			logger.Debug("discovery failed", "server", r.addr, "error", r.err)
+			lastErr = r.err
+			failed++
+			continue
+		}
+		for i := range r.records {
+			id := string(protocol.ValidSchemes.NodeAddr(&r.records[i]))
+			if _, exist := seen[id]; exist {
+				continue
+			}
+			seen[id] = struct{}{}
+			rst = append(rst, r.records[i])
+			if len(rst) == limit {
+				break
+			}
+		}
+	}
+	if failed == next && next > 0 {
+		return nil, fmt.Errorf("discovery failed on all %d servers, last error: %w", failed, lastErr)
+	}
+	return rst, nil
+}
+
+// report updates health score of the server.
+func (mc *MultiClient) report(addr ma.Multiaddr, err error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for _, s := range mc.servers {
+		if !s.addr.Equal(addr) {
+			continue
+		}
+		if err != nil {
+			s.score -= failurePenalty
+			if s.score < minHealthScore {
+				s.score = minHealthScore
+			}
+			s.lastFailure = time.Now()
+		} else {
+			s.score += successReward
+			if s.score > maxHealthScore {
+				s.score = maxHealthScore
+			}
+		}
+		return
+	}
+}
+
+// ordered returns servers sorted by health score. Servers with the same score are shuffled
+// so that load is spread between them.
+func (mc *MultiClient) ordered() []ma.Multiaddr {
+	mc.mu.Lock()
+	servers := make([]*serverHealth, len(mc.servers))
+	copy(servers, mc.servers)
+	scores := make(map[*serverHealth]int, len(servers))
+	now := time.Now()
+	for _, s := range servers {
+		if s.score < 0 && now.Sub(s.lastFailure) > healthRecoveryPeriod {
+			s.score = 0
+		}
+		scores[s] = s.score
+	}
+	mc.mu.Unlock()
+
+	rand.Shuffle(len(servers), func(i, j int) {
+		servers[i], servers[j] = servers[j], servers[i]
+	})
+	sort.SliceStable(servers, func(i, j int) bool {
+		return scores[servers[i]] > scores[servers[j]]
+	})
+	rst := make([]ma.Multiaddr, len(servers))
+	for i := range servers {
+		rst[i] = servers[i].addr
+	}
+	return rst
+}
@@ -1,6 +1,7 @@
 package prometheus
 
 import (
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/status-im/rendezvous/server"
 )
@@ -31,10 +32,31 @@ var (
 		Namespace: "rendezvous",
 		Help:      "Number of errors labeled by the type of operation.",
 	}, []string{"operation"})
+
+	penaltiesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:      "penalties",
+		Namespace: "rendezvous",
+		Help:      "Number of penalties labeled by the kind of misbehavior.",
+	}, []string{"penalty"})
+
+	peerScoreHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:      "peer_score",
+		Namespace: "rendezvous",
+		Help:      "Score of peers after each penalty.",
+		Buckets:   []float64{-100, -80, -60, -40, -20, -10, 0},
+	})
+
+	penalizedPeersGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:      "penalized_peers",
+		Namespace: "rendezvous",
+		Help:      "Number of peers that misbehaved recently.",
+	})
 )
 
 func UsePrometheus() {
-	prometheus.MustRegister(registerationsGauge, discoverySize, discoveryDuration, errorsCounter)
+	prometheus.MustRegister(registerationsGauge, discoverySize, discoveryDuration, errorsCounter, penaltiesCounter, peerScoreHistogram, penalizedPeersGauge)
+	// usage of the resource manager created by the server
+	rcmgr.MustRegisterWith(prometheus.DefaultRegisterer)
 	server.UseMetrics(prometheusMetrics{})
 }
 
@@ -59,3 +81,15 @@ func (n prometheusMetrics) ObserveDiscoveryDuration(o float64, lvs ...string) {
 func (n prometheusMetrics) CountError(lvs ...string) {
 	errorsCounter.WithLabelValues(lvs...).Inc()
 }
+
+func (n prometheusMetrics) CountPenalty(lvs ...string) {
+	penaltiesCounter.WithLabelValues(lvs...).Inc()
+}
+
+func (n prometheusMetrics) ObservePeerScore(o float64) {
+	peerScoreHistogram.Observe(o)
+}
+
+func (n prometheusMetrics) SetPenalizedPeers(o float64) {
+	penalizedPeersGauge.Set(o)
+}
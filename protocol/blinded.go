@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+)
+
+// BlindedTopicPrefix marks opaque binary topics, e.g. created with BlindTopic. Such topics are
+// not split into namespaces and may contain any byte except 0xff.
+const BlindedTopicPrefix = "\x00"
+
+// IsBlinded returns true if topic is an opaque binary topic.
+func IsBlinded(topic string) bool {
+	return len(topic) > len(BlindedTopicPrefix) && strings.HasPrefix(topic, BlindedTopicPrefix)
+}
+
+// BlindTopic derives opaque topic from the topic name and the secret shared by members of
+// the application, so that server can't learn the name. Topic changes every epoch.
+func BlindTopic(secret []byte, name string, epoch uint64) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(name))
+	var buf [9]byte
+	binary.BigEndian.PutUint64(buf[1:], epoch)
+	mac.Write(buf[:])
+	sum := mac.Sum(nil)
+	for i := range sum {
+		// 0xff separates topic from node address in server storage
+		if sum[i] == 0xff {
+			sum[i] = 0xfe
+		}
+	}
+	return BlindedTopicPrefix + string(sum)
+}
+
+// ErrInvalidPeriod is returned for period of the topic rotation that is not positive.
+var ErrInvalidPeriod = errors.New("period must be positive")
+
+// Epoch returns number of the period that contains t.
+func Epoch(t time.Time, period time.Duration) (uint64, error) {
+	if period <= 0 {
+		return 0, ErrInvalidPeriod
+	}
+	return uint64(t.UnixNano() / int64(period)), nil
+}
@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlindTopic(t *testing.T) {
+	secret := []byte("secret")
+	topic := BlindTopic(secret, "/app/chat", 1)
+	require.Equal(t, topic, BlindTopic(secret, "/app/chat", 1))
+	require.NotEqual(t, topic, BlindTopic(secret, "/app/chat", 2))
+	require.NotEqual(t, topic, BlindTopic([]byte("other"), "/app/chat", 1))
+	require.True(t, IsBlinded(topic))
+	require.NoError(t, ValidateTopic(topic))
+	for epoch := uint64(0); epoch < 1000; epoch++ {
+		require.Equal(t, -1, strings.IndexByte(BlindTopic(secret, "/app/chat", epoch), 0xff))
+	}
+	require.Equal(t, []string{topic}, Namespaces(topic))
+	require.False(t, InNamespace(topic, BlindedTopicPrefix))
+
+	require.False(t, IsBlinded(BlindedTopicPrefix))
+	require.Error(t, ValidateTopic(BlindedTopicPrefix+"a\xffb"))
+}
+
+func TestEpoch(t *testing.T) {
+	start := time.Unix(3600, 0)
+	for _, tc := range []struct {
+		t     time.Time
+		epoch uint64
+	}{{start, 1}, {start.Add(time.Hour - 1), 1}, {start.Add(time.Hour), 2}} {
+		epoch, err := Epoch(tc.t, time.Hour)
+		require.NoError(t, err)
+		require.Equal(t, tc.epoch, epoch)
+	}
+	_, err := Epoch(start, 0)
+	require.ErrorIs(t, err, ErrInvalidPeriod)
+	_, err = Epoch(start, -time.Hour)
+	require.ErrorIs(t, err, ErrInvalidPeriod)
+}
@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"errors"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// ShardKey returns the part of the topic that decides which cluster member owns it: the top level
+// namespace, so that a namespace with all its topics and wildcard patterns is served by a single
+// member. Blinded topics are their own keys.
+func ShardKey(topic string) string {
+	if namespace, wildcard, err := ParseWildcard(topic); wildcard && err == nil {
+		topic = namespace
+	}
+	namespaces := Namespaces(topic)
+	if len(namespaces) == 0 {
+		return ""
+	}
+	return namespaces[len(namespaces)-1]
+}
+
+// NewRedirect creates E_REDIRECT error that points to the owner of the topic.
+func NewRedirect(owner ma.Multiaddr) *Error {
+	return NewError(E_REDIRECT, owner.String())
+}
+
+// RedirectAddr returns owner multiaddr if err is E_REDIRECT.
+func RedirectAddr(err error) (ma.Multiaddr, bool) {
+	var perr *Error
+	if !errors.As(err, &perr) || perr.Status != E_REDIRECT {
+		return nil, false
+	}
+	addr, err := ma.NewMultiaddr(perr.Message)
+	if err != nil {
+		return nil, false
+	}
+	return addr, true
+}
@@ -0,0 +1,32 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardKey(t *testing.T) {
+	require.Equal(t, "/app", ShardKey("/app/chat/1"))
+	require.Equal(t, "/app", ShardKey("/app/*"))
+	require.Equal(t, "/app", ShardKey("/app"))
+	require.Equal(t, "app", ShardKey("app/chat"))
+	blinded := BlindTopic([]byte("secret"), "/app/chat", 1)
+	require.Equal(t, blinded, ShardKey(blinded))
+}
+
+func TestRedirectAddr(t *testing.T) {
+	owner := ma.StringCast("/ip4/10.0.0.2/tcp/9090")
+	addr, ok := RedirectAddr(fmt.Errorf("register: %w", NewRedirect(owner)))
+	require.True(t, ok)
+	require.True(t, owner.Equal(addr))
+	require.ErrorIs(t, NewRedirect(owner), ErrRedirect)
+
+	_, ok = RedirectAddr(NewError(E_REDIRECT, "not an address"))
+	require.False(t, ok)
+	_, ok = RedirectAddr(errors.New("other"))
+	require.False(t, ok)
+}
@@ -0,0 +1,72 @@
+package protocol
+
+import "sort"
+
+// Codec is a registry of requests supported by a protocol version.
+type Codec struct {
+	ID       string
+	requests map[MessageType]func() interface{}
+}
+
+// NewCodec creates empty codec for the protocol id.
+func NewCodec(id string) *Codec {
+	return &Codec{ID: id, requests: map[MessageType]func() interface{}{}}
+}
+
+// Register adds request type. newRequest returns pointer to the value that request is decoded to.
+func (c *Codec) Register(typ MessageType, newRequest func() interface{}) *Codec {
+	c.requests[typ] = newRequest
+	return c
+}
+
+// NewRequest returns value for decoding request of the type, false if type is not supported.
+func (c *Codec) NewRequest(typ MessageType) (interface{}, bool) {
+	newRequest, exist := c.requests[typ]
+	if !exist {
+		return nil, false
+	}
+	return newRequest(), true
+}
+
+// Supports returns true if request type is a part of the protocol version.
+func (c *Codec) Supports(typ MessageType) bool {
+	_, exist := c.requests[typ]
+	return exist
+}
+
+// Requests returns supported request types in ascending order.
+func (c *Codec) Requests() []MessageType {
+	rst := make([]MessageType, 0, len(c.requests))
+	for typ := range c.requests {
+		rst = append(rst, typ)
+	}
+	sort.Slice(rst, func(i, j int) bool { return rst[i] < rst[j] })
+	return rst
+}
+
+var (
+	CodecV1 = NewCodec(VERSION).
+		Register(REGISTER, func() interface{} { return &Register{} }).
+		Register(DISCOVER, func() interface{} { return &Discover{} }).
+		Register(REMOTEIP, func() interface{} { return &RemoteIp{} })
+
+	CodecV2 = NewCodec(VERSION2).
+		Register(REGISTER, func() interface{} { return &Register{} }).
+		Register(DISCOVER, func() interface{} { return &DiscoverV2{} }).
+		Register(REMOTEIP, func() interface{} { return &RemoteIp{} }).
+		Register(TOPICS, func() interface{} { return &Topics{} }).
+		Register(INFO, func() interface{} { return &Info{} })
+
+	// Codecs lists supported protocol versions, preferred first.
+	Codecs = []*Codec{CodecV2, CodecV1}
+)
+
+// CodecFor returns codec for the protocol id, nil if version is not supported.
+func CodecFor(id string) *Codec {
+	for _, c := range Codecs {
+		if c.ID == id {
+			return c
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package protocol
+
+import "fmt"
+
+// Error is a rejection returned by the server. It carries response status and
+// a human-readable reason provided by the server.
+type Error struct {
+	Status  ResponseStatus
+	Message string
+}
+
+// NewError creates an error for the non-OK status.
+func NewError(status ResponseStatus, message string) *Error {
+	return &Error{Status: status, Message: message}
+}
+
+func (e *Error) Error() string {
+	if len(e.Message) == 0 {
+		return e.Status.String()
+	}
+	return fmt.Sprintf("%v: %s", e.Status, e.Message)
+}
+
+// Is matches errors with the same status, so that errors.Is(err, ErrInvalidTTL)
+// holds regardless of the message.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	return t.Status == e.Status
+}
+
+var (
+	ErrInvalidNamespace = &Error{Status: E_INVALID_NAMESPACE}
+	ErrInvalidENR       = &Error{Status: E_INVALID_ENR}
+	ErrInvalidTTL       = &Error{Status: E_INVALID_TTL}
+	ErrInvalidLimit     = &Error{Status: E_INVALID_LIMIT}
+	ErrInvalidContent   = &Error{Status: E_INVALID_CONTENT}
+	ErrNotAuthorized    = &Error{Status: E_NOT_AUTHORIZED}
+	ErrInternalError    = &Error{Status: E_INTERNAL_ERROR}
+	ErrRedirect         = &Error{Status: E_REDIRECT}
+)
+
+func (s ResponseStatus) String() string {
+	switch s {
+	case OK:
+		return "OK"
+	case E_INVALID_NAMESPACE:
+		return "E_INVALID_NAMESPACE"
+	case E_INVALID_ENR:
+		return "E_INVALID_ENR"
+	case E_INVALID_TTL:
+		return "E_INVALID_TTL"
+	case E_INVALID_LIMIT:
+		return "E_INVALID_LIMIT"
+	case E_INVALID_CONTENT:
+		return "E_INVALID_CONTENT"
+	case E_NOT_AUTHORIZED:
+		return "E_NOT_AUTHORIZED"
+	case E_INTERNAL_ERROR:
+		return "E_INTERNAL_ERROR"
+	case E_REDIRECT:
+		return "E_REDIRECT"
+	default:
+		return fmt.Sprintf("ResponseStatus(%d)", uint(s))
+	}
+}
@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// FederationVersion is a protocol spoken between federated servers. Every stream carries a
+// single request: FEDERATION_UPDATE pushed to the peer and answered with FEDERATION_ACK once it is
+// applied, FEDERATION_SYNC answered with FEDERATION_UPDATE that holds records of the topics
+// with different digests, or FEDERATION_PROXY answered with the response to the proxied request.
+const FederationVersion = "/rend/federation/0.1.0"
+
+const (
+	FEDERATION_UPDATE MessageType = iota
+	FEDERATION_SYNC
+	FEDERATION_ACK
+	FEDERATION_PROXY
+)
+
+// FederatedRecord is a registration replicated with its original deadline.
+type FederatedRecord struct {
+	Topic  string
+	Record enr.Record
+	// Deadline and Registered are unix time in nanoseconds.
+	Deadline   uint64
+	Registered uint64
+	// Hops is the number of times the record may be forwarded to the next server.
+	Hops uint
+	// Envelope is signed peer record of the detached ENR, see DetachPeerRecord.
+	Envelope []byte         `rlp:"optional"`
+	Rest     []rlp.RawValue `rlp:"tail"`
+}
+
+// FederatedExpiration removes registration of the node before its deadline. Registrations with
+// higher sequence number or later deadline are kept.
+type FederatedExpiration struct {
+	Topic    string
+	Node     []byte
+	Seq      uint64
+	Deadline uint64
+	Hops     uint
+	Rest     []rlp.RawValue `rlp:"tail"`
+}
+
+// FederationUpdate carries new registrations and expirations.
+type FederationUpdate struct {
+	Records     []FederatedRecord
+	Expirations []FederatedExpiration
+	Rest        []rlp.RawValue `rlp:"tail"`
+}
+
+// TopicDigest is a hash of node addresses, sequence numbers and deadlines of all registrations
+// under the topic.
+type TopicDigest struct {
+	Topic  string
+	Digest []byte
+	Rest   []rlp.RawValue `rlp:"tail"`
+}
+
+// FederationSync asks for registrations of topics whose digests differ from the sender's ones.
+type FederationSync struct {
+	Topics []TopicDigest
+	Rest   []rlp.RawValue `rlp:"tail"`
+}
+
+// FederationAck confirms that update was applied. Records refused by the peer, e.g. registrations
+// of nodes it bans, are listed by their index in FederationUpdate.Records. Records that are older
+// than the stored ones are not refused.
+type FederationAck struct {
+	Rejected []uint
+	Rest     []rlp.RawValue `rlp:"tail"`
+}
+
+// ProxiedRequest is a request of a client forwarded by a cluster member to the owner of the
+// topic, so that owner checks it as if it was sent by the client.
+type ProxiedRequest struct {
+	// Peer and Addr are the libp2p peer ID and the remote multiaddr of the client, in binary form.
+	Peer []byte
+	Addr []byte
+	// Version is the protocol the request was sent with.
+	Version string
+	Type    MessageType
+	Request rlp.RawValue
+	Rest    []rlp.RawValue `rlp:"tail"`
+}
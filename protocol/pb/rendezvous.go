@@ -0,0 +1,322 @@
+// Package pb implements messages of the libp2p rendezvous protocol, see rendezvous.proto.
+package pb
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const PROTOCOL = "/rendezvous/1.0.0"
+
+type MessageType int32
+
+const (
+	REGISTER          MessageType = 0
+	REGISTER_RESPONSE MessageType = 1
+	UNREGISTER        MessageType = 2
+	DISCOVER          MessageType = 3
+	DISCOVER_RESPONSE MessageType = 4
+)
+
+type ResponseStatus int32
+
+const (
+	OK                           ResponseStatus = 0
+	E_INVALID_NAMESPACE          ResponseStatus = 100
+	E_INVALID_SIGNED_PEER_RECORD ResponseStatus = 101
+	E_INVALID_TTL                ResponseStatus = 102
+	E_INVALID_COOKIE             ResponseStatus = 103
+	E_NOT_AUTHORIZED             ResponseStatus = 200
+	E_INTERNAL_ERROR             ResponseStatus = 300
+	E_UNAVAILABLE                ResponseStatus = 400
+)
+
+var errMalformed = errors.New("malformed protobuf message")
+
+type Register struct {
+	Ns               string
+	SignedPeerRecord []byte
+	// Ttl is in seconds.
+	Ttl uint64
+}
+
+type RegisterResponse struct {
+	Status     ResponseStatus
+	StatusText string
+	// Ttl is in seconds.
+	Ttl uint64
+}
+
+type Unregister struct {
+	Ns string
+}
+
+type Discover struct {
+	Ns     string
+	Limit  uint64
+	Cookie []byte
+}
+
+type DiscoverResponse struct {
+	Registrations []*Register
+	Cookie        []byte
+	Status        ResponseStatus
+	StatusText    string
+}
+
+// Message is an envelope for every request and response. Only the field that matches Type is set.
+type Message struct {
+	Type             MessageType
+	Register         *Register
+	RegisterResponse *RegisterResponse
+	Unregister       *Unregister
+	Discover         *Discover
+	DiscoverResponse *DiscoverResponse
+}
+
+// Marshal encodes message using protobuf wire format.
+func (m *Message) Marshal() []byte {
+	var b []byte
+	b = appendVarint(b, 1, uint64(m.Type))
+	if m.Register != nil {
+		b = appendMessage(b, 2, m.Register.marshal())
+	}
+	if m.RegisterResponse != nil {
+		b = appendMessage(b, 3, m.RegisterResponse.marshal())
+	}
+	if m.Unregister != nil {
+		b = appendMessage(b, 4, m.Unregister.marshal())
+	}
+	if m.Discover != nil {
+		b = appendMessage(b, 5, m.Discover.marshal())
+	}
+	if m.DiscoverResponse != nil {
+		b = appendMessage(b, 6, m.DiscoverResponse.marshal())
+	}
+	return b
+}
+
+// Unmarshal decodes message. Unknown fields are skipped.
+func (m *Message) Unmarshal(b []byte) error {
+	*m = Message{}
+	return parse(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.Type = MessageType(v)
+			return n, nil
+		case num == 2 && typ == protowire.BytesType:
+			m.Register = &Register{}
+			return consumeMessage(b, m.Register.unmarshal)
+		case num == 3 && typ == protowire.BytesType:
+			m.RegisterResponse = &RegisterResponse{}
+			return consumeMessage(b, m.RegisterResponse.unmarshal)
+		case num == 4 && typ == protowire.BytesType:
+			m.Unregister = &Unregister{}
+			return consumeMessage(b, m.Unregister.unmarshal)
+		case num == 5 && typ == protowire.BytesType:
+			m.Discover = &Discover{}
+			return consumeMessage(b, m.Discover.unmarshal)
+		case num == 6 && typ == protowire.BytesType:
+			m.DiscoverResponse = &DiscoverResponse{}
+			return consumeMessage(b, m.DiscoverResponse.unmarshal)
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+}
+
+func (r *Register) marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, r.Ns)
+	b = appendBytes(b, 2, r.SignedPeerRecord)
+	if r.Ttl != 0 {
+		b = appendVarint(b, 3, r.Ttl)
+	}
+	return b
+}
+
+func (r *Register) unmarshal(b []byte) error {
+	return parse(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			r.Ns = v
+			return n, nil
+		case num == 2 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			r.SignedPeerRecord = append([]byte{}, v...)
+			return n, nil
+		case num == 3 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			r.Ttl = v
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+}
+
+func (r *RegisterResponse) marshal() []byte {
+	var b []byte
+	b = appendVarint(b, 1, uint64(r.Status))
+	b = appendString(b, 2, r.StatusText)
+	if r.Ttl != 0 {
+		b = appendVarint(b, 3, r.Ttl)
+	}
+	return b
+}
+
+func (r *RegisterResponse) unmarshal(b []byte) error {
+	return parse(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			r.Status = ResponseStatus(v)
+			return n, nil
+		case num == 2 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			r.StatusText = v
+			return n, nil
+		case num == 3 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			r.Ttl = v
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+}
+
+func (u *Unregister) marshal() []byte {
+	return appendString(nil, 1, u.Ns)
+}
+
+func (u *Unregister) unmarshal(b []byte) error {
+	return parse(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num == 1 && typ == protowire.BytesType {
+			v, n := protowire.ConsumeString(b)
+			u.Ns = v
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+}
+
+func (d *Discover) marshal() []byte {
+	var b []byte
+	b = appendString(b, 1, d.Ns)
+	if d.Limit != 0 {
+		b = appendVarint(b, 2, d.Limit)
+	}
+	b = appendBytes(b, 3, d.Cookie)
+	return b
+}
+
+func (d *Discover) unmarshal(b []byte) error {
+	return parse(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			d.Ns = v
+			return n, nil
+		case num == 2 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			d.Limit = v
+			return n, nil
+		case num == 3 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			d.Cookie = append([]byte{}, v...)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+}
+
+func (d *DiscoverResponse) marshal() []byte {
+	var b []byte
+	for _, r := range d.Registrations {
+		b = appendMessage(b, 1, r.marshal())
+	}
+	b = appendBytes(b, 2, d.Cookie)
+	b = appendVarint(b, 3, uint64(d.Status))
+	b = appendString(b, 4, d.StatusText)
+	return b
+}
+
+func (d *DiscoverResponse) unmarshal(b []byte) error {
+	return parse(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			r := &Register{}
+			d.Registrations = append(d.Registrations, r)
+			return consumeMessage(b, r.unmarshal)
+		case num == 2 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			d.Cookie = append([]byte{}, v...)
+			return n, nil
+		case num == 3 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			d.Status = ResponseStatus(v)
+			return n, nil
+		case num == 4 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			d.StatusText = v
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+}
+
+// parse iterates over fields. field consumes value of the field and returns its length.
+func parse(b []byte, field func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("%w: %v", errMalformed, protowire.ParseError(n))
+		}
+		b = b[n:]
+		n, err := field(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return fmt.Errorf("%w: field %d: %v", errMalformed, num, protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func consumeMessage(b []byte, unmarshal func([]byte) error) (int, error) {
+	v, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return n, nil
+	}
+	return n, unmarshal(v)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendMessage(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
@@ -0,0 +1,40 @@
+package pb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	for _, msg := range []Message{
+		{Type: REGISTER, Register: &Register{Ns: "topic", SignedPeerRecord: []byte{1, 2, 3}, Ttl: 7200}},
+		{Type: REGISTER_RESPONSE, RegisterResponse: &RegisterResponse{Status: E_INVALID_TTL, StatusText: "ttl is too long"}},
+		{Type: UNREGISTER, Unregister: &Unregister{Ns: "topic"}},
+		{Type: DISCOVER, Discover: &Discover{Ns: "topic", Limit: 10, Cookie: []byte{4}}},
+		{Type: DISCOVER_RESPONSE, DiscoverResponse: &DiscoverResponse{
+			Registrations: []*Register{{Ns: "topic", SignedPeerRecord: []byte{1}, Ttl: 10}, {Ns: "topic", SignedPeerRecord: []byte{2}}},
+			Cookie:        []byte{5},
+		}},
+	} {
+		var decoded Message
+		require.NoError(t, decoded.Unmarshal(msg.Marshal()))
+		require.Equal(t, msg, decoded)
+	}
+}
+
+func TestMessageUnknownFields(t *testing.T) {
+	msg := Message{Type: DISCOVER, Discover: &Discover{Ns: "topic"}}
+	data := msg.Marshal()
+	data = protowire.AppendTag(data, 100, protowire.BytesType)
+	data = protowire.AppendString(data, "future")
+	var decoded Message
+	require.NoError(t, decoded.Unmarshal(data))
+	require.Equal(t, msg, decoded)
+}
+
+func TestMessageMalformed(t *testing.T) {
+	var decoded Message
+	require.Error(t, decoded.Unmarshal([]byte{0x12, 0x10, 0x01}))
+}
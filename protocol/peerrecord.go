@@ -0,0 +1,215 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/rlp"
+	lcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/record"
+)
+
+const (
+	// PeerRecordKey is ENR entry with libp2p signed peer record envelope.
+	PeerRecordKey = "spr"
+	// PeerRecordID is a name of identity scheme for ENRs that wrap signed peer records
+	// received over the libp2p rendezvous protocol.
+	PeerRecordID = "libp2p"
+	// DetachedPeerRecordID is a name of identity scheme for ENRs that stand in for signed peer
+	// records that don't fit into enr.SizeLimit, see DetachPeerRecord.
+	DetachedPeerRecordID = "libp2p-detached"
+	// PeerRecordHashKey is ENR entry with keccak256 hash of the detached envelope.
+	PeerRecordHashKey = "sprh"
+	// NodeAddrKey is ENR entry with node address of the detached peer record.
+	NodeAddrKey = "addr"
+)
+
+// ValidSchemes are identity schemes accepted in records: "v4" ENRs and ENRs wrapping
+// signed peer records.
+var ValidSchemes = enr.SchemeMap{
+	"v4":         enode.V4ID{},
+	PeerRecordID: PeerRecordScheme{},
+}
+
+// StoredSchemes are identity schemes of records stored by the server. Detached peer records
+// can't be verified without their envelopes, so they are not in ValidSchemes and are never
+// returned to rlp clients.
+var StoredSchemes = enr.SchemeMap{
+	"v4":                 enode.V4ID{},
+	PeerRecordID:         PeerRecordScheme{},
+	DetachedPeerRecordID: DetachedPeerRecordScheme{},
+}
+
+// PeerRecordScheme is an identity scheme of ENR that contains only signed peer record.
+// Record signature is empty, envelope itself is signed by the peer.
+type PeerRecordScheme struct{}
+
+func (PeerRecordScheme) Verify(r *enr.Record, sig []byte) error {
+	// sequence number and two pairs: id and envelope
+	if len(r.AppendElements(nil)) != 5 {
+		return errors.New("record must contain only id and signed peer record")
+	}
+	if len(sig) != 0 {
+		return enr.ErrInvalidSig
+	}
+	_, _, err := ConsumePeerRecord(r)
+	return err
+}
+
+func (PeerRecordScheme) NodeAddr(r *enr.Record) []byte {
+	_, rec, err := ConsumePeerRecord(r)
+	if err != nil {
+		return nil
+	}
+	pub, err := rec.PeerID.ExtractPublicKey()
+	if err != nil {
+		return nil
+	}
+	return PeerNodeAddr(pub)
+}
+
+// PeerNodeAddr returns node address of the libp2p peer. Secp256k1 keys get the same address
+// as in "v4" ENRs, so a peer registered over both protocols is stored once.
+func PeerNodeAddr(pub lcrypto.PubKey) []byte {
+	if secp, ok := pub.(*lcrypto.Secp256k1PublicKey); ok {
+		raw, err := secp.Raw()
+		if err == nil {
+			if key, err := crypto.DecompressPubkey(raw); err == nil {
+				return crypto.Keccak256(crypto.FromECDSAPub(key)[1:])
+			}
+		}
+	}
+	raw, err := lcrypto.MarshalPublicKey(pub)
+	if err != nil {
+		return nil
+	}
+	return crypto.Keccak256(raw)
+}
+
+// DetachedPeerRecordScheme is an identity scheme of ENR that holds only node address and hash
+// of signed peer record envelope. Verify checks only the layout of the record, envelope is
+// checked by VerifyRecord.
+type DetachedPeerRecordScheme struct{}
+
+func (DetachedPeerRecordScheme) Verify(r *enr.Record, sig []byte) error {
+	// sequence number and three pairs: node address, id and hash
+	if len(r.AppendElements(nil)) != 7 {
+		return errors.New("record must contain only id, node address and hash of signed peer record")
+	}
+	if len(sig) != 0 {
+		return enr.ErrInvalidSig
+	}
+	var hash []byte
+	if err := r.Load(enr.WithEntry(PeerRecordHashKey, &hash)); err != nil {
+		return err
+	}
+	if len(hash) != 32 {
+		return errors.New("invalid signed peer record hash")
+	}
+	if len(DetachedPeerRecordScheme{}.NodeAddr(r)) == 0 {
+		return errors.New("node address is missing")
+	}
+	return nil
+}
+
+func (DetachedPeerRecordScheme) NodeAddr(r *enr.Record) []byte {
+	var addr []byte
+	if err := r.Load(enr.WithEntry(NodeAddrKey, &addr)); err != nil {
+		return nil
+	}
+	return addr
+}
+
+func consumePeerRecord(envelope []byte) (*record.Envelope, *peer.PeerRecord, error) {
+	env, rec, err := record.ConsumeEnvelope(envelope, peer.PeerRecordEnvelopeDomain)
+	if err != nil {
+		return nil, nil, err
+	}
+	pr, ok := rec.(*peer.PeerRecord)
+	if !ok {
+		return nil, nil, fmt.Errorf("unexpected record type %T", rec)
+	}
+	return env, pr, nil
+}
+
+// WrapPeerRecord creates ENR that carries signed peer record envelope. Such ENRs can be
+// registered over both protocols. It fails if envelope doesn't fit into enr.SizeLimit,
+// see DetachPeerRecord.
+func WrapPeerRecord(envelope []byte) (enr.Record, error) {
+	var r enr.Record
+	_, pr, err := consumePeerRecord(envelope)
+	if err != nil {
+		return r, err
+	}
+	r.SetSeq(pr.Seq)
+	r.Set(enr.ID(PeerRecordID))
+	r.Set(enr.WithEntry(PeerRecordKey, envelope))
+	if err := r.SetSig(PeerRecordScheme{}, []byte{}); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// DetachPeerRecord creates ENR that stands in for signed peer record envelope that doesn't
+// fit into enr.SizeLimit, e.g. of a peer with many addresses. Envelope must be kept next to
+// the ENR, it is needed to verify the record and to return it to libp2p clients.
+func DetachPeerRecord(envelope []byte) (enr.Record, error) {
+	var r enr.Record
+	env, pr, err := consumePeerRecord(envelope)
+	if err != nil {
+		return r, err
+	}
+	if !pr.PeerID.MatchesPublicKey(env.PublicKey) {
+		return r, errors.New("signed peer record is not signed by the peer")
+	}
+	r.SetSeq(pr.Seq)
+	r.Set(enr.ID(DetachedPeerRecordID))
+	r.Set(enr.WithEntry(NodeAddrKey, PeerNodeAddr(env.PublicKey)))
+	r.Set(enr.WithEntry(PeerRecordHashKey, crypto.Keccak256(envelope)))
+	if err := r.SetSig(DetachedPeerRecordScheme{}, []byte{}); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// VerifyRecord checks signature of the stored record. Detached peer records are checked
+// against their envelope, other records must come without one.
+func VerifyRecord(r *enr.Record, envelope []byte) error {
+	if r.IdentityScheme() != DetachedPeerRecordID {
+		if len(envelope) != 0 {
+			return errors.New("only detached peer record has an envelope")
+		}
+		return r.VerifySignature(ValidSchemes)
+	}
+	detached, err := DetachPeerRecord(envelope)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(encodeRecord(&detached), encodeRecord(r)) {
+		return errors.New("record doesn't match signed peer record")
+	}
+	return nil
+}
+
+func encodeRecord(r *enr.Record) []byte {
+	data, _ := rlp.EncodeToBytes(r)
+	return data
+}
+
+// ConsumePeerRecord returns envelope stored in ENR and verified peer record from it.
+func ConsumePeerRecord(r *enr.Record) ([]byte, *peer.PeerRecord, error) {
+	var envelope []byte
+	if err := r.Load(enr.WithEntry(PeerRecordKey, &envelope)); err != nil {
+		return nil, nil, err
+	}
+	_, pr, err := consumePeerRecord(envelope)
+	if err != nil {
+		return nil, nil, err
+	}
+	return envelope, pr, nil
+}
@@ -0,0 +1,47 @@
+package protocol
+
+import (
+	"testing"
+
+	lcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/record"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func signedPeerRecord(t *testing.T, priv lcrypto.PrivKey, addrs int) []byte {
+	id, err := peer.IDFromPrivateKey(priv)
+	require.NoError(t, err)
+	rec := peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: id})
+	for i := 0; i < addrs; i++ {
+		rec.Addrs = append(rec.Addrs, ma.StringCast("/ip6/2001:db8::1/udp/4001/quic-v1"))
+	}
+	env, err := record.Seal(rec, priv)
+	require.NoError(t, err)
+	data, err := env.Marshal()
+	require.NoError(t, err)
+	return data
+}
+
+func TestDetachPeerRecord(t *testing.T) {
+	priv, _, err := lcrypto.GenerateSecp256k1Key(nil)
+	require.NoError(t, err)
+	envelope := signedPeerRecord(t, priv, 8)
+	_, err = WrapPeerRecord(envelope)
+	require.Error(t, err)
+
+	r, err := DetachPeerRecord(envelope)
+	require.NoError(t, err)
+	require.NoError(t, VerifyRecord(&r, envelope))
+	require.Error(t, VerifyRecord(&r, nil))
+	require.Error(t, VerifyRecord(&r, signedPeerRecord(t, priv, 9)))
+	// rlp clients don't accept detached records
+	require.Error(t, r.VerifySignature(ValidSchemes))
+
+	// detached and wrapped records of the peer have the same node address
+	wrapped, err := WrapPeerRecord(signedPeerRecord(t, priv, 1))
+	require.NoError(t, err)
+	require.Equal(t, ValidSchemes.NodeAddr(&wrapped), StoredSchemes.NodeAddr(&r))
+	require.Error(t, VerifyRecord(&wrapped, envelope))
+}
@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/rlp"
 )
 
 type ResponseStatus uint
@@ -9,14 +10,26 @@ type MessageType uint64
 
 const (
 	VERSION = "/rend/0.1.0"
+	// VERSION2 carries record details in discover response. Its messages end with a tail
+	// of raw values, so that new fields can be appended without breaking older peers.
+	VERSION2 = "/rend/0.2.0"
+)
 
-	REGISTER MessageType = iota
+// Message types are sent on the wire, values of the existing types must not change.
+const (
+	REGISTER MessageType = iota + 1
 	REGISTER_RESPONSE
 	DISCOVER
 	DISCOVER_RESPONSE
 	REMOTEIP
 	REMOTEIP_RESPONSE
+	TOPICS
+	TOPICS_RESPONSE
+	INFO
+	INFO_RESPONSE
+)
 
+const (
 	OK                  ResponseStatus = 0
 	E_INVALID_NAMESPACE ResponseStatus = 100
 	E_INVALID_ENR       ResponseStatus = 101
@@ -25,12 +38,27 @@ const (
 	E_INVALID_CONTENT   ResponseStatus = 104
 	E_NOT_AUTHORIZED    ResponseStatus = 200
 	E_INTERNAL_ERROR    ResponseStatus = 300
+	// E_REDIRECT is returned by a cluster member that doesn't own the topic, message is the owner
+	// multiaddr, see NewRedirect.
+	E_REDIRECT ResponseStatus = 400
+)
+
+// Optional features reported in InfoResponse.
+const (
+	// FeatureTopics is reported if server answers TOPICS requests.
+	FeatureTopics = "topics"
+	// FeatureLibp2pRendezvous is reported if server also speaks libp2p rendezvous protocol.
+	FeatureLibp2pRendezvous = "libp2p-rendezvous"
+	// FeatureRelay is reported if server is a circuit relay v2, see RelayKey.
+	FeatureRelay = "relay"
 )
 
 type Register struct {
 	Topic  string
 	Record enr.Record
 	TTL    uint64
+	// Token grants access to a private topic, see NewToken.
+	Token []byte `rlp:"optional"`
 }
 
 type RegisterResponse struct {
@@ -41,18 +69,104 @@ type RegisterResponse struct {
 type Discover struct {
 	Limit uint
 	Topic string
+	// Extended asks server to add per record details to the response.
+	// Servers that don't know about this field reply with E_INVALID_CONTENT.
+	Extended bool `rlp:"optional"`
+	// Token grants access to a private topic, see NewToken.
+	Token []byte `rlp:"optional"`
 }
 
 type DiscoverResponse struct {
 	Status  ResponseStatus
 	Message string
 	Records []enr.Record
+	// TTLs holds remaining TTL in nanoseconds for each record. Present only in response
+	// to the extended request.
+	TTLs []uint64 `rlp:"optional"`
+	// Registered holds unix time in seconds when each record was first registered,
+	// zero if unknown. Present only in response to the extended request.
+	Registered []uint64 `rlp:"optional"`
+}
+
+// DiscoverV2 is a discover request used since VERSION2.
+type DiscoverV2 struct {
+	Limit uint
+	Topic string
+	// Token grants access to a private topic, see NewToken.
+	Token []byte         `rlp:"optional"`
+	Rest  []rlp.RawValue `rlp:"tail"`
+}
+
+// DiscoveredRecord is a record with remaining TTL in nanoseconds and unix time in seconds
+// of the first registration.
+type DiscoveredRecord struct {
+	Record     enr.Record
+	TTL        uint64
+	Registered uint64
+	Rest       []rlp.RawValue `rlp:"tail"`
+}
+
+// DiscoverResponseV2 is a response to DiscoverV2.
+type DiscoverResponseV2 struct {
+	Status  ResponseStatus
+	Message string
+	Records []DiscoveredRecord
+	Rest    []rlp.RawValue `rlp:"tail"`
 }
 
 type RemoteIp struct {
 }
 
 type RemoteIpResponse struct {
-	Status ResponseStatus
-	IP     string
+	Status  ResponseStatus
+	IP      string
+	Message string `rlp:"optional"`
+}
+
+// Topics asks for topics with active registrations. Used since VERSION2.
+type Topics struct {
+	// Prefix limits response to topics that start with it. Empty prefix matches all topics.
+	Prefix string
+	// Limit is a maximal number of topics in response, server default is used if zero.
+	Limit uint
+	Rest  []rlp.RawValue `rlp:"tail"`
+}
+
+// TopicStat is a topic with the number of active registrations under it.
+type TopicStat struct {
+	Topic string
+	Count uint64
+	Rest  []rlp.RawValue `rlp:"tail"`
+}
+
+// TopicsResponse is a response to Topics. Topics are sorted by name.
+type TopicsResponse struct {
+	Status  ResponseStatus
+	Message string
+	Topics  []TopicStat
+	Rest    []rlp.RawValue `rlp:"tail"`
+}
+
+// Info asks for server version, limits and capabilities. Used since VERSION2.
+type Info struct {
+	Rest []rlp.RawValue `rlp:"tail"`
+}
+
+// InfoResponse is a response to Info.
+type InfoResponse struct {
+	Status  ResponseStatus
+	Message string
+	Version string
+	// LongestTTL is the maximal TTL of registration in nanoseconds.
+	LongestTTL uint64
+	// MaxLimit is the maximal number of records returned for discover request.
+	MaxLimit       uint
+	MaxTopicLength uint
+	// Requests lists request types supported by negotiated protocol version.
+	Requests []MessageType
+	// Features lists enabled optional features, see Feature constants.
+	Features []string
+	// Uptime is in seconds.
+	Uptime uint64
+	Rest   []rlp.RawValue `rlp:"tail"`
 }
@@ -0,0 +1,17 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageTypes(t *testing.T) {
+	// values of /rend/0.1.0, peers that don't know about later versions depend on them
+	require.Equal(t, MessageType(1), REGISTER)
+	require.Equal(t, MessageType(2), REGISTER_RESPONSE)
+	require.Equal(t, MessageType(3), DISCOVER)
+	require.Equal(t, MessageType(4), DISCOVER_RESPONSE)
+	require.Equal(t, MessageType(5), REMOTEIP)
+	require.Equal(t, MessageType(6), REMOTEIP_RESPONSE)
+}
@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"errors"
+
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// RelayKey is ENR entry with circuit relay multiaddr of the node, e.g.
+// /ip4/203.0.113.7/tcp/9090/p2p/<relay>/p2p-circuit/p2p/<node>.
+const RelayKey = "relay"
+
+// Relay is binary encoded circuit relay multiaddr.
+type Relay []byte
+
+func (Relay) ENRKey() string { return RelayKey }
+
+// SetRelayAddr puts relay multiaddr into the record. Record must be signed again.
+func SetRelayAddr(r *enr.Record, addr ma.Multiaddr) error {
+	if _, err := addr.ValueForProtocol(ma.P_CIRCUIT); err != nil {
+		return errors.New("relay address must contain /p2p-circuit")
+	}
+	r.Set(Relay(addr.Bytes()))
+	return nil
+}
+
+// RelayAddr returns relay multiaddr of the record. Error satisfies enr.IsNotFound if record has none.
+func RelayAddr(r *enr.Record) (ma.Multiaddr, error) {
+	var raw Relay
+	if err := r.Load(&raw); err != nil {
+		return nil, err
+	}
+	addr, err := ma.NewMultiaddrBytes(raw)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := addr.ValueForProtocol(ma.P_CIRCUIT); err != nil {
+		return nil, errors.New("relay address must contain /p2p-circuit")
+	}
+	return addr, nil
+}
+
+// RelayPeers returns the relay and the relayed peer of circuit relay multiaddr. Address must end
+// with /p2p/<relay>/p2p-circuit/p2p/<node>.
+func RelayPeers(addr ma.Multiaddr) (relay, node peer.ID, err error) {
+	before, after := ma.SplitFunc(addr, func(c ma.Component) bool { return c.Protocol().Code == ma.P_CIRCUIT })
+	if after == nil {
+		return "", "", errors.New("relay address must contain /p2p-circuit")
+	}
+	if relay, err = lastPeer(before); err != nil {
+		return "", "", errors.New("relay address must contain relay peer before /p2p-circuit")
+	}
+	_, after = ma.SplitFirst(after)
+	if after == nil || len(ma.Split(after)) != 1 {
+		return "", "", errors.New("relay address must end with the relayed peer")
+	}
+	if node, err = lastPeer(after); err != nil {
+		return "", "", errors.New("relay address must end with the relayed peer")
+	}
+	return relay, node, nil
+}
+
+func lastPeer(addr ma.Multiaddr) (peer.ID, error) {
+	if addr == nil {
+		return "", errors.New("address is empty")
+	}
+	_, last := ma.SplitLast(addr)
+	if last == nil || last.Protocol().Code != ma.P_P2P {
+		return "", errors.New("address doesn't end with /p2p")
+	}
+	return peer.Decode(last.Value())
+}
@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRelayAddr(t *testing.T) {
+	var record enr.Record
+	_, err := RelayAddr(&record)
+	require.True(t, enr.IsNotFound(err))
+
+	require.Error(t, SetRelayAddr(&record, ma.StringCast("/ip4/127.0.0.1/tcp/9090")))
+	addr := ma.StringCast("/ip4/127.0.0.1/tcp/9090/p2p/12D3KooWNM9UkCesRZjGpuBJkrAS5E7oFwgSvMXkFzW1PNoMXFMC/p2p-circuit")
+	require.NoError(t, SetRelayAddr(&record, addr))
+	loaded, err := RelayAddr(&record)
+	require.NoError(t, err)
+	require.True(t, addr.Equal(loaded))
+
+	record.Set(Relay(ma.StringCast("/ip4/127.0.0.1/tcp/9090").Bytes()))
+	_, err = RelayAddr(&record)
+	require.Error(t, err)
+	require.False(t, enr.IsNotFound(err))
+}
+
+func TestRelayPeers(t *testing.T) {
+	relay, node := "12D3KooWNM9UkCesRZjGpuBJkrAS5E7oFwgSvMXkFzW1PNoMXFMC", "12D3KooWDpJ7As7BWAwRMfu1VU2WCqNjvq387JEYKDBj4kx6nXTN"
+	r, n, err := RelayPeers(ma.StringCast("/ip4/127.0.0.1/tcp/9090/p2p/" + relay + "/p2p-circuit/p2p/" + node))
+	require.NoError(t, err)
+	require.Equal(t, relay, r.String())
+	require.Equal(t, node, n.String())
+
+	for _, addr := range []string{
+		"/ip4/127.0.0.1/tcp/9090/p2p/" + relay,
+		"/ip4/127.0.0.1/tcp/9090/p2p/" + relay + "/p2p-circuit",
+		"/ip4/127.0.0.1/tcp/9090/p2p-circuit/p2p/" + node,
+		"/ip4/127.0.0.1/tcp/9090/p2p/" + relay + "/p2p-circuit/ip4/127.0.0.1/p2p/" + node,
+	} {
+		_, _, err := RelayPeers(ma.StringCast(addr))
+		require.Error(t, err, addr)
+	}
+}
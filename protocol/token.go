@@ -0,0 +1,80 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"errors"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+var (
+	ErrTokenExpired        = errors.New("token expired")
+	ErrTokenWrongTopic     = errors.New("token is issued for other topic")
+	ErrTokenWrongHolder    = errors.New("token is issued for other node")
+	ErrTokenWrongSignature = errors.New("token is not signed by the topic owner")
+)
+
+// Token grants access to a private topic and all topics under it. It is signed by the topic
+// owner and is sent encoded in Register and Discover requests.
+type Token struct {
+	Topic string
+	// Expiry is unix time in seconds.
+	Expiry uint64
+	// Holder is the node ID allowed to use the token. Any node may use it if empty.
+	Holder    []byte
+	Signature []byte
+}
+
+type tokenPayload struct {
+	Topic  string
+	Expiry uint64
+	Holder []byte
+}
+
+func (t Token) hash() []byte {
+	data, _ := rlp.EncodeToBytes(tokenPayload{Topic: t.Topic, Expiry: t.Expiry, Holder: t.Holder})
+	return crypto.Keccak256(data)
+}
+
+// NewToken creates token for the topic signed with the owner key. Holder may be zero ID,
+// then any node can use the token.
+func NewToken(owner *ecdsa.PrivateKey, topic string, expiry time.Time, holder enode.ID) ([]byte, error) {
+	t := Token{Topic: topic, Expiry: uint64(expiry.Unix())}
+	if holder != (enode.ID{}) {
+		t.Holder = holder.Bytes()
+	}
+	sig, err := crypto.Sign(t.hash(), owner)
+	if err != nil {
+		return nil, err
+	}
+	t.Signature = sig
+	return rlp.EncodeToBytes(t)
+}
+
+// DecodeToken decodes token created with NewToken.
+func DecodeToken(data []byte) (t Token, err error) {
+	return t, rlp.DecodeBytes(data, &t)
+}
+
+// Verify checks that token is signed by the owner, is valid at now and grants access
+// to the topic for the holder. Holder is a node address, see enr.IdentityScheme.
+func (t Token) Verify(owner *ecdsa.PublicKey, topic string, holder []byte, now time.Time) error {
+	if len(t.Signature) != crypto.SignatureLength ||
+		!crypto.VerifySignature(crypto.FromECDSAPub(owner), t.hash(), t.Signature[:crypto.RecoveryIDOffset]) {
+		return ErrTokenWrongSignature
+	}
+	if !InNamespace(topic, t.Topic) {
+		return ErrTokenWrongTopic
+	}
+	if uint64(now.Unix()) > t.Expiry {
+		return ErrTokenExpired
+	}
+	if len(t.Holder) != 0 && !bytes.Equal(t.Holder, holder) {
+		return ErrTokenWrongHolder
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToken(t *testing.T) {
+	owner, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	other, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	holder := enode.PubkeyToIDV4(&other.PublicKey)
+	now := time.Now()
+
+	data, err := NewToken(owner, "/app/x", now.Add(time.Hour), holder)
+	require.NoError(t, err)
+	token, err := DecodeToken(data)
+	require.NoError(t, err)
+	require.NoError(t, token.Verify(&owner.PublicKey, "/app/x", holder.Bytes(), now))
+	require.NoError(t, token.Verify(&owner.PublicKey, "/app/x/chat", holder.Bytes(), now))
+	require.ErrorIs(t, token.Verify(&other.PublicKey, "/app/x", holder.Bytes(), now), ErrTokenWrongSignature)
+	require.ErrorIs(t, token.Verify(&owner.PublicKey, "/app/y", holder.Bytes(), now), ErrTokenWrongTopic)
+	require.ErrorIs(t, token.Verify(&owner.PublicKey, "/app/x", make([]byte, 32), now), ErrTokenWrongHolder)
+	require.ErrorIs(t, token.Verify(&owner.PublicKey, "/app/x", holder.Bytes(), now.Add(2*time.Hour)), ErrTokenExpired)
+
+	// token without holder can be used by any node
+	data, err = NewToken(owner, "/app/x", now.Add(time.Hour), enode.ID{})
+	require.NoError(t, err)
+	token, err = DecodeToken(data)
+	require.NoError(t, err)
+	require.NoError(t, token.Verify(&owner.PublicKey, "/app/x", nil, now))
+
+	token.Expiry++
+	require.ErrorIs(t, token.Verify(&owner.PublicKey, "/app/x", nil, now), ErrTokenWrongSignature)
+}
@@ -0,0 +1,109 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// TopicSeparator separates namespaces of hierarchical topics, e.g. /waku/2/rs/16/32.
+	TopicSeparator = "/"
+	// TopicWildcard at the end of discovered topic matches every topic under the namespace.
+	TopicWildcard = "*"
+)
+
+// ValidateTopic checks that topic is a sequence of non-empty segments separated by
+// TopicSeparator. Topic may start with separator. Segments may contain ASCII letters,
+// digits and any of "-_.:+=@". Blinded topics may contain any byte except 0xff, see IsBlinded.
+// Topics registered over VERSION are checked with ValidateLegacyTopic.
+func ValidateTopic(topic string) error {
+	if len(topic) == 0 {
+		return errors.New("topic is empty")
+	}
+	if IsBlinded(topic) {
+		if strings.IndexByte(topic, 0xff) != -1 {
+			return errors.New("topic contains forbidden byte 0xff")
+		}
+		return nil
+	}
+	for i, segment := range strings.Split(strings.TrimPrefix(topic, TopicSeparator), TopicSeparator) {
+		if len(segment) == 0 {
+			return fmt.Errorf("segment %d of the topic is empty", i)
+		}
+		for j := 0; j < len(segment); j++ {
+			if !validTopicByte(segment[j]) {
+				return fmt.Errorf("topic contains forbidden byte %#x", segment[j])
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateLegacyTopic checks topic registered over VERSION. Clients of VERSION predate
+// hierarchical topics, so their topics may contain any byte except 0xff.
+func ValidateLegacyTopic(topic string) error {
+	if len(topic) == 0 {
+		return errors.New("topic is empty")
+	}
+	if strings.IndexByte(topic, 0xff) != -1 {
+		return errors.New("topic contains forbidden byte 0xff")
+	}
+	return nil
+}
+
+func validTopicByte(b byte) bool {
+	switch {
+	case b >= 'a' && b <= 'z', b >= 'A' && b <= 'Z', b >= '0' && b <= '9':
+		return true
+	}
+	return strings.IndexByte("-_.:+=@", b) != -1
+}
+
+// Subtopics returns pattern that matches every topic under the namespace.
+func Subtopics(namespace string) string {
+	return strings.TrimSuffix(namespace, TopicSeparator) + TopicSeparator + TopicWildcard
+}
+
+// ParseWildcard returns namespace of the pattern created with Subtopics. ok is false
+// if topic doesn't end with wildcard.
+func ParseWildcard(topic string) (namespace string, ok bool, err error) {
+	if IsBlinded(topic) || !strings.HasSuffix(topic, TopicWildcard) {
+		return "", false, nil
+	}
+	namespace = strings.TrimSuffix(topic, TopicSeparator+TopicWildcard)
+	if namespace == topic {
+		return "", true, errors.New("wildcard must follow topic separator")
+	}
+	if len(namespace) == 0 {
+		return "", true, errors.New("namespace is empty")
+	}
+	return namespace, true, ValidateTopic(namespace)
+}
+
+// InNamespace returns true if topic is the namespace itself or any topic under it.
+// Blinded topics are only in their own namespace.
+func InNamespace(topic, namespace string) bool {
+	if IsBlinded(topic) || IsBlinded(namespace) {
+		return topic == namespace
+	}
+	namespace = strings.TrimSuffix(namespace, TopicSeparator)
+	return topic == namespace || strings.HasPrefix(topic, namespace+TopicSeparator)
+}
+
+// Namespaces returns the topic and all namespaces it belongs to, the most specific first.
+func Namespaces(topic string) []string {
+	if IsBlinded(topic) {
+		return []string{topic}
+	}
+	var rst []string
+	for ns := topic; len(ns) != 0; {
+		rst = append(rst, ns)
+		idx := strings.LastIndex(ns, TopicSeparator)
+		if idx == -1 {
+			break
+		}
+		ns = ns[:idx]
+	}
+	return rst
+}
@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateTopic(t *testing.T) {
+	for _, topic := range []string{"any", "/waku/2/rs/16/32", "app/chat", "/rend/0.2.0", "a_b-c:d+e=f@g"} {
+		require.NoError(t, ValidateTopic(topic), topic)
+	}
+	for _, topic := range []string{"", "/", "a//b", "a/", "white space", "a/*", "\xff"} {
+		require.Error(t, ValidateTopic(topic), topic)
+	}
+}
+
+func TestValidateLegacyTopic(t *testing.T) {
+	for _, topic := range []string{"any", "a//b", "white space", "a/*"} {
+		require.NoError(t, ValidateLegacyTopic(topic), topic)
+	}
+	for _, topic := range []string{"", "a\xffb"} {
+		require.Error(t, ValidateLegacyTopic(topic), topic)
+	}
+}
+
+func TestParseWildcard(t *testing.T) {
+	namespace, ok, err := ParseWildcard(Subtopics("/waku/2/"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "/waku/2", namespace)
+
+	_, ok, err = ParseWildcard("/waku/2")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	for _, pattern := range []string{"*", "/*", "/waku*", "/wa*ku/*"} {
+		_, ok, err = ParseWildcard(pattern)
+		require.True(t, ok, pattern)
+		require.Error(t, err, pattern)
+	}
+}
+
+func TestInNamespace(t *testing.T) {
+	require.True(t, InNamespace("/waku/2", "/waku/2"))
+	require.True(t, InNamespace("/waku/2/rs/16", "/waku/2/"))
+	require.False(t, InNamespace("/waku/20", "/waku/2"))
+}
+
+func TestNamespaces(t *testing.T) {
+	require.Equal(t, []string{"/waku/2/rs", "/waku/2", "/waku"}, Namespaces("/waku/2/rs"))
+	require.Equal(t, []string{"app/chat", "app"}, Namespaces("app/chat"))
+}
@@ -0,0 +1,48 @@
+package rendezvous
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
+	ma "github.com/multiformats/go-multiaddr"
+	ethv4 "github.com/status-im/go-multiaddr-ethv4"
+	"github.com/status-im/rendezvous/protocol"
+)
+
+// RegisterRelayed reserves a slot on the server, which must be started with relay enabled, puts
+// relayed address of the client host into the record and registers it under the topic. Record is
+// signed with the key, so its sequence number is increased. Registration should be repeated before
+// returned reservation expiry, otherwise peers will fail to connect through the relay.
+func (c Client) RegisterRelayed(ctx context.Context, srv ma.Multiaddr, topic string, record enr.Record, key *ecdsa.PrivateKey, ttl time.Duration) (time.Time, error) {
+	pid, err := srv.ValueForProtocol(ethv4.P_ETHv4)
+	if err != nil {
+		return time.Time{}, err
+	}
+	peerid, err := peer.Decode(pid)
+	if err != nil {
+		return time.Time{}, err
+	}
+	transport := srv.Decapsulate(ma.StringCast("/ethv4/" + pid))
+	rsvp, err := client.Reserve(ctx, c.h, peer.AddrInfo{ID: peerid, Addrs: []ma.Multiaddr{transport}})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("relay reservation failed: %w", err)
+	}
+	relayed, err := ma.NewMultiaddr(fmt.Sprintf("/p2p/%s/p2p-circuit/p2p/%s", peerid, c.h.ID()))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := protocol.SetRelayAddr(&record, transport.Encapsulate(relayed)); err != nil {
+		return time.Time{}, err
+	}
+	record.SetSeq(record.Seq() + 1)
+	if err := enode.SignV4(&record, key); err != nil {
+		return time.Time{}, err
+	}
+	return rsvp.Expiration, c.Register(ctx, srv, topic, record, ttl)
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/status-im/rendezvous/protocol"
+)
+
+// ACLRule controls requests to matching topics. Topic is either an exact topic, a namespace
+// pattern "ns/*" that matches the namespace and every topic under it, or "*" that matches
+// all topics. Requests are denied unless Register or Discover is set.
+type ACLRule struct {
+	Topic    string `json:"topic"`
+	Register bool   `json:"register"`
+	Discover bool   `json:"discover"`
+	// Peers are libp2p peer IDs allowed to register. Any peer is allowed if empty.
+	Peers []string `json:"peers,omitempty"`
+	// Keys are hex encoded compressed secp256k1 public keys of ENRs allowed to be registered.
+	// Any record is allowed if empty.
+	Keys []string `json:"keys,omitempty"`
+	// MaxTTL is a duration string, e.g. "10s". Server limit is used if empty.
+	MaxTTL string `json:"maxTTL,omitempty"`
+	// MaxRecords limits the number of active registrations per topic. Unlimited if zero.
+	MaxRecords int `json:"maxRecords,omitempty"`
+}
+
+// ACLConfig is the content of FilePolicy file. Rules are checked in order and the first
+// matching rule is applied. Default is applied if no rule matches.
+type ACLConfig struct {
+	Rules   []ACLRule `json:"rules"`
+	Default ACLRule   `json:"default"`
+}
+
+type aclRule struct {
+	ACLRule
+	namespace string
+	// pattern is true if rule matches topics under the namespace too.
+	pattern bool
+	all     bool
+	peers   map[peer.ID]struct{}
+	keys    map[string]struct{}
+	maxTTL  time.Duration
+}
+
+func newACLRule(r ACLRule) (rule aclRule, err error) {
+	rule = aclRule{ACLRule: r}
+	switch {
+	case r.Topic == protocol.TopicWildcard:
+		rule.all = true
+	case strings.HasSuffix(r.Topic, protocol.TopicWildcard):
+		namespace, _, err := protocol.ParseWildcard(r.Topic)
+		if err != nil {
+			return rule, fmt.Errorf("invalid topic pattern %q: %w", r.Topic, err)
+		}
+		rule.namespace = namespace
+		rule.pattern = true
+	default:
+		rule.namespace = r.Topic
+	}
+	if len(r.Peers) != 0 {
+		rule.peers = map[peer.ID]struct{}{}
+		for _, p := range r.Peers {
+			id, err := peer.Decode(p)
+			if err != nil {
+				return rule, fmt.Errorf("invalid peer %q: %w", p, err)
+			}
+			rule.peers[id] = struct{}{}
+		}
+	}
+	if len(r.Keys) != 0 {
+		rule.keys = map[string]struct{}{}
+		for _, k := range r.Keys {
+			raw, err := hex.DecodeString(strings.TrimPrefix(k, "0x"))
+			if err != nil {
+				return rule, fmt.Errorf("invalid key %q: %w", k, err)
+			}
+			if _, err := crypto.DecompressPubkey(raw); err != nil {
+				return rule, fmt.Errorf("invalid key %q: %w", k, err)
+			}
+			rule.keys[string(raw)] = struct{}{}
+		}
+	}
+	if len(r.MaxTTL) != 0 {
+		rule.maxTTL, err = time.ParseDuration(r.MaxTTL)
+		if err != nil {
+			return rule, fmt.Errorf("invalid max ttl %q: %w", r.MaxTTL, err)
+		}
+	}
+	return rule, nil
+}
+
+// matches returns true if rule applies to the topic.
+func (r aclRule) matches(topic string) bool {
+	if r.all {
+		return true
+	}
+	if r.pattern {
+		return protocol.InNamespace(topic, r.namespace)
+	}
+	return topic == r.namespace
+}
+
+// within returns true if rule applies only to topics of the namespace.
+func (r aclRule) within(namespace string) bool {
+	return !r.all && protocol.InNamespace(r.namespace, namespace)
+}
+
+func (r aclRule) allowRegister(req RegisterRequest) error {
+	if !r.Register {
+		return protocol.NewError(protocol.E_NOT_AUTHORIZED, "registration under the topic is not allowed")
+	}
+	if r.peers != nil {
+		if _, exist := r.peers[req.Peer]; !exist {
+			return protocol.NewError(protocol.E_NOT_AUTHORIZED, "peer is not allowed to register under the topic")
+		}
+	}
+	if r.keys != nil {
+		var key enode.Secp256k1
+		if err := req.Record.Load(&key); err != nil {
+			return protocol.NewError(protocol.E_NOT_AUTHORIZED, "record without secp256k1 key can't be registered under the topic")
+		}
+		if _, exist := r.keys[string(crypto.CompressPubkey((*ecdsa.PublicKey)(&key)))]; !exist {
+			return protocol.NewError(protocol.E_NOT_AUTHORIZED, "record key is not allowed to be registered under the topic")
+		}
+	}
+	if r.maxTTL != 0 && req.TTL > r.maxTTL {
+		return protocol.NewError(protocol.E_INVALID_TTL, fmt.Sprintf("ttl %v is longer than %v", req.TTL, r.maxTTL))
+	}
+	if r.MaxRecords != 0 && !req.Renewal && req.Active >= r.MaxRecords {
+		return protocol.NewError(protocol.E_NOT_AUTHORIZED, fmt.Sprintf("topic has %d registrations already", req.Active))
+	}
+	return nil
+}
+
+// NewFilePolicy loads policy from JSON file with ACLConfig.
+func NewFilePolicy(path string) (*FilePolicy, error) {
+	p := &FilePolicy{path: path}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// FilePolicy is a Policy loaded from a file. Use Reload to apply changes in the file.
+type FilePolicy struct {
+	path string
+
+	mu    sync.RWMutex
+	rules []aclRule
+	def   aclRule
+}
+
+// Reload reads the file again. Current rules are kept if file is invalid.
+func (p *FilePolicy) Reload() error {
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	var cfg ACLConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("can't parse %s: %w", p.path, err)
+	}
+	rules := make([]aclRule, len(cfg.Rules))
+	for i := range cfg.Rules {
+		rules[i], err = newACLRule(cfg.Rules[i])
+		if err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+	cfg.Default.Topic = protocol.TopicWildcard
+	def, err := newACLRule(cfg.Default)
+	if err != nil {
+		return fmt.Errorf("default rule: %w", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rules = rules
+	p.def = def
+	return nil
+}
+
+func (p *FilePolicy) rule(topic string) aclRule {
+	for _, r := range p.rules {
+		if r.matches(topic) {
+			return r
+		}
+	}
+	return p.def
+}
+
+func (p *FilePolicy) AllowRegister(req RegisterRequest) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.rule(req.Topic).allowRegister(req)
+}
+
+// AllowDiscover checks rule of the topic. Wildcard pattern is also denied if discovery is denied
+// by any rule for topics under the namespace.
+func (p *FilePolicy) AllowDiscover(req DiscoverRequest) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	namespace, wildcard, _ := protocol.ParseWildcard(req.Topic)
+	if !wildcard {
+		namespace = req.Topic
+	}
+	denied := !p.rule(namespace).Discover
+	if wildcard {
+		for _, r := range p.rules {
+			if r.within(namespace) && !r.Discover {
+				denied = true
+			}
+		}
+	}
+	if denied {
+		return protocol.NewError(protocol.E_NOT_AUTHORIZED, "discovery of the topic is not allowed")
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/status-im/rendezvous/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func writePolicy(t *testing.T, path, content string) {
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+}
+
+func newRecord(t *testing.T) (*ecdsa.PrivateKey, enr.Record) {
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	var r enr.Record
+	require.NoError(t, enode.SignV4(&r, key))
+	return key, r
+}
+
+func TestFilePolicy(t *testing.T) {
+	allowed, allowedRecord := newRecord(t)
+	_, otherRecord := newRecord(t)
+	path := filepath.Join(t.TempDir(), "policy.json")
+	writePolicy(t, path, `{
+		"rules": [
+			{"topic": "/private/*", "register": true, "keys": ["`+hex.EncodeToString(crypto.CompressPubkey(&allowed.PublicKey))+`"]},
+			{"topic": "/public/*", "register": true, "discover": true, "maxTTL": "5s", "maxRecords": 1}
+		]
+	}`)
+	policy, err := NewFilePolicy(path)
+	require.NoError(t, err)
+	srv := newTestServer(t, WithPolicy(policy))
+
+	for _, tc := range []struct {
+		desc   string
+		topic  string
+		record enr.Record
+		ttl    time.Duration
+		status protocol.ResponseStatus
+	}{
+		{"allowed key", "/private/a", allowedRecord, time.Second, protocol.OK},
+		{"other key", "/private/a", otherRecord, time.Second, protocol.E_NOT_AUTHORIZED},
+		{"default denies", "/other", allowedRecord, time.Second, protocol.E_NOT_AUTHORIZED},
+		{"ttl too long", "/public/a", otherRecord, 10 * time.Second, protocol.E_INVALID_TTL},
+		{"first record", "/public/a", otherRecord, time.Second, protocol.OK},
+		{"renewal", "/public/a", otherRecord, time.Second, protocol.OK},
+		{"too many records", "/public/a", allowedRecord, time.Second, protocol.E_NOT_AUTHORIZED},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			resp, err := srv.register("", protocol.Register{Topic: tc.topic, Record: tc.record, TTL: uint64(tc.ttl)})
+			require.NoError(t, err)
+			require.Equal(t, tc.status, resp.Status, resp.Message)
+		})
+	}
+
+	for _, tc := range []struct {
+		topic  string
+		status protocol.ResponseStatus
+	}{
+		{"/public/a", protocol.OK},
+		{protocol.Subtopics("/public"), protocol.OK},
+		{"/private/a", protocol.E_NOT_AUTHORIZED},
+		{protocol.Subtopics("/"), protocol.E_INVALID_NAMESPACE},
+	} {
+		data, err := rlp.EncodeToBytes(protocol.DiscoverV2{Topic: tc.topic, Limit: 1})
+		require.NoError(t, err)
+		_, resp, err := srv.msgParser(nil, protocol.CodecV2, protocol.DISCOVER, rlp.NewStream(bytes.NewReader(data), 0))
+		require.NoError(t, err)
+		require.Equal(t, tc.status, resp.(protocol.DiscoverResponseV2).Status, tc.topic)
+	}
+}
+
+// slowPolicy widens the window between the policy check and the store.
+type slowPolicy struct {
+	Policy
+}
+
+func (p slowPolicy) AllowRegister(req RegisterRequest) error {
+	time.Sleep(10 * time.Millisecond)
+	return p.Policy.AllowRegister(req)
+}
+
+func TestFilePolicyConcurrentRegistrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	writePolicy(t, path, `{"default": {"register": true, "maxRecords": 1}}`)
+	policy, err := NewFilePolicy(path)
+	require.NoError(t, err)
+	srv := newTestServer(t, WithPolicy(slowPolicy{policy}))
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		accepted int
+	)
+	for i := 0; i < 20; i++ {
+		_, record := newRecord(t)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := srv.register("", protocol.Register{Topic: "any", Record: record, TTL: uint64(time.Second)})
+			require.NoError(t, err)
+			if resp.Status == protocol.OK {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 1, accepted)
+}
+
+func TestFilePolicyReplicatedRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	writePolicy(t, path, `{"rules": [{"topic": "closed"}], "default": {"register": true, "maxRecords": 1}}`)
+	policy, err := NewFilePolicy(path)
+	require.NoError(t, err)
+	srv := newTestServer(t, WithFederation(DefaultFederationConfig), WithPolicy(policy))
+
+	deadline := unixNano(time.Now().Add(10 * time.Second))
+	var update protocol.FederationUpdate
+	for _, topic := range []string{"any", "any", "closed"} {
+		_, record := newRecord(t)
+		update.Records = append(update.Records, protocol.FederatedRecord{Topic: topic, Record: record, Deadline: deadline})
+	}
+	require.Equal(t, []uint{1, 2}, srv.applyUpdate("", update))
+	require.Equal(t, 1, srv.topics.count("any"))
+	require.Equal(t, 0, srv.topics.count("closed"))
+
+	// renewal of the stored record is within the limit
+	update.Records = update.Records[:1]
+	update.Records[0].Deadline = unixNano(time.Now().Add(20 * time.Second))
+	require.Empty(t, srv.applyUpdate("", update))
+}
+
+func TestFilePolicyReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	writePolicy(t, path, `{"default": {"discover": true}}`)
+	policy, err := NewFilePolicy(path)
+	require.NoError(t, err)
+	require.NoError(t, policy.AllowDiscover(DiscoverRequest{Topic: "any"}))
+	require.ErrorIs(t, policy.AllowRegister(RegisterRequest{Topic: "any"}), protocol.ErrNotAuthorized)
+
+	writePolicy(t, path, `{"default": {"register": true}}`)
+	require.NoError(t, policy.Reload())
+	require.ErrorIs(t, policy.AllowDiscover(DiscoverRequest{Topic: "any"}), protocol.ErrNotAuthorized)
+	require.NoError(t, policy.AllowRegister(RegisterRequest{Topic: "any"}))
+
+	writePolicy(t, path, `{"rules": [{"topic": "/a*"}]}`)
+	require.Error(t, policy.Reload())
+	require.NoError(t, policy.AllowRegister(RegisterRequest{Topic: "any"}))
+}
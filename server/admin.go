@@ -0,0 +1,367 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/status-im/rendezvous/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Config is the effective configuration of the server.
+type Config struct {
+	Version           string            `json:"version"`
+	Addresses         []string          `json:"addresses,omitempty"`
+	LongestTTL        string            `json:"longestTTL"`
+	MaxLimit          uint              `json:"maxLimit"`
+	MaxTopicLength    int               `json:"maxTopicLength"`
+	TopicsDisabled    bool              `json:"topicsDisabled"`
+	NamespacePolicies []string          `json:"namespacePolicies,omitempty"`
+	Policy            string            `json:"policy,omitempty"`
+	PrivateTopics     map[string]string `json:"privateTopics,omitempty"`
+	Scoring           *ScoreConfig      `json:"scoring,omitempty"`
+	Resources         ResourceLimits    `json:"resources"`
+	Relay             *relay.Resources  `json:"relay,omitempty"`
+	Federation        *FederationConfig `json:"federation,omitempty"`
+	Cluster           *ClusterConfig    `json:"cluster,omitempty"`
+}
+
+// Config returns the effective configuration of the server.
+func (srv *Server) Config() Config {
+	cfg := Config{
+		Version:        Version,
+		LongestTTL:     longestTTL.String(),
+		MaxLimit:       maxLimit,
+		MaxTopicLength: maxTopicLength,
+		TopicsDisabled: srv.topicsDisabled,
+		Resources:      srv.limits,
+		Relay:          srv.relayResources,
+	}
+	for _, addr := range srv.Addrs() {
+		cfg.Addresses = append(cfg.Addresses, addr.String())
+	}
+	for ns := range srv.policies {
+		cfg.NamespacePolicies = append(cfg.NamespacePolicies, ns)
+	}
+	sort.Strings(cfg.NamespacePolicies)
+	if srv.policy != nil {
+		cfg.Policy = fmt.Sprintf("%T", srv.policy)
+	}
+	if len(srv.private) != 0 {
+		cfg.PrivateTopics = map[string]string{}
+		for topic, owner := range srv.private {
+			cfg.PrivateTopics[topic] = hex.EncodeToString(crypto.CompressPubkey(owner))
+		}
+	}
+	if srv.scores != nil {
+		cfg.Scoring = &srv.scores.cfg
+	}
+	if srv.federation != nil {
+		cfg.Federation = &srv.federation.cfg
+	}
+	if srv.cluster != nil {
+		cluster := srv.cluster.cfg
+		cluster.Members = srv.ClusterMembers()
+		cfg.Cluster = &cluster
+	}
+	return cfg
+}
+
+// adminTopic is a topic in admin API. Blinded topics are hex encoded.
+type adminTopic struct {
+	Topic   string `json:"topic"`
+	Blinded bool   `json:"blinded,omitempty"`
+	Count   uint64 `json:"count,omitempty"`
+}
+
+func newAdminTopic(topic string) adminTopic {
+	if protocol.IsBlinded(topic) {
+		return adminTopic{Topic: hex.EncodeToString([]byte(topic)), Blinded: true}
+	}
+	return adminTopic{Topic: topic}
+}
+
+type adminRegistration struct {
+	adminTopic
+	Node       string            `json:"node"`
+	ID         string            `json:"id,omitempty"`
+	ENR        string            `json:"enr"`
+	Seq        uint64            `json:"seq"`
+	IP         string            `json:"ip,omitempty"`
+	TCP        int               `json:"tcp,omitempty"`
+	UDP        int               `json:"udp,omitempty"`
+	Fields     map[string]string `json:"fields"`
+	Registered time.Time         `json:"registered,omitempty"`
+	Deadline   time.Time         `json:"deadline"`
+}
+
+func newAdminRegistration(key RecordsKey, stored StorageRecord) adminRegistration {
+	reg := adminRegistration{
+		adminTopic: newAdminTopic(string(TopicPart(key))),
+		Node:       hex.EncodeToString(NodeAddrPart(key)),
+		Seq:        stored.ENR.Seq(),
+		Fields:     map[string]string{},
+		Registered: stored.Registered,
+		Deadline:   stored.Time,
+	}
+	elements := stored.ENR.AppendElements(nil)
+	for i := 1; i+1 < len(elements); i += 2 {
+		raw, _ := elements[i+1].(rlp.RawValue)
+		reg.Fields[elements[i].(string)] = hex.EncodeToString(raw)
+	}
+	if node, err := enode.New(protocol.ValidSchemes, &stored.ENR); err == nil {
+		reg.ID = node.ID().String()
+		reg.ENR = node.String()
+		if ip := node.IP(); ip != nil {
+			reg.IP = ip.String()
+		}
+		reg.TCP = node.TCP()
+		reg.UDP = node.UDP()
+	}
+	return reg
+}
+
+type adminBan struct {
+	Kind   BanKind `json:"kind"`
+	Target string  `json:"target"`
+	Reason string  `json:"reason,omitempty"`
+	// Expiry is RFC 3339 time, ban is permanent if omitted.
+	Expiry *time.Time `json:"expiry,omitempty"`
+	// Duration is used if expiry is omitted, e.g. "1h".
+	Duration string `json:"duration,omitempty"`
+}
+
+// AdminHandler serves JSON admin API under /admin/. Every request must carry the token
+// in "Authorization: Bearer" header. Flags are returned together with Config.
+func (srv *Server) AdminHandler(token string, flags map[string]string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/config", srv.adminMethod(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, struct {
+			Server Config            `json:"server"`
+			Flags  map[string]string `json:"flags,omitempty"`
+		}{srv.Config(), flags})
+	}))
+	mux.HandleFunc("/admin/topics", srv.adminMethod(http.MethodGet, srv.adminTopics))
+	mux.HandleFunc("/admin/registrations", srv.adminMethod(http.MethodGet, srv.adminRegistrations))
+	mux.HandleFunc("/admin/registration", srv.adminRegistration)
+	mux.HandleFunc("/admin/bans", srv.adminBans)
+	mux.HandleFunc("/admin/cluster", srv.adminCluster)
+	mux.HandleFunc("/admin/scores", srv.adminMethod(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		scores := map[string]float64{}
+		for id, score := range srv.Scores() {
+			scores[id.String()] = score
+		}
+		writeJSON(w, http.StatusOK, scores)
+	}))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if len(token) == 0 || !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (srv *Server) adminMethod(method string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+			return
+		}
+		fn(w, r)
+	}
+}
+
+func (srv *Server) adminTopics(w http.ResponseWriter, r *http.Request) {
+	rst := []adminTopic{}
+	for _, stat := range srv.topics.list(r.URL.Query().Get("prefix"), math.MaxUint32, func(string) bool { return false }) {
+		t := newAdminTopic(stat.Topic)
+		t.Count = stat.Count
+		rst = append(rst, t)
+	}
+	writeJSON(w, http.StatusOK, rst)
+}
+
+// queryTopic reads topic parameter, hex decoded if blinded parameter is true.
+func queryTopic(r *http.Request) (string, error) {
+	topic := r.URL.Query().Get("topic")
+	if len(topic) == 0 {
+		return "", errors.New("topic is required")
+	}
+	if r.URL.Query().Get("blinded") != "true" {
+		return topic, nil
+	}
+	raw, err := hex.DecodeString(topic)
+	if err != nil {
+		return "", fmt.Errorf("invalid blinded topic: %w", err)
+	}
+	return string(raw), nil
+}
+
+func (srv *Server) adminRegistrations(w http.ResponseWriter, r *http.Request) {
+	topic, err := queryTopic(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	keys, stored, err := srv.storage.GetAll(topic)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	rst := make([]adminRegistration, len(stored))
+	for i := range stored {
+		rst[i] = newAdminRegistration(keys[i], stored[i])
+	}
+	writeJSON(w, http.StatusOK, rst)
+}
+
+// adminRegistration returns registration of the node under the topic on GET and expires it on DELETE.
+func (srv *Server) adminRegistration(w http.ResponseWriter, r *http.Request) {
+	topic, err := queryTopic(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	addr, err := hex.DecodeString(strings.TrimPrefix(r.URL.Query().Get("node"), "0x"))
+	if err != nil || len(addr) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("node must be hex encoded node address"))
+		return
+	}
+	key := NewRecordsKeyForAddr(topic, addr)
+	stored, err := srv.storage.Get(key.String())
+	if errors.Is(err, leveldb.ErrNotFound) {
+		writeError(w, http.StatusNotFound, errors.New("registration not found"))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, newAdminRegistration(key, stored))
+	case http.MethodDelete:
+		if err := srv.remove(key.String()); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		logger.Info("registration expired by admin", "topic", topic, "node", hex.EncodeToString(addr))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+	}
+}
+
+func (srv *Server) adminBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		rst := []adminBan{}
+		for _, b := range srv.Bans() {
+			ab := adminBan{Kind: b.Kind, Target: b.Target, Reason: b.Reason}
+			if !b.Expiry.IsZero() {
+				expiry := b.Expiry
+				ab.Expiry = &expiry
+			}
+			rst = append(rst, ab)
+		}
+		sort.Slice(rst, func(i, j int) bool {
+			return rst[i].Kind < rst[j].Kind || (rst[i].Kind == rst[j].Kind && rst[i].Target < rst[j].Target)
+		})
+		writeJSON(w, http.StatusOK, rst)
+	case http.MethodPost:
+		var ab adminBan
+		if err := json.NewDecoder(r.Body).Decode(&ab); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		b := Ban{Kind: ab.Kind, Target: ab.Target, Reason: ab.Reason}
+		if ab.Expiry != nil {
+			b.Expiry = *ab.Expiry
+		} else if len(ab.Duration) != 0 {
+			duration, err := time.ParseDuration(ab.Duration)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			b.Expiry = time.Now().Add(duration)
+		}
+		if err := srv.Ban(b); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err := srv.Unban(BanKind(r.URL.Query().Get("kind")), r.URL.Query().Get("target")); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+	}
+}
+
+// adminCluster returns cluster members on GET and replaces them on PUT with a JSON list of
+// multiaddrs, e.g. when a server joins or leaves.
+func (srv *Server) adminCluster(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		members := []string{}
+		for _, addr := range srv.ClusterMembers() {
+			members = append(members, addr.String())
+		}
+		writeJSON(w, http.StatusOK, members)
+	case http.MethodPut:
+		var members []string
+		if err := json.NewDecoder(r.Body).Decode(&members); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		addrs := make([]ma.Multiaddr, len(members))
+		for i, value := range members {
+			addr, err := ma.NewMultiaddr(value)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid member %q: %w", value, err))
+				return
+			}
+			addrs[i] = addr
+		}
+		if err := srv.SetClusterMembers(addrs); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		logger.Info("cluster members updated by admin", "members", len(addrs))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, val interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(val); err != nil {
+		logger.Debug("error writing admin response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
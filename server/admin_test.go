@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/status-im/rendezvous/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func adminRequest(t *testing.T, h http.Handler, method, path, body string, val interface{}) int {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if val != nil {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), val), rec.Body.String())
+	}
+	return rec.Code
+}
+
+func TestAdminAPI(t *testing.T) {
+	srv := newTestServer(t)
+	key, r := newRecord(t)
+	blinded := protocol.BlindTopic([]byte("secret"), "app", 1)
+	for _, topic := range []string{"/app/chat", blinded} {
+		resp, err := srv.register("", protocol.Register{Record: r, Topic: topic, TTL: uint64(10 * time.Second)})
+		require.NoError(t, err)
+		require.Equal(t, protocol.OK, resp.Status, resp.Message)
+	}
+	h := srv.AdminHandler("secret", map[string]string{"port": "9090"})
+
+	for _, auth := range []string{"", "secret", "Bearer other", "Basic secret"} {
+		req := httptest.NewRequest(http.MethodGet, "/admin/topics", nil)
+		req.Header.Set("Authorization", auth)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusUnauthorized, rec.Code, auth)
+	}
+
+	var topics []adminTopic
+	require.Equal(t, http.StatusOK, adminRequest(t, h, http.MethodGet, "/admin/topics", "", &topics))
+	require.Equal(t, []adminTopic{
+		{Topic: hex.EncodeToString([]byte(blinded)), Blinded: true, Count: 1},
+		{Topic: "/app/chat", Count: 1},
+	}, topics)
+
+	var regs []adminRegistration
+	require.Equal(t, http.StatusOK, adminRequest(t, h, http.MethodGet, "/admin/registrations?blinded=true&topic="+topics[0].Topic, "", &regs))
+	require.Len(t, regs, 1)
+	id := enode.PubkeyToIDV4(&key.PublicKey).String()
+	require.Equal(t, id, regs[0].ID)
+	require.Equal(t, id, regs[0].Node)
+	require.Contains(t, regs[0].Fields, "secp256k1")
+	require.False(t, regs[0].Deadline.IsZero())
+
+	path := "/admin/registration?topic=" + url.QueryEscape("/app/chat") + "&node=" + id
+	var reg adminRegistration
+	require.Equal(t, http.StatusOK, adminRequest(t, h, http.MethodGet, path, "", &reg))
+	require.Equal(t, "/app/chat", reg.Topic)
+	require.Equal(t, http.StatusNoContent, adminRequest(t, h, http.MethodDelete, path, "", nil))
+	require.Equal(t, http.StatusNotFound, adminRequest(t, h, http.MethodGet, path, "", nil))
+	require.Equal(t, 0, srv.topics.count("/app/chat"))
+
+	require.Equal(t, http.StatusNoContent, adminRequest(t, h, http.MethodPost, "/admin/bans", `{"kind": "ip", "target": "10.0.0.1", "duration": "1h"}`, nil))
+	require.Equal(t, http.StatusBadRequest, adminRequest(t, h, http.MethodPost, "/admin/bans", `{"kind": "ip", "target": "invalid"}`, nil))
+	var bans []adminBan
+	require.Equal(t, http.StatusOK, adminRequest(t, h, http.MethodGet, "/admin/bans", "", &bans))
+	require.Len(t, bans, 1)
+	require.Equal(t, "10.0.0.1/32", bans[0].Target)
+	require.NotNil(t, bans[0].Expiry)
+	require.Equal(t, http.StatusNoContent, adminRequest(t, h, http.MethodDelete, "/admin/bans?kind=ip&target=10.0.0.1", "", nil))
+	require.Empty(t, srv.Bans())
+
+	var cfg struct {
+		Server Config
+		Flags  map[string]string
+	}
+	require.Equal(t, http.StatusOK, adminRequest(t, h, http.MethodGet, "/admin/config", "", &cfg))
+	require.Equal(t, longestTTL.String(), cfg.Server.LongestTTL)
+	require.Equal(t, "9090", cfg.Flags["port"])
+}
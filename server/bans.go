@@ -0,0 +1,391 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/status-im/rendezvous/protocol"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// BanKind is the kind of the banned target.
+type BanKind string
+
+const (
+	// BanNode bans hex encoded node address, see enr.IdentityScheme. It is the node ID for v4 records.
+	BanNode BanKind = "node"
+	// BanPeer bans libp2p peer ID. Node with the same secp256k1 key is banned too.
+	BanPeer BanKind = "peer"
+	// BanIP bans IP address or CIDR range.
+	BanIP BanKind = "ip"
+)
+
+// Ban blocks connections and registrations of the target.
+type Ban struct {
+	Kind   BanKind
+	Target string
+	Reason string
+	// Expiry is when the ban is lifted. Ban is permanent if zero.
+	Expiry time.Time
+}
+
+func (b Ban) expired(now time.Time) bool {
+	return !b.Expiry.IsZero() && !now.Before(b.Expiry)
+}
+
+type banRLP struct {
+	Reason string
+	Expiry uint64
+	Rest   []rlp.RawValue `rlp:"tail"`
+}
+
+// normalizeBan validates target of the ban and converts it to the canonical form, so that
+// the same target is always stored under the same key.
+func normalizeBan(b Ban) (Ban, error) {
+	switch b.Kind {
+	case BanNode:
+		raw, err := hex.DecodeString(strings.TrimPrefix(b.Target, "0x"))
+		if err != nil || len(raw) == 0 {
+			return b, fmt.Errorf("invalid node address %q", b.Target)
+		}
+		b.Target = hex.EncodeToString(raw)
+	case BanPeer:
+		id, err := peer.Decode(b.Target)
+		if err != nil {
+			return b, fmt.Errorf("invalid peer %q: %w", b.Target, err)
+		}
+		b.Target = id.String()
+	case BanIP:
+		ipnet, err := parseIPNet(b.Target)
+		if err != nil {
+			return b, err
+		}
+		b.Target = ipnet.String()
+	default:
+		return b, fmt.Errorf("unknown ban kind %q", b.Kind)
+	}
+	return b, nil
+}
+
+// parseIPNet parses CIDR range. Single address is a range of its own.
+func parseIPNet(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip %q", value)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ip range %q: %w", value, err)
+	}
+	return ipnet, nil
+}
+
+func banKey(kind BanKind, target string) []byte {
+	return append([]byte{BansPrefix}, []byte(string(kind)+":"+target)...)
+}
+
+// AddBan stores the ban, previous ban of the same target is replaced.
+func (s *Storage) AddBan(b Ban) error {
+	data, err := rlp.EncodeToBytes(banRLP{Reason: b.Reason, Expiry: unixNano(b.Expiry)})
+	if err != nil {
+		return err
+	}
+	return s.db.Put(banKey(b.Kind, b.Target), data, nil)
+}
+
+// RemoveBan removes the ban of the target.
+func (s *Storage) RemoveBan(kind BanKind, target string) error {
+	return s.db.Delete(banKey(kind, target), nil)
+}
+
+// Bans returns all stored bans, expired ones included.
+func (s *Storage) Bans() (rst []Ban, err error) {
+	iter := s.db.NewIterator(util.BytesPrefix([]byte{BansPrefix}), nil)
+	defer iter.Release()
+	for iter.Next() {
+		parts := strings.SplitN(string(iter.Key()[1:]), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed ban key %x", iter.Key())
+		}
+		var stored banRLP
+		if err := rlp.DecodeBytes(iter.Value(), &stored); err != nil {
+			return nil, err
+		}
+		rst = append(rst, Ban{Kind: BanKind(parts[0]), Target: parts[1], Reason: stored.Reason, Expiry: fromUnixNano(stored.Expiry)})
+	}
+	return rst, iter.Error()
+}
+
+// KeysOfNode returns keys of all registrations of the node address.
+func (s *Storage) KeysOfNode(addr []byte) (rst []RecordsKey, err error) {
+	iter := s.db.NewIterator(util.BytesPrefix([]byte{RecordsPrefix}), nil)
+	defer iter.Release()
+	for iter.Next() {
+		if string(NodeAddrPart(iter.Key())) == string(addr) {
+			rst = append(rst, append(RecordsKey{}, iter.Key()...))
+		}
+	}
+	return rst, iter.Error()
+}
+
+type bannedNet struct {
+	ipnet *net.IPNet
+	ban   Ban
+}
+
+// banlist keeps bans in memory. It is used as libp2p connection gater.
+type banlist struct {
+	mu    sync.RWMutex
+	nodes map[string]Ban
+	peers map[peer.ID]Ban
+	nets  map[string]bannedNet
+}
+
+func newBanlist() *banlist {
+	return &banlist{
+		nodes: map[string]Ban{},
+		peers: map[peer.ID]Ban{},
+		nets:  map[string]bannedNet{},
+	}
+}
+
+// add expects normalized ban.
+func (l *banlist) add(b Ban) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch b.Kind {
+	case BanNode:
+		raw, _ := hex.DecodeString(b.Target)
+		l.nodes[string(raw)] = b
+	case BanPeer:
+		id, _ := peer.Decode(b.Target)
+		l.peers[id] = b
+	case BanIP:
+		ipnet, _ := parseIPNet(b.Target)
+		l.nets[b.Target] = bannedNet{ipnet: ipnet, ban: b}
+	}
+}
+
+// remove expects normalized ban and returns false if target wasn't banned.
+func (l *banlist) remove(b Ban) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var exist bool
+	switch b.Kind {
+	case BanNode:
+		raw, _ := hex.DecodeString(b.Target)
+		_, exist = l.nodes[string(raw)]
+		delete(l.nodes, string(raw))
+	case BanPeer:
+		id, _ := peer.Decode(b.Target)
+		_, exist = l.peers[id]
+		delete(l.peers, id)
+	case BanIP:
+		_, exist = l.nets[b.Target]
+		delete(l.nets, b.Target)
+	}
+	return exist
+}
+
+func (l *banlist) list() (rst []Ban) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, b := range l.nodes {
+		rst = append(rst, b)
+	}
+	for _, b := range l.peers {
+		rst = append(rst, b)
+	}
+	for _, n := range l.nets {
+		rst = append(rst, n.ban)
+	}
+	return rst
+}
+
+// expired returns bans that expired before now.
+func (l *banlist) expired(now time.Time) (rst []Ban) {
+	for _, b := range l.list() {
+		if b.expired(now) {
+			rst = append(rst, b)
+		}
+	}
+	return rst
+}
+
+func (l *banlist) bannedNode(addr []byte) bool {
+	if len(addr) == 0 {
+		return false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	b, exist := l.nodes[string(addr)]
+	return exist && !b.expired(time.Now())
+}
+
+// bannedPeer returns true if peer or node with the same key is banned.
+func (l *banlist) bannedPeer(id peer.ID) bool {
+	l.mu.RLock()
+	b, exist := l.peers[id]
+	l.mu.RUnlock()
+	if exist && !b.expired(time.Now()) {
+		return true
+	}
+	return l.bannedNode(peerNodeAddr(id))
+}
+
+func (l *banlist) bannedAddr(addr ma.Multiaddr) bool {
+	if addr == nil {
+		return false
+	}
+	ip, err := manet.ToIP(addr)
+	if err != nil {
+		return false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	now := time.Now()
+	for _, n := range l.nets {
+		if n.ipnet.Contains(ip) && !n.ban.expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *banlist) InterceptPeerDial(id peer.ID) bool {
+	return !l.bannedPeer(id)
+}
+
+func (l *banlist) InterceptAddrDial(id peer.ID, addr ma.Multiaddr) bool {
+	return !l.bannedPeer(id) && !l.bannedAddr(addr)
+}
+
+func (l *banlist) InterceptAccept(addrs network.ConnMultiaddrs) bool {
+	return !l.bannedAddr(addrs.RemoteMultiaddr())
+}
+
+func (l *banlist) InterceptSecured(_ network.Direction, id peer.ID, addrs network.ConnMultiaddrs) bool {
+	return !l.bannedPeer(id) && !l.bannedAddr(addrs.RemoteMultiaddr())
+}
+
+func (l *banlist) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
+
+// loadBans restores bans from storage.
+func (srv *Server) loadBans() error {
+	bans, err := srv.storage.Bans()
+	if err != nil {
+		return err
+	}
+	for _, b := range bans {
+		b, err := normalizeBan(b)
+		if err != nil {
+			logger.Error("skipping invalid ban", "error", err)
+			continue
+		}
+		srv.bans.add(b)
+	}
+	return nil
+}
+
+// Ban blocks connections from the target and its registrations. Existing registrations
+// of the banned node or peer are removed and connections matching the ban are closed.
+// Ban is persisted and replaces previous ban of the same target.
+func (srv *Server) Ban(b Ban) error {
+	b, err := normalizeBan(b)
+	if err != nil {
+		return err
+	}
+	if err := srv.storage.AddBan(b); err != nil {
+		return err
+	}
+	srv.bans.add(b)
+	logger.Info("banned", "kind", b.Kind, "target", b.Target, "reason", b.Reason, "expiry", b.Expiry)
+	var addr []byte
+	switch b.Kind {
+	case BanNode:
+		addr, _ = hex.DecodeString(b.Target)
+	case BanPeer:
+		id, _ := peer.Decode(b.Target)
+		addr = peerNodeAddr(id)
+	}
+	if len(addr) != 0 {
+		keys, err := srv.storage.KeysOfNode(addr)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := srv.remove(key.String()); err != nil {
+				return err
+			}
+		}
+	}
+	if srv.h != nil {
+		for _, conn := range srv.h.Network().Conns() {
+			if srv.bans.bannedPeer(conn.RemotePeer()) || srv.bans.bannedAddr(conn.RemoteMultiaddr()) {
+				conn.Close()
+			}
+		}
+	}
+	return nil
+}
+
+// Unban lifts the ban of the target.
+func (srv *Server) Unban(kind BanKind, target string) error {
+	b, err := normalizeBan(Ban{Kind: kind, Target: target})
+	if err != nil {
+		return err
+	}
+	if !srv.bans.remove(b) {
+		return errors.New("target is not banned")
+	}
+	logger.Info("ban lifted", "kind", b.Kind, "target", b.Target)
+	return srv.storage.RemoveBan(b.Kind, b.Target)
+}
+
+// Bans returns active bans.
+func (srv *Server) Bans() (rst []Ban) {
+	now := time.Now()
+	for _, b := range srv.bans.list() {
+		if !b.expired(now) {
+			rst = append(rst, b)
+		}
+	}
+	return rst
+}
+
+// purgeBans removes expired bans.
+func (srv *Server) purgeBans() {
+	for _, b := range srv.bans.expired(time.Now()) {
+		srv.bans.remove(b)
+		if err := srv.storage.RemoveBan(b.Kind, b.Target); err != nil {
+			logger.Error("error removing ban from storage", "kind", b.Kind, "target", b.Target, "error", err)
+		}
+	}
+}
+
+// checkBanned rejects registrations of banned nodes and from banned peers.
+func (srv *Server) checkBanned(req RegisterRequest) *protocol.Error {
+	if srv.bans.bannedNode(protocol.StoredSchemes.NodeAddr(&req.Record)) || (len(req.Peer) != 0 && srv.bans.bannedPeer(req.Peer)) {
+		return protocol.NewError(protocol.E_NOT_AUTHORIZED, "banned")
+	}
+	return nil
+}
@@ -79,6 +79,23 @@ func (c *Cleaner) Add(deadlineTime time.Time, key string) {
 	heap.Push(c, key)
 }
 
+// Remove deletes key, it won't be returned by PopSince.
+func (c *Cleaner) Remove(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exist := c.deadlines[key]; !exist {
+		return false
+	}
+	for i, n := range c.heap {
+		if n == key {
+			heap.Remove(c, i)
+			break
+		}
+	}
+	delete(c.deadlines, key)
+	return true
+}
+
 func (c *Cleaner) Exist(key string) bool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
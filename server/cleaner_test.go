@@ -22,3 +22,13 @@ func TestCleaner(t *testing.T) {
 	assert.Equal(t, []string{added[3*time.Minute]}, c.PopSince(time.Time{}.Add(200*time.Second)))
 	assert.Empty(t, c.PopSince(time.Time{}.Add(500*time.Second)))
 }
+
+func TestCleanerRemove(t *testing.T) {
+	c := NewCleaner()
+	c.Add(time.Time{}.Add(time.Minute), "first")
+	c.Add(time.Time{}.Add(2*time.Minute), "second")
+	assert.True(t, c.Remove("first"))
+	assert.False(t, c.Remove("first"))
+	assert.False(t, c.Exist("first"))
+	assert.Equal(t, []string{"second"}, c.PopSince(time.Time{}.Add(time.Hour)))
+}
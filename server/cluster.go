@@ -0,0 +1,334 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/status-im/rendezvous/protocol"
+)
+
+// ClusterConfig configures sharding of topics between servers.
+type ClusterConfig struct {
+	// Members are addresses of all servers in the cluster with their identity, as returned by
+	// Server.Addr, including this server.
+	Members []ma.Multiaddr
+	// VirtualNodes is the number of points of every member on the hash ring.
+	VirtualNodes int
+	// Proxy makes server forward requests for topics it doesn't own to the owner, otherwise
+	// client is redirected with E_REDIRECT.
+	Proxy bool
+	// RebalanceInterval is how often records of topics owned by other members are handed off,
+	// in addition to every membership change.
+	RebalanceInterval time.Duration
+}
+
+// DefaultClusterConfig is a config without members.
+var DefaultClusterConfig = ClusterConfig{
+	VirtualNodes:      64,
+	RebalanceInterval: time.Minute,
+}
+
+// WithCluster splits topics between cluster members by consistent hash of protocol.ShardKey.
+func WithCluster(cfg ClusterConfig) ServerOption {
+	return func(srv *Server) {
+		if cfg.VirtualNodes == 0 {
+			cfg.VirtualNodes = DefaultClusterConfig.VirtualNodes
+		}
+		if cfg.RebalanceInterval == 0 {
+			cfg.RebalanceInterval = DefaultClusterConfig.RebalanceInterval
+		}
+		srv.cluster = &cluster{cfg: cfg, rebalance: make(chan struct{}, 1)}
+	}
+}
+
+type cluster struct {
+	cfg       ClusterConfig
+	rebalance chan struct{}
+
+	mu      sync.RWMutex
+	addrs   []ma.Multiaddr
+	members map[peer.ID]ma.Multiaddr
+	ring    []ringPoint
+}
+
+type ringPoint struct {
+	hash   uint64
+	member peer.ID
+}
+
+func ringHash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// owner returns member that owns the topic and its address.
+func (c *cluster) owner(topic string) (peer.ID, ma.Multiaddr) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.ring) == 0 {
+		return "", nil
+	}
+	hash := ringHash(protocol.ShardKey(topic))
+	idx := sort.Search(len(c.ring), func(i int) bool { return c.ring[i].hash >= hash })
+	if idx == len(c.ring) {
+		idx = 0
+	}
+	id := c.ring[idx].member
+	return id, c.members[id]
+}
+
+func (c *cluster) member(id peer.ID) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, exist := c.members[id]
+	return exist
+}
+
+// SetClusterMembers replaces members of the cluster, e.g. when a server joins or leaves. Records
+// of topics that are now owned by other members are handed off to them. Server that is not
+// a member owns no topics, so leaving server is drained by removing it from its own list too.
+func (srv *Server) SetClusterMembers(addrs []ma.Multiaddr) error {
+	if srv.cluster == nil {
+		return errors.New("cluster mode is disabled")
+	}
+	members := make(map[peer.ID]ma.Multiaddr, len(addrs))
+	for _, addr := range addrs {
+		id, _, err := splitServerAddr(addr)
+		if err != nil {
+			return fmt.Errorf("invalid cluster member %v: %w", addr, err)
+		}
+		members[id] = addr
+	}
+	ring := make([]ringPoint, 0, len(members)*srv.cluster.cfg.VirtualNodes)
+	for id, addr := range members {
+		for i := 0; i < srv.cluster.cfg.VirtualNodes; i++ {
+			ring = append(ring, ringPoint{hash: ringHash(id.String() + "#" + strconv.Itoa(i)), member: id})
+		}
+		if srv.h != nil && id != srv.h.ID() {
+			_, transport, _ := splitServerAddr(addr)
+			srv.h.Peerstore().AddAddr(id, transport, peerstore.PermanentAddrTTL)
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash || (ring[i].hash == ring[j].hash && ring[i].member < ring[j].member)
+	})
+	srv.cluster.mu.Lock()
+	srv.cluster.members = members
+	srv.cluster.ring = ring
+	srv.cluster.addrs = append([]ma.Multiaddr(nil), addrs...)
+	srv.cluster.mu.Unlock()
+	select {
+	case srv.cluster.rebalance <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// ClusterMembers returns addresses of the cluster members.
+func (srv *Server) ClusterMembers() []ma.Multiaddr {
+	if srv.cluster == nil {
+		return nil
+	}
+	srv.cluster.mu.RLock()
+	defer srv.cluster.mu.RUnlock()
+	return append([]ma.Multiaddr(nil), srv.cluster.addrs...)
+}
+
+// startCluster builds the hash ring and starts rebalancing loop.
+func (srv *Server) startCluster() error {
+	if srv.cluster == nil {
+		return nil
+	}
+	if err := srv.SetClusterMembers(srv.cluster.cfg.Members); err != nil {
+		return err
+	}
+	srv.wg.Add(1)
+	go srv.rebalanceLoop()
+	return nil
+}
+
+// foreignOwner returns member that owns the topic and its address if it is not this server.
+func (srv *Server) foreignOwner(topic string) (peer.ID, ma.Multiaddr, bool) {
+	if srv.cluster == nil {
+		return "", nil, false
+	}
+	owner, addr := srv.cluster.owner(topic)
+	if len(owner) == 0 || owner == srv.h.ID() {
+		return "", nil, false
+	}
+	return owner, addr, true
+}
+
+// route decides where the request for the topic is served. It returns true if request was
+// forwarded to the owner and its response is stored in resp, and redirect error if client should
+// ask the owner. Proxied requests are always served locally, so that they don't loop while members
+// disagree on membership.
+func (srv *Server) route(from requester, codec *protocol.Codec, typ protocol.MessageType, msg interface{}, topic string, resp interface{}) (bool, *protocol.Error) {
+	if from.proxied {
+		return false, nil
+	}
+	owner, addr, foreign := srv.foreignOwner(topic)
+	if !foreign {
+		return false, nil
+	}
+	if !srv.cluster.cfg.Proxy {
+		return false, protocol.NewRedirect(addr)
+	}
+	if err := srv.proxy(owner, from, codec, typ, msg, resp); err != nil {
+		logger.Debug("failed to proxy request", "owner", owner, "error", err)
+		return false, protocol.NewError(protocol.E_INTERNAL_ERROR, "owner of the topic is unreachable")
+	}
+	return true, nil
+}
+
+// proxy sends request to the owner on behalf of the client and decodes its response. Owner checks
+// bans, tokens and policies against the client.
+func (srv *Server) proxy(owner peer.ID, from requester, codec *protocol.Codec, typ protocol.MessageType, msg, resp interface{}) error {
+	request, err := rlp.EncodeToBytes(msg)
+	if err != nil {
+		return err
+	}
+	proxied := protocol.ProxiedRequest{Peer: []byte(from.peer), Version: codec.ID, Type: typ, Request: request}
+	if from.addr != nil {
+		proxied.Addr = from.addr.Bytes()
+	}
+	ctx, cancel := srv.quitContext(srv.writeTimeout + srv.readTimeout)
+	defer cancel()
+	s, err := srv.federationStream(ctx, owner)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	s.SetWriteDeadline(time.Now().Add(srv.writeTimeout))
+	if err := rlp.Encode(s, protocol.FEDERATION_PROXY); err != nil {
+		s.Reset()
+		return err
+	}
+	if err := rlp.Encode(s, proxied); err != nil {
+		s.Reset()
+		return err
+	}
+	s.SetReadDeadline(time.Now().Add(srv.readTimeout))
+	rs := rlp.NewStream(s, 0)
+	resptype, err := rs.Uint()
+	if err != nil {
+		s.Reset()
+		return err
+	}
+	if protocol.MessageType(resptype) != responseType(typ) {
+		s.Reset()
+		return fmt.Errorf("unexpected response type %d", resptype)
+	}
+	return rs.Decode(resp)
+}
+
+// serveProxied serves request forwarded by the cluster member. Only requests that are routed
+// by topic are accepted.
+func (srv *Server) serveProxied(req protocol.ProxiedRequest) (protocol.MessageType, interface{}, error) {
+	codec := protocol.CodecFor(req.Version)
+	if codec == nil {
+		return 0, nil, fmt.Errorf("unsupported version %s", req.Version)
+	}
+	typed, known := codec.NewRequest(req.Type)
+	if !known || (req.Type != protocol.REGISTER && req.Type != protocol.DISCOVER) {
+		return 0, nil, fmt.Errorf("request type %d can't be proxied", req.Type)
+	}
+	id, err := peer.IDFromBytes(req.Peer)
+	if err != nil {
+		return 0, nil, err
+	}
+	from := requester{peer: id, proxied: true}
+	if len(req.Addr) != 0 {
+		if from.addr, err = ma.NewMultiaddrBytes(req.Addr); err != nil {
+			return 0, nil, err
+		}
+	}
+	// client connected to the member, so connection gater didn't see it
+	if srv.bans.bannedPeer(from.peer) || (from.addr != nil && srv.bans.bannedAddr(from.addr)) {
+		banned := protocol.NewError(protocol.E_NOT_AUTHORIZED, "banned")
+		switch typed.(type) {
+		case *protocol.Register:
+			return protocol.REGISTER_RESPONSE, protocol.RegisterResponse{Status: banned.Status, Message: banned.Message}, nil
+		case *protocol.DiscoverV2:
+			return protocol.DISCOVER_RESPONSE, protocol.DiscoverResponseV2{Status: banned.Status, Message: banned.Message}, nil
+		default:
+			return protocol.DISCOVER_RESPONSE, protocol.DiscoverResponse{Status: banned.Status, Message: banned.Message}, nil
+		}
+	}
+	return srv.parseRequest(from, codec, req.Type, rlp.NewStream(bytes.NewReader(req.Request), 0))
+}
+
+// responseType returns response type of the proxied request type.
+func responseType(typ protocol.MessageType) protocol.MessageType {
+	if typ == protocol.REGISTER {
+		return protocol.REGISTER_RESPONSE
+	}
+	return protocol.DISCOVER_RESPONSE
+}
+
+// rebalanceLoop hands off records after every membership change and every rebalance interval.
+func (srv *Server) rebalanceLoop() {
+	defer srv.wg.Done()
+	for {
+		select {
+		case <-srv.cluster.rebalance:
+		case <-time.After(srv.cluster.cfg.RebalanceInterval):
+		case <-srv.quit:
+			return
+		}
+		srv.rebalance()
+	}
+}
+
+// rebalance sends records of topics owned by other members to the owners with the federation
+// protocol and removes them once owner applied them. Records are kept if owner is unreachable
+// or refuses them.
+func (srv *Server) rebalance() {
+	for _, stat := range srv.topics.list("", math.MaxUint32, func(string) bool { return false }) {
+		owner, _ := srv.cluster.owner(stat.Topic)
+		if len(owner) == 0 || owner == srv.h.ID() {
+			continue
+		}
+		keys, stored, err := srv.storage.GetAll(stat.Topic)
+		if err != nil {
+			logger.Error("failed to read records for handoff", "topic", stat.Topic, "error", err)
+			continue
+		}
+		update := protocol.FederationUpdate{}
+		for i := range stored {
+			update.Records = append(update.Records, protocol.FederatedRecord{
+				Topic:      stat.Topic,
+				Record:     stored[i].ENR,
+				Deadline:   unixNano(stored[i].Time),
+				Registered: unixNano(stored[i].Registered),
+				Envelope:   stored[i].Envelope,
+			})
+		}
+		rejected, err := srv.sendUpdate(owner, update)
+		if err != nil {
+			logger.Warn("failed to hand off topic", "topic", stat.Topic, "owner", owner, "error", err)
+			continue
+		}
+		for i, key := range keys {
+			if rejected[i] {
+				continue
+			}
+			if err := srv.unstore(key.String()); err != nil {
+				logger.Error("failed to remove handed off record", "topic", stat.Topic, "error", err)
+			}
+		}
+		logger.Info("topic handed off", "topic", stat.Topic, "owner", owner, "records", len(keys)-len(rejected), "rejected", len(rejected))
+	}
+}
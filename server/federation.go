@@ -0,0 +1,664 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+	ethv4 "github.com/status-im/go-multiaddr-ethv4"
+	"github.com/status-im/rendezvous/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const (
+	// federationQueue is the number of pending pushes, pushes over it are left for the sync.
+	federationQueue = 1024
+	// maxFederationBatch is the maximal number of entries in a single pushed update.
+	maxFederationBatch = 256
+	// maxSyncRecords is the maximal number of records in response to a sync request, the rest
+	// is sent in the next sync.
+	maxSyncRecords = 4096
+)
+
+// FederationConfig configures replication of registrations between servers.
+type FederationConfig struct {
+	// Peers are addresses of federated servers with their identity, as returned by Server.Addr.
+	Peers []ma.Multiaddr
+	// SyncInterval is how often topic digests are compared with every peer.
+	SyncInterval time.Duration
+	// MaxHops is how many servers a registration travels through from the server where it was
+	// made. One is enough if every server lists all others as peers.
+	MaxHops uint
+}
+
+// DefaultFederationConfig is a config without peers.
+var DefaultFederationConfig = FederationConfig{
+	SyncInterval: time.Minute,
+	MaxHops:      2,
+}
+
+// WithFederation replicates registrations with the peers. New registrations and removals are
+// pushed right away, missed ones are found by periodic sync of topic digests.
+func WithFederation(cfg FederationConfig) ServerOption {
+	return func(srv *Server) {
+		if cfg.MaxHops == 0 {
+			cfg.MaxHops = 1
+		}
+		if cfg.SyncInterval == 0 {
+			cfg.SyncInterval = DefaultFederationConfig.SyncInterval
+		}
+		srv.federation = &federation{
+			cfg:        cfg,
+			queue:      make(chan federationItem, federationQueue),
+			tombstones: map[string]tombstone{},
+		}
+	}
+}
+
+type federation struct {
+	cfg   FederationConfig
+	peers []peer.ID
+	queue chan federationItem
+
+	mu sync.Mutex
+	// tombstones are removed registrations, so that sync doesn't bring them back.
+	tombstones map[string]tombstone
+}
+
+// federationItem is a registration or removal waiting to be pushed.
+type federationItem struct {
+	key     string
+	expired *protocol.FederatedExpiration
+	hops    uint
+	// from is the peer that sent the entry, it isn't pushed back.
+	from peer.ID
+}
+
+type tombstone struct {
+	seq      uint64
+	deadline time.Time
+}
+
+// covers returns true if registration with the seq and deadline was removed.
+func (t tombstone) covers(seq uint64, deadline time.Time) bool {
+	return seq < t.seq || (seq == t.seq && !deadline.After(t.deadline))
+}
+
+// newer returns true if the record replaces the stored one: it has higher sequence number,
+// or the same one and later deadline.
+func newer(seq uint64, deadline time.Time, stored StorageRecord) bool {
+	return seq > stored.ENR.Seq() || (seq == stored.ENR.Seq() && deadline.After(stored.Time))
+}
+
+// startFederation resolves peers and starts push and sync loops.
+func (srv *Server) startFederation() {
+	if srv.federation == nil {
+		return
+	}
+	for _, addr := range srv.federation.cfg.Peers {
+		id, transport, err := splitServerAddr(addr)
+		if err != nil {
+			logger.Error("invalid federation peer", "address", addr, "error", err)
+			continue
+		}
+		srv.h.Peerstore().AddAddr(id, transport, peerstore.PermanentAddrTTL)
+		srv.federation.peers = append(srv.federation.peers, id)
+	}
+	srv.wg.Add(2)
+	go srv.pushLoop()
+	go srv.syncLoop()
+}
+
+// splitServerAddr returns peer ID and transport address of the server multiaddr.
+func splitServerAddr(addr ma.Multiaddr) (peer.ID, ma.Multiaddr, error) {
+	pid, err := addr.ValueForProtocol(ethv4.P_ETHv4)
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := peer.Decode(pid)
+	if err != nil {
+		return "", nil, err
+	}
+	return id, addr.Decapsulate(ma.StringCast("/ethv4/" + pid)), nil
+}
+
+// federationPeer returns true if the peer is a federated server or a cluster member, which hands
+// off records with the federation protocol.
+func (srv *Server) federationPeer(id peer.ID) bool {
+	if srv.cluster != nil && srv.cluster.member(id) {
+		return true
+	}
+	if srv.federation == nil {
+		return false
+	}
+	for _, p := range srv.federation.peers {
+		if p == id {
+			return true
+		}
+	}
+	return false
+}
+
+// pushRegistration schedules push of the stored registration.
+func (srv *Server) pushRegistration(key string) {
+	if srv.federation == nil {
+		return
+	}
+	srv.enqueue(federationItem{key: key, hops: srv.federation.cfg.MaxHops - 1})
+}
+
+// pushExpiration buries removed registration and schedules push of the removal.
+func (srv *Server) pushExpiration(key string, stored StorageRecord) {
+	if srv.federation == nil {
+		return
+	}
+	srv.bury(key, stored.ENR.Seq(), stored.Time)
+	srv.enqueue(federationItem{key: key, hops: srv.federation.cfg.MaxHops - 1, expired: &protocol.FederatedExpiration{
+		Topic:    string(TopicPart([]byte(key))),
+		Node:     NodeAddrPart([]byte(key)),
+		Seq:      stored.ENR.Seq(),
+		Deadline: unixNano(stored.Time),
+	}})
+}
+
+func (srv *Server) enqueue(item federationItem) {
+	if srv.federation == nil {
+		return
+	}
+	select {
+	case srv.federation.queue <- item:
+	default:
+		logger.Debug("federation queue is full, entry is left for sync", "topic", string(TopicPart([]byte(item.key))))
+	}
+}
+
+func (srv *Server) bury(key string, seq uint64, deadline time.Time) {
+	if srv.federation == nil {
+		return
+	}
+	srv.federation.mu.Lock()
+	defer srv.federation.mu.Unlock()
+	if t, exist := srv.federation.tombstones[key]; !exist || !t.covers(seq, deadline) {
+		srv.federation.tombstones[key] = tombstone{seq: seq, deadline: deadline}
+	}
+}
+
+func (srv *Server) buried(key string, seq uint64, deadline time.Time) bool {
+	if srv.federation == nil {
+		return false
+	}
+	srv.federation.mu.Lock()
+	defer srv.federation.mu.Unlock()
+	t, exist := srv.federation.tombstones[key]
+	return exist && t.covers(seq, deadline)
+}
+
+// purgeTombstones forgets removals of registrations that expired anyway.
+func (srv *Server) purgeTombstones() {
+	if srv.federation == nil {
+		return
+	}
+	now := time.Now()
+	srv.federation.mu.Lock()
+	defer srv.federation.mu.Unlock()
+	for key, t := range srv.federation.tombstones {
+		if t.deadline.Before(now) {
+			delete(srv.federation.tombstones, key)
+		}
+	}
+}
+
+// quitContext returns context that is cancelled on timeout or once server is stopped.
+func (srv *Server) quitContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	go func() {
+		select {
+		case <-srv.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// pushLoop sends queued entries in batches to every peer except the one they came from.
+func (srv *Server) pushLoop() {
+	defer srv.wg.Done()
+	for {
+		var batch []federationItem
+		select {
+		case item := <-srv.federation.queue:
+			batch = append(batch, item)
+		case <-srv.quit:
+			return
+		}
+	collect:
+		for len(batch) < maxFederationBatch {
+			select {
+			case item := <-srv.federation.queue:
+				batch = append(batch, item)
+			default:
+				break collect
+			}
+		}
+		srv.push(batch)
+	}
+}
+
+func (srv *Server) push(batch []federationItem) {
+	updates := map[peer.ID]*protocol.FederationUpdate{}
+	for _, item := range batch {
+		var (
+			record  *protocol.FederatedRecord
+			expired *protocol.FederatedExpiration
+		)
+		if item.expired != nil {
+			e := *item.expired
+			e.Hops = item.hops
+			expired = &e
+		} else {
+			stored, err := srv.storage.Get(item.key)
+			if err != nil {
+				// removed in the meantime, removal is pushed separately
+				continue
+			}
+			record = &protocol.FederatedRecord{
+				Topic:      string(TopicPart([]byte(item.key))),
+				Record:     stored.ENR,
+				Deadline:   unixNano(stored.Time),
+				Registered: unixNano(stored.Registered),
+				Hops:       item.hops,
+				Envelope:   stored.Envelope,
+			}
+		}
+		for _, id := range srv.federation.peers {
+			if id == item.from {
+				continue
+			}
+			update, exist := updates[id]
+			if !exist {
+				update = &protocol.FederationUpdate{}
+				updates[id] = update
+			}
+			if record != nil {
+				update.Records = append(update.Records, *record)
+			} else {
+				update.Expirations = append(update.Expirations, *expired)
+			}
+		}
+	}
+	for id, update := range updates {
+		if _, err := srv.sendUpdate(id, *update); err != nil {
+			logger.Debug("failed to push federation update", "peer", id, "error", err)
+		}
+	}
+}
+
+// sendUpdate sends update to the peer and waits until it is applied. It returns indexes of
+// records that were refused by the peer.
+func (srv *Server) sendUpdate(id peer.ID, update protocol.FederationUpdate) (map[int]bool, error) {
+	ctx, cancel := srv.quitContext(srv.writeTimeout + srv.readTimeout)
+	defer cancel()
+	s, err := srv.federationStream(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	s.SetWriteDeadline(time.Now().Add(srv.writeTimeout))
+	if err := rlp.Encode(s, protocol.FEDERATION_UPDATE); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	if err := rlp.Encode(s, update); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	s.SetReadDeadline(time.Now().Add(srv.readTimeout))
+	rs := rlp.NewStream(s, 0)
+	typ, err := rs.Uint()
+	if err != nil {
+		s.Reset()
+		return nil, err
+	}
+	if protocol.MessageType(typ) != protocol.FEDERATION_ACK {
+		s.Reset()
+		return nil, fmt.Errorf("unexpected response type %d", typ)
+	}
+	var ack protocol.FederationAck
+	if err := rs.Decode(&ack); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	rejected := make(map[int]bool, len(ack.Rejected))
+	for _, i := range ack.Rejected {
+		rejected[int(i)] = true
+	}
+	return rejected, nil
+}
+
+// federationStream opens stream to the peer. Dial backoff is ignored, peers are known to be
+// servers and they are retried on the push and sync schedule.
+func (srv *Server) federationStream(ctx context.Context, id peer.ID) (network.Stream, error) {
+	return srv.h.NewStream(network.WithForceDirectDial(ctx, "federation"), id, protocol.FederationVersion)
+}
+
+// syncLoop syncs with every peer right away and then every sync interval.
+func (srv *Server) syncLoop() {
+	defer srv.wg.Done()
+	for {
+		for _, id := range srv.federation.peers {
+			if err := srv.sync(id); err != nil {
+				logger.Debug("federation sync failed", "peer", id, "error", err)
+			}
+		}
+		select {
+		case <-time.After(srv.federation.cfg.SyncInterval):
+		case <-srv.quit:
+			return
+		}
+	}
+}
+
+// sync sends digests of local topics and applies registrations returned by the peer.
+func (srv *Server) sync(id peer.ID) error {
+	digests, err := srv.digests()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := srv.quitContext(srv.writeTimeout + srv.readTimeout)
+	defer cancel()
+	s, err := srv.federationStream(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	s.SetWriteDeadline(time.Now().Add(srv.writeTimeout))
+	if err := rlp.Encode(s, protocol.FEDERATION_SYNC); err != nil {
+		s.Reset()
+		return err
+	}
+	if err := rlp.Encode(s, protocol.FederationSync{Topics: digests}); err != nil {
+		s.Reset()
+		return err
+	}
+	s.SetReadDeadline(time.Now().Add(srv.readTimeout))
+	rs := rlp.NewStream(s, 0)
+	typ, err := rs.Uint()
+	if err != nil {
+		s.Reset()
+		return err
+	}
+	if protocol.MessageType(typ) != protocol.FEDERATION_UPDATE {
+		s.Reset()
+		return fmt.Errorf("unexpected response type %d", typ)
+	}
+	var update protocol.FederationUpdate
+	if err := rs.Decode(&update); err != nil {
+		s.Reset()
+		return err
+	}
+	srv.applyUpdate(id, update)
+	return nil
+}
+
+// federationHandler serves a single message of a federated peer.
+func (srv *Server) federationHandler(s network.Stream) {
+	if !srv.trackStream(s) {
+		s.Reset()
+		return
+	}
+	defer srv.untrackStream(s)
+	srv.setIdle(s, false)
+	from := s.Conn().RemotePeer()
+	if !srv.federationPeer(from) {
+		logger.Debug("federation stream from unknown peer", "peer", from)
+		s.Reset()
+		return
+	}
+	defer s.Close()
+	s.SetReadDeadline(time.Now().Add(srv.readTimeout))
+	rs := rlp.NewStream(s, 0)
+	typ, err := rs.Uint()
+	if err != nil {
+		s.Reset()
+		return
+	}
+	switch protocol.MessageType(typ) {
+	case protocol.FEDERATION_UPDATE:
+		var update protocol.FederationUpdate
+		if err := rs.Decode(&update); err != nil {
+			logger.Debug("invalid federation update", "peer", from, "error", err)
+			s.Reset()
+			return
+		}
+		ack := protocol.FederationAck{Rejected: srv.applyUpdate(from, update)}
+		s.SetWriteDeadline(time.Now().Add(srv.writeTimeout))
+		if err := rlp.Encode(s, protocol.FEDERATION_ACK); err != nil {
+			s.Reset()
+			return
+		}
+		if err := rlp.Encode(s, ack); err != nil {
+			s.Reset()
+		}
+	case protocol.FEDERATION_PROXY:
+		if srv.cluster == nil || !srv.cluster.member(from) {
+			s.Reset()
+			return
+		}
+		var req protocol.ProxiedRequest
+		if err := rs.Decode(&req); err != nil {
+			logger.Debug("invalid proxied request", "peer", from, "error", err)
+			s.Reset()
+			return
+		}
+		resptype, resp, err := srv.serveProxied(req)
+		if err != nil {
+			logger.Debug("failed to serve proxied request", "peer", from, "error", err)
+			s.Reset()
+			return
+		}
+		s.SetWriteDeadline(time.Now().Add(srv.writeTimeout))
+		if err := rlp.Encode(s, resptype); err != nil {
+			s.Reset()
+			return
+		}
+		if err := rlp.Encode(s, resp); err != nil {
+			s.Reset()
+		}
+	case protocol.FEDERATION_SYNC:
+		var msg protocol.FederationSync
+		if err := rs.Decode(&msg); err != nil {
+			logger.Debug("invalid federation sync", "peer", from, "error", err)
+			s.Reset()
+			return
+		}
+		update, err := srv.syncResponse(msg)
+		if err != nil {
+			logger.Error("failed to prepare federation sync response", "error", err)
+			s.Reset()
+			return
+		}
+		s.SetWriteDeadline(time.Now().Add(srv.writeTimeout))
+		if err := rlp.Encode(s, protocol.FEDERATION_UPDATE); err != nil {
+			s.Reset()
+			return
+		}
+		if err := rlp.Encode(s, update); err != nil {
+			s.Reset()
+		}
+	default:
+		s.Reset()
+	}
+}
+
+// applyUpdate stores newer registrations and removes expired ones. Entries that changed the
+// storage are forwarded while they have hops left. It returns indexes of rejected records.
+func (srv *Server) applyUpdate(from peer.ID, update protocol.FederationUpdate) (rejected []uint) {
+	for i, rec := range update.Records {
+		key, changed, err := srv.storeReplica(rec)
+		if err != nil {
+			logger.Debug("federated record rejected", "peer", from, "topic", rec.Topic, "error", err)
+			rejected = append(rejected, uint(i))
+			continue
+		}
+		if changed && rec.Hops > 0 {
+			srv.enqueue(federationItem{key: key, hops: rec.Hops - 1, from: from})
+		}
+	}
+	for _, e := range update.Expirations {
+		key, changed, err := srv.expireReplica(e)
+		if err != nil {
+			logger.Debug("federated expiration failed", "peer", from, "topic", e.Topic, "error", err)
+			continue
+		}
+		if changed && e.Hops > 0 {
+			expired := e
+			srv.enqueue(federationItem{key: key, hops: e.Hops - 1, from: from, expired: &expired})
+		}
+	}
+	return rejected
+}
+
+// storeReplica stores replicated record with its original deadline if it is newer than the
+// stored one. Record is checked against bans and policies as a registration of unknown peer,
+// so that peers can't exceed limits the server enforces on its own clients. It returns true
+// if storage was changed.
+func (srv *Server) storeReplica(rec protocol.FederatedRecord) (string, bool, error) {
+	if reason := validateTopic(rec.Topic, true); len(reason) != 0 {
+		return "", false, errors.New(reason)
+	}
+	if err := protocol.VerifyRecord(&rec.Record, rec.Envelope); err != nil {
+		return "", false, err
+	}
+	now := time.Now()
+	deadline := fromUnixNano(rec.Deadline)
+	if !deadline.After(now) {
+		return "", false, nil
+	}
+	// origin adds network delay to the deadline, another one allows for clock skew
+	if deadline.After(now.Add(replicaTTL(&rec.Record) + 2*srv.networkDelay)) {
+		return "", false, errors.New("deadline is too far")
+	}
+	defer srv.registerLocks.lock(rec.Topic)()
+	// registering peer was checked by the origin server
+	if perr := srv.checkRegister(RegisterRequest{Topic: rec.Topic, Record: rec.Record, TTL: deadline.Sub(now)}); perr != nil {
+		return "", false, perr
+	}
+	key := NewRecordsKey(rec.Topic, rec.Record).String()
+	if srv.buried(key, rec.Record.Seq(), deadline) {
+		return key, false, nil
+	}
+	stored, err := srv.storage.Get(key)
+	if err == nil && !newer(rec.Record.Seq(), deadline, stored) {
+		return key, false, nil
+	} else if err != nil && !errors.Is(err, leveldb.ErrNotFound) {
+		return key, false, err
+	}
+	if err := srv.storage.Put(key, StorageRecord{ENR: rec.Record, Time: deadline, Registered: fromUnixNano(rec.Registered), Envelope: rec.Envelope}); err != nil {
+		return key, false, err
+	}
+	if !srv.cleaner.Exist(key) {
+		srv.addActive(rec.Topic)
+	}
+	srv.cleaner.Add(deadline, key)
+	return key, true, nil
+}
+
+// replicaTTL returns the longest TTL of the protocol the record was registered with. Signed peer
+// records may come from the libp2p rendezvous protocol, which allows longer registrations.
+func replicaTTL(record *enr.Record) time.Duration {
+	if scheme := record.IdentityScheme(); scheme == protocol.PeerRecordID || scheme == protocol.DetachedPeerRecordID {
+		return specLongestTTL
+	}
+	return longestTTL
+}
+
+// expireReplica removes registration unless stored one is newer than the expired one.
+// It returns true if storage was changed.
+func (srv *Server) expireReplica(e protocol.FederatedExpiration) (string, bool, error) {
+	key := NewRecordsKeyForAddr(e.Topic, e.Node).String()
+	deadline := fromUnixNano(e.Deadline)
+	srv.bury(key, e.Seq, deadline)
+	stored, err := srv.storage.Get(key)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return key, false, nil
+	} else if err != nil {
+		return key, false, err
+	}
+	if !(tombstone{seq: e.Seq, deadline: deadline}).covers(stored.ENR.Seq(), stored.Time) {
+		return key, false, nil
+	}
+	return key, true, srv.unstore(key)
+}
+
+// digests returns digests of all topics with active registrations.
+func (srv *Server) digests() ([]protocol.TopicDigest, error) {
+	stats := srv.topics.list("", math.MaxUint32, func(string) bool { return false })
+	rst := make([]protocol.TopicDigest, 0, len(stats))
+	for _, stat := range stats {
+		keys, stored, err := srv.storage.GetAll(stat.Topic)
+		if err != nil {
+			return nil, err
+		}
+		rst = append(rst, protocol.TopicDigest{Topic: stat.Topic, Digest: topicDigest(keys, stored)})
+	}
+	return rst, nil
+}
+
+// topicDigest hashes node addresses, sequence numbers and deadlines of registrations sorted by key.
+func topicDigest(keys []RecordsKey, stored []StorageRecord) []byte {
+	h := sha256.New()
+	buf := make([]byte, 8)
+	for i := range keys {
+		h.Write(NodeAddrPart(keys[i]))
+		binary.BigEndian.PutUint64(buf, stored[i].ENR.Seq())
+		h.Write(buf)
+		binary.BigEndian.PutUint64(buf, unixNano(stored[i].Time))
+		h.Write(buf)
+	}
+	return h.Sum(nil)
+}
+
+// syncResponse returns registrations of local topics whose digests differ from the peer's ones.
+// Returned entries are not forwarded, the peer syncs with its own peers.
+func (srv *Server) syncResponse(msg protocol.FederationSync) (protocol.FederationUpdate, error) {
+	theirs := make(map[string][]byte, len(msg.Topics))
+	for _, d := range msg.Topics {
+		theirs[d.Topic] = d.Digest
+	}
+	update := protocol.FederationUpdate{}
+	for _, stat := range srv.topics.list("", math.MaxUint32, func(string) bool { return false }) {
+		keys, stored, err := srv.storage.GetAll(stat.Topic)
+		if err != nil {
+			return update, err
+		}
+		if bytes.Equal(theirs[stat.Topic], topicDigest(keys, stored)) {
+			continue
+		}
+		for i := range stored {
+			if len(update.Records) == maxSyncRecords {
+				return update, nil
+			}
+			update.Records = append(update.Records, protocol.FederatedRecord{
+				Topic:      stat.Topic,
+				Record:     stored[i].ENR,
+				Deadline:   unixNano(stored[i].Time),
+				Registered: unixNano(stored[i].Registered),
+				Envelope:   stored[i].Envelope,
+			})
+		}
+	}
+	return update, nil
+}
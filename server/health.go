@@ -0,0 +1,54 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// cleanerStallPeriods is the number of cleaner periods without purge after which server
+// is reported as not healthy.
+const cleanerStallPeriods = 5
+
+// Healthy returns error if the cleaner goroutine didn't purge records for several cleaner periods.
+func (srv *Server) Healthy() error {
+	last := atomic.LoadInt64(&srv.lastPurge)
+	if last == 0 {
+		return nil
+	}
+	if since := time.Since(time.Unix(0, last)); since > cleanerStallPeriods*srv.cleanerPeriod {
+		return fmt.Errorf("cleaner didn't run for %v", since.Truncate(time.Millisecond))
+	}
+	return nil
+}
+
+// Ready returns nil once Start rebuilt the cleaner state and the host is listening, as long as
+// storage is readable and server is healthy.
+func (srv *Server) Ready() error {
+	if atomic.LoadInt32(&srv.ready) == 0 {
+		return errors.New("server is not started")
+	}
+	if len(srv.h.Network().ListenAddresses()) == 0 {
+		return errors.New("host is not listening")
+	}
+	if err := srv.storage.Probe(); err != nil {
+		return fmt.Errorf("storage probe failed: %w", err)
+	}
+	return srv.Healthy()
+}
+
+// HealthHandler responds with 200 if check passes and with 503 and the error otherwise.
+// Use with Healthy for liveness and with Ready for readiness probes.
+func HealthHandler(check func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := check(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
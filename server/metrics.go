@@ -14,6 +14,9 @@ type MetricsInterface interface {
 	ObserveDiscoverSize(float64, ...string)
 	ObserveDiscoveryDuration(float64, ...string)
 	CountError(...string)
+	CountPenalty(...string)
+	ObservePeerScore(float64)
+	SetPenalizedPeers(float64)
 }
 
 type noopMetrics struct{}
@@ -27,3 +30,9 @@ func (n noopMetrics) ObserveDiscoverSize(o float64, lvs ...string) {}
 func (n noopMetrics) ObserveDiscoveryDuration(o float64, lvs ...string) {}
 
 func (n noopMetrics) CountError(lvs ...string) {}
+
+func (n noopMetrics) CountPenalty(lvs ...string) {}
+
+func (n noopMetrics) ObservePeerScore(o float64) {}
+
+func (n noopMetrics) SetPenalizedPeers(o float64) {}
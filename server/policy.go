@@ -0,0 +1,152 @@
+package server
+
+import (
+	"errors"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/status-im/rendezvous/protocol"
+)
+
+// Policy decides which registrations and discovery requests are allowed. It is consulted
+// after NamespacePolicy hooks, errors are handled the same way.
+type Policy interface {
+	AllowRegister(req RegisterRequest) error
+	AllowDiscover(req DiscoverRequest) error
+}
+
+// RegisterRequest is a registration checked by Policy.
+type RegisterRequest struct {
+	Topic  string
+	Record enr.Record
+	TTL    time.Duration
+	// Peer is the libp2p peer that sent the request, empty if unknown, e.g. for records
+	// replicated from federated servers.
+	Peer peer.ID
+	// Active is the number of active registrations under the topic.
+	Active int
+	// Renewal is true if the record is already registered under the topic.
+	Renewal bool
+}
+
+// DiscoverRequest is a discovery request checked by Policy.
+type DiscoverRequest struct {
+	// Topic is a topic or a wildcard pattern, see protocol.Subtopics.
+	Topic string
+	Limit uint
+	// Peer is the libp2p peer that sent the request, empty if unknown.
+	Peer peer.ID
+}
+
+// WithPolicy makes server consult policy for every registration and discovery request.
+func WithPolicy(policy Policy) ServerOption {
+	return func(srv *Server) {
+		srv.policy = policy
+	}
+}
+
+// NamespacePolicy is consulted for requests to topics of the namespace. Nil hooks allow every
+// request. Hooks may return *protocol.Error to pick the response status, other errors are
+// reported as E_NOT_AUTHORIZED.
+type NamespacePolicy struct {
+	// Register is called before record is stored.
+	Register func(topic string, record enr.Record, ttl time.Duration) error
+	// Discover is called before records are read. Topic is a wildcard pattern if client asked
+	// for subtopics, see protocol.Subtopics.
+	Discover func(topic string, limit uint) error
+}
+
+// WithNamespacePolicy applies policy to the namespace and all topics under it. If several
+// namespaces match a topic, policy of the most specific one is used.
+func WithNamespacePolicy(namespace string, policy NamespacePolicy) ServerOption {
+	return func(srv *Server) {
+		if srv.policies == nil {
+			srv.policies = map[string]NamespacePolicy{}
+		}
+		srv.policies[strings.TrimSuffix(namespace, protocol.TopicSeparator)] = policy
+	}
+}
+
+// policyFor returns policy of the most specific namespace of the topic.
+func (srv *Server) policyFor(topic string) (NamespacePolicy, bool) {
+	for _, ns := range protocol.Namespaces(topic) {
+		if policy, exist := srv.policies[ns]; exist {
+			return policy, true
+		}
+	}
+	return NamespacePolicy{}, false
+}
+
+// topicLocks serialize registrations under the same topic, so that policy limits that depend
+// on the number of active registrations are checked and stored atomically.
+type topicLocks [64]sync.Mutex
+
+// lock locks the topic and returns function that unlocks it.
+func (l *topicLocks) lock(topic string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(topic))
+	mu := &l[h.Sum32()%uint32(len(l))]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// checkRegister must be called with the topic locked until record is stored.
+func (srv *Server) checkRegister(req RegisterRequest) *protocol.Error {
+	if err := srv.checkBanned(req); err != nil {
+		return err
+	}
+	if err := srv.checkRelayAddr(&req.Record, req.Peer); err != nil {
+		return err
+	}
+	if policy, exist := srv.policyFor(req.Topic); exist && policy.Register != nil {
+		if err := policyError(policy.Register(req.Topic, req.Record, req.TTL)); err != nil {
+			return err
+		}
+	}
+	if srv.policy == nil {
+		return nil
+	}
+	req.Active = srv.topics.count(req.Topic)
+	req.Renewal = srv.cleaner.Exist(NewRecordsKey(req.Topic, req.Record).String())
+	return policyError(srv.policy.AllowRegister(req))
+}
+
+// checkDiscover consults policy of the topic. Wildcard pattern is checked against policies
+// of the namespace and of every namespace under it, so that subtopics with stricter
+// policies can't be discovered with a wildcard.
+func (srv *Server) checkDiscover(req DiscoverRequest, namespace string, wildcard bool) *protocol.Error {
+	if policy, exist := srv.policyFor(namespace); exist && policy.Discover != nil {
+		if err := policyError(policy.Discover(req.Topic, req.Limit)); err != nil {
+			return err
+		}
+	}
+	if wildcard {
+		for ns, policy := range srv.policies {
+			if ns == namespace || !protocol.InNamespace(ns, namespace) || policy.Discover == nil {
+				continue
+			}
+			if err := policyError(policy.Discover(req.Topic, req.Limit)); err != nil {
+				return err
+			}
+		}
+	}
+	if srv.policy == nil {
+		return nil
+	}
+	return policyError(srv.policy.AllowDiscover(req))
+}
+
+func policyError(err error) *protocol.Error {
+	if err == nil {
+		return nil
+	}
+	var perr *protocol.Error
+	if errors.As(err, &perr) {
+		return perr
+	}
+	return protocol.NewError(protocol.E_NOT_AUTHORIZED, err.Error())
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/status-im/rendezvous/protocol"
+)
+
+// WithPrivateTopic makes REGISTER and DISCOVER of the topic and all topics under it require
+// a token signed by the owner key, see protocol.NewToken.
+func WithPrivateTopic(topic string, owner *ecdsa.PublicKey) ServerOption {
+	return func(srv *Server) {
+		if srv.private == nil {
+			srv.private = map[string]*ecdsa.PublicKey{}
+		}
+		srv.private[strings.TrimSuffix(topic, protocol.TopicSeparator)] = owner
+	}
+}
+
+// privateOwner returns owner key of the most specific private namespace of the topic.
+func (srv *Server) privateOwner(topic string) (*ecdsa.PublicKey, bool) {
+	for _, ns := range protocol.Namespaces(topic) {
+		if owner, exist := srv.private[ns]; exist {
+			return owner, true
+		}
+	}
+	return nil, false
+}
+
+// checkToken verifies token if topic is private. Holder is node address of the registered
+// record or of the discovering peer. Wildcard pattern can't be used to discover private
+// topics under its namespace, they must be discovered one by one.
+func (srv *Server) checkToken(topic string, token []byte, holder []byte) *protocol.Error {
+	if len(srv.private) == 0 {
+		return nil
+	}
+	namespace, wildcard, err := protocol.ParseWildcard(topic)
+	if err != nil {
+		// rejected with the reason later
+		return nil
+	}
+	if !wildcard {
+		namespace = topic
+	}
+	if wildcard {
+		for ns := range srv.private {
+			if ns != namespace && protocol.InNamespace(ns, namespace) {
+				return protocol.NewError(protocol.E_NOT_AUTHORIZED, "wildcard covers private topics")
+			}
+		}
+	}
+	owner, private := srv.privateOwner(namespace)
+	if !private {
+		return nil
+	}
+	if len(token) == 0 {
+		return protocol.NewError(protocol.E_NOT_AUTHORIZED, "topic is private, token is required")
+	}
+	t, err := protocol.DecodeToken(token)
+	if err != nil {
+		return protocol.NewError(protocol.E_NOT_AUTHORIZED, "malformed token")
+	}
+	if err := t.Verify(owner, namespace, holder, time.Now()); err != nil {
+		return protocol.NewError(protocol.E_NOT_AUTHORIZED, err.Error())
+	}
+	return nil
+}
+
+// peerNodeAddr returns node address of the peer, nil if it can't be derived from the peer ID.
+func peerNodeAddr(id peer.ID) []byte {
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return nil
+	}
+	return protocol.PeerNodeAddr(pub)
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	"github.com/status-im/rendezvous/protocol"
+)
+
+// DefaultRelayResources are strict limits of the circuit relay. Relayed connections are meant
+// for hole punching and small exchanges between peers, not for bulk traffic.
+var DefaultRelayResources = relay.Resources{
+	Limit: &relay.RelayLimit{
+		Duration: 2 * time.Minute,
+		Data:     1 << 17,
+	},
+	ReservationTTL:         30 * time.Minute,
+	MaxReservations:        128,
+	MaxCircuits:            4,
+	BufferSize:             2048,
+	MaxReservationsPerPeer: 1,
+	MaxReservationsPerIP:   4,
+	MaxReservationsPerASN:  32,
+}
+
+// WithRelay makes the server a circuit relay v2 with the resource limits, e.g. DefaultRelayResources.
+// Peers behind NAT reserve a slot and register relayed address under their topics.
+func WithRelay(resources relay.Resources) ServerOption {
+	return func(srv *Server) {
+		srv.relayResources = &resources
+	}
+}
+
+// startRelay starts relay service on the host if it is enabled.
+func (srv *Server) startRelay() error {
+	if srv.relayResources == nil {
+		return nil
+	}
+	r, err := relay.New(srv.h, relay.WithResources(*srv.relayResources))
+	if err != nil {
+		return err
+	}
+	srv.relay = r
+	return nil
+}
+
+// checkRelayAddr rejects records with malformed relay address, or with relay address that goes
+// through a relay other than this server or its federated servers and cluster members. Relayed
+// peer must be the registering one if it is known.
+func (srv *Server) checkRelayAddr(record *enr.Record, remote peer.ID) *protocol.Error {
+	addr, err := protocol.RelayAddr(record)
+	if enr.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return protocol.NewError(protocol.E_INVALID_ENR, "invalid relay address: "+err.Error())
+	}
+	relay, node, err := protocol.RelayPeers(addr)
+	if err != nil {
+		return protocol.NewError(protocol.E_INVALID_ENR, "invalid relay address: "+err.Error())
+	}
+	if !srv.relayPeer(relay) {
+		return protocol.NewError(protocol.E_INVALID_ENR, "relay address must go through the server")
+	}
+	if len(remote) != 0 && node != remote {
+		return protocol.NewError(protocol.E_INVALID_ENR, "relay address must point to the registering peer")
+	}
+	return nil
+}
+
+// relayPeer returns true if the relay is this server with relay enabled or a trusted server.
+func (srv *Server) relayPeer(id peer.ID) bool {
+	if srv.h != nil && id == srv.h.ID() {
+		return srv.relay != nil
+	}
+	return srv.federationPeer(id)
+}
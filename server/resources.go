@@ -0,0 +1,137 @@
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	libp2pprotocol "github.com/libp2p/go-libp2p/core/protocol"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
+	"github.com/status-im/rendezvous/protocol"
+	"github.com/status-im/rendezvous/protocol/pb"
+)
+
+// ResourceLimits limits resources used by peers. Limits of streams and memory apply to each
+// rendezvous protocol separately, zero values keep libp2p defaults scaled to the machine.
+type ResourceLimits struct {
+	// StreamsPerPeer limits inbound streams of a single peer.
+	StreamsPerPeer int
+	// Streams limits inbound streams of all peers.
+	Streams int
+	// MemoryPerPeer and Memory limit memory in bytes reserved by streams of a single peer and of all peers.
+	MemoryPerPeer int64
+	Memory        int64
+	// Once there are more than HighWater connections, connection manager closes the least
+	// useful ones until LowWater remain. Connection manager is disabled if HighWater is zero.
+	LowWater  int
+	HighWater int
+	// GracePeriod protects new connections from being closed by connection manager.
+	GracePeriod time.Duration
+	// IdleTimeout closes streams that don't send the next request in time. Read timeout is used if zero.
+	IdleTimeout time.Duration
+}
+
+// DefaultResourceLimits are used unless WithResourceLimits is given.
+var DefaultResourceLimits = ResourceLimits{
+	StreamsPerPeer: 8,
+	Streams:        1024,
+	MemoryPerPeer:  1 << 20,
+	Memory:         64 << 20,
+	LowWater:       400,
+	HighWater:      600,
+	GracePeriod:    time.Minute,
+	IdleTimeout:    10 * time.Second,
+}
+
+// WithResourceLimits replaces DefaultResourceLimits.
+func WithResourceLimits(limits ResourceLimits) ServerOption {
+	return func(srv *Server) {
+		srv.limits = limits
+	}
+}
+
+// protocols returns IDs of all protocols served by the server.
+func protocols() []libp2pprotocol.ID {
+	ids := []libp2pprotocol.ID{pb.PROTOCOL}
+	for _, codec := range protocol.Codecs {
+		ids = append(ids, libp2pprotocol.ID(codec.ID))
+	}
+	return ids
+}
+
+// resourceOptions creates resource manager with the limits and connection manager.
+// Resource manager usage is reported to metrics registered with rcmgr.MustRegisterWith,
+// peers whose streams are blocked by the limits are penalized with PenaltyRateLimit.
+func (srv *Server) resourceOptions() ([]libp2p.Option, error) {
+	partial := rcmgr.PartialLimitConfig{
+		Protocol:     map[libp2pprotocol.ID]rcmgr.ResourceLimits{},
+		ProtocolPeer: map[libp2pprotocol.ID]rcmgr.ResourceLimits{},
+	}
+	for _, id := range protocols() {
+		partial.Protocol[id] = rcmgr.ResourceLimits{
+			StreamsInbound: rcmgr.LimitVal(srv.limits.Streams),
+			Memory:         rcmgr.LimitVal64(srv.limits.Memory),
+		}
+		partial.ProtocolPeer[id] = rcmgr.ResourceLimits{
+			StreamsInbound: rcmgr.LimitVal(srv.limits.StreamsPerPeer),
+			Memory:         rcmgr.LimitVal64(srv.limits.MemoryPerPeer),
+		}
+	}
+	reporter, err := rcmgr.NewStatsTraceReporter()
+	if err != nil {
+		return nil, err
+	}
+	rm, err := rcmgr.NewResourceManager(
+		rcmgr.NewFixedLimiter(partial.Build(rcmgr.DefaultLimits.AutoScale())),
+		rcmgr.WithTraceReporter(reporter),
+		rcmgr.WithTraceReporter(blockedStreams{srv}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	opts := []libp2p.Option{libp2p.ResourceManager(rm)}
+	if srv.limits.HighWater != 0 {
+		cm, err := connmgr.NewConnManager(srv.limits.LowWater, srv.limits.HighWater, connmgr.WithGracePeriod(srv.limits.GracePeriod))
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, libp2p.ConnectionManager(cm))
+	}
+	return opts, nil
+}
+
+// blockedStreams penalizes peers that open more streams than allowed by the per-peer limits.
+type blockedStreams struct {
+	srv *Server
+}
+
+func (b blockedStreams) ConsumeEvent(evt rcmgr.TraceEvt) {
+	if evt.Type != rcmgr.TraceBlockAddStreamEvt || evt.DeltaIn == 0 {
+		return
+	}
+	// only limits of protocol-peer scopes, named "protocol:<id>.peer:<peer>", are set by the server
+	if !strings.HasPrefix(evt.Name, "protocol:") {
+		return
+	}
+	idx := strings.LastIndex(evt.Name, ".peer:")
+	if idx < 0 {
+		return
+	}
+	id, err := peer.Decode(evt.Name[idx+len(".peer:"):])
+	if err != nil {
+		return
+	}
+	// events are consumed with resource manager locked, a ban closes connections of the peer
+	// and releases their resources
+	go b.srv.Penalize(id, PenaltyRateLimit)
+}
+
+// idleTimeout is how long stream may wait for the next request.
+func (srv *Server) idleTimeout() time.Duration {
+	if srv.limits.IdleTimeout != 0 {
+		return srv.limits.IdleTimeout
+	}
+	return srv.readTimeout
+}
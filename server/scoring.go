@@ -0,0 +1,183 @@
+package server
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Penalty is a kind of peer misbehavior.
+type Penalty string
+
+const (
+	PenaltyInvalidContent   Penalty = "invalid_content"
+	PenaltyInvalidSignature Penalty = "invalid_signature"
+	PenaltyUnknownType      Penalty = "unknown_type"
+	// PenaltyRateLimit is reported when inbound streams of the peer exceed
+	// ResourceLimits.StreamsPerPeer, and can be reported by other rate limiters with Server.Penalize.
+	PenaltyRateLimit Penalty = "rate_limit"
+)
+
+// ScoreConfig controls peer scoring. Every peer starts with zero score, penalties lower it
+// and score decays back to zero over time. Peer is banned for BanDuration once its score drops
+// to Threshold or below.
+type ScoreConfig struct {
+	Penalties   map[Penalty]float64
+	Threshold   float64
+	BanDuration time.Duration
+	// HalfLife is how long it takes for the score to decay to the half of its value.
+	HalfLife time.Duration
+}
+
+// DefaultScoreConfig bans a peer after 10 malformed requests sent in a short period.
+var DefaultScoreConfig = ScoreConfig{
+	Penalties: map[Penalty]float64{
+		PenaltyInvalidContent:   10,
+		PenaltyInvalidSignature: 20,
+		PenaltyUnknownType:      10,
+		PenaltyRateLimit:        5,
+	},
+	Threshold:   -100,
+	BanDuration: 10 * time.Minute,
+	HalfLife:    10 * time.Minute,
+}
+
+// WithScoring replaces DefaultScoreConfig.
+func WithScoring(cfg ScoreConfig) ServerOption {
+	return func(srv *Server) {
+		srv.scores = newScores(cfg)
+	}
+}
+
+// DisableScoring makes server ignore misbehavior of peers.
+func DisableScoring() ServerOption {
+	return func(srv *Server) {
+		srv.scores = nil
+	}
+}
+
+// minScore is the score below which decayed peer is forgotten.
+const minScore = 0.1
+
+type peerScore struct {
+	value   float64
+	updated time.Time
+}
+
+func (s *peerScore) decay(now time.Time, halfLife time.Duration) {
+	if halfLife > 0 {
+		s.value *= math.Pow(0.5, float64(now.Sub(s.updated))/float64(halfLife))
+	}
+	s.updated = now
+}
+
+type scores struct {
+	cfg ScoreConfig
+
+	mu    sync.Mutex
+	peers map[peer.ID]*peerScore
+}
+
+func newScores(cfg ScoreConfig) *scores {
+	return &scores{cfg: cfg, peers: map[peer.ID]*peerScore{}}
+}
+
+// penalize lowers score of the peer and returns true if it dropped below the threshold.
+// Score of the peer is reset then.
+func (s *scores) penalize(id peer.ID, penalty Penalty, now time.Time) (float64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	score, exist := s.peers[id]
+	if !exist {
+		score = &peerScore{updated: now}
+		s.peers[id] = score
+	}
+	score.decay(now, s.cfg.HalfLife)
+	score.value -= s.cfg.Penalties[penalty]
+	if score.value <= s.cfg.Threshold {
+		delete(s.peers, id)
+		return score.value, true
+	}
+	return score.value, false
+}
+
+// decay updates all scores and returns peers that are forgotten.
+func (s *scores) decay(now time.Time) (forgotten []peer.ID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, score := range s.peers {
+		score.decay(now, s.cfg.HalfLife)
+		if math.Abs(score.value) < minScore {
+			delete(s.peers, id)
+			forgotten = append(forgotten, id)
+		}
+	}
+	return forgotten
+}
+
+func (s *scores) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.peers)
+}
+
+func (s *scores) list(now time.Time) map[peer.ID]float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rst := make(map[peer.ID]float64, len(s.peers))
+	for id, score := range s.peers {
+		score.decay(now, s.cfg.HalfLife)
+		rst[id] = score.value
+	}
+	return rst
+}
+
+// Penalize lowers score of the peer and bans it temporarily if score drops below the threshold.
+// It does nothing if scoring is disabled or peer is unknown.
+func (srv *Server) Penalize(id peer.ID, penalty Penalty) {
+	if srv.scores == nil || len(id) == 0 {
+		return
+	}
+	metrics.CountPenalty(string(penalty))
+	score, ban := srv.scores.penalize(id, penalty, time.Now())
+	metrics.ObservePeerScore(score)
+	metrics.SetPenalizedPeers(float64(srv.scores.len()))
+	if !ban {
+		return
+	}
+	logger.Info("peer misbehaves", "peer", id, "score", score, "penalty", penalty)
+	if err := srv.Ban(Ban{
+		Kind:   BanPeer,
+		Target: id.String(),
+		Reason: "misbehavior score dropped to " + formatScore(score),
+		Expiry: time.Now().Add(srv.scores.cfg.BanDuration),
+	}); err != nil {
+		logger.Error("failed to ban misbehaving peer", "peer", id, "error", err)
+	}
+}
+
+// Scores returns current scores of peers that misbehaved recently.
+func (srv *Server) Scores() map[peer.ID]float64 {
+	if srv.scores == nil {
+		return nil
+	}
+	return srv.scores.list(time.Now())
+}
+
+// decayScores forgets peers whose score decayed close to zero and updates the number of
+// penalized peers. Scores of individual peers are not exported as metrics, they are available
+// with Server.Scores and admin API.
+func (srv *Server) decayScores() {
+	if srv.scores == nil {
+		return
+	}
+	srv.scores.decay(time.Now())
+	metrics.SetPenalizedPeers(float64(srv.scores.len()))
+}
+
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'f', 1, 64)
+}
@@ -1,27 +1,42 @@
 package server
 
 import (
-	"bytes"
+	"context"
+	"crypto/ecdsa"
 	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/log"
-	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	libp2pprotocol "github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	quic "github.com/libp2p/go-libp2p/p2p/transport/quic"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	"github.com/libp2p/go-libp2p/p2p/transport/websocket"
 	"github.com/multiformats/go-multiaddr"
 	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
 	"github.com/status-im/rendezvous/protocol"
+	"github.com/status-im/rendezvous/protocol/pb"
 )
 
 var logger = log.New("package", "rendezvous/server")
 
+// Version is reported to clients in response to INFO request. It can be set at build time
+// with -ldflags "-X github.com/status-im/rendezvous/server.Version=...".
+var Version = "dev"
+
 const (
 	longestTTL          = 20 * time.Second
 	networkDelay        = 500 * time.Millisecond
@@ -30,26 +45,80 @@ const (
 	maxTopicLength      = 50
 )
 
-// NewServer creates instance of the server.
-func NewServer(laddr ma.Multiaddr, identity crypto.PrivKey, s Storage) *Server {
+// ServerOption configures Server.
+type ServerOption func(*Server)
+
+// DisableTopics makes server reject TOPICS requests with E_NOT_AUTHORIZED, so that
+// the list of topics isn't exposed to clients.
+func DisableTopics() ServerOption {
+	return func(srv *Server) {
+		srv.topicsDisabled = true
+	}
+}
+
+// WithListenAddrs adds listen addresses. TCP, QUIC (/udp/.../quic-v1) and WebSocket (/tcp/.../ws)
+// addresses over IPv4 or IPv6 are supported.
+func WithListenAddrs(addrs ...ma.Multiaddr) ServerOption {
+	return func(srv *Server) {
+		srv.laddrs = append(srv.laddrs, addrs...)
+	}
+}
+
+// WithAnnounceAddrs makes server advertise addresses instead of the listen ones, e.g. public
+// addresses of the NAT or load balancer in front of it.
+func WithAnnounceAddrs(addrs ...ma.Multiaddr) ServerOption {
+	return func(srv *Server) {
+		srv.announce = append(srv.announce, addrs...)
+	}
+}
+
+// WithNATPortMap makes server map listen ports on the NAT device with UPnP or NAT-PMP.
+// Mapped addresses are advertised once they are discovered.
+func WithNATPortMap() ServerOption {
+	return func(srv *Server) {
+		srv.natPortMap = true
+	}
+}
+
+// NewServer creates instance of the server. Laddr may be nil if listen addresses are set
+// with WithListenAddrs.
+func NewServer(laddr ma.Multiaddr, identity crypto.PrivKey, s Storage, opts ...ServerOption) *Server {
 	srv := Server{
-		laddr:         laddr,
 		identity:      identity,
 		storage:       s,
 		cleaner:       NewCleaner(),
+		topics:        newTopicCounter(),
+		bans:          newBanlist(),
+		scores:        newScores(DefaultScoreConfig),
+		limits:        DefaultResourceLimits,
 		writeTimeout:  10 * time.Second,
 		readTimeout:   10 * time.Second,
 		cleanerPeriod: cleanerPeriod,
 		networkDelay:  networkDelay,
 	}
+	if laddr != nil {
+		srv.laddrs = []ma.Multiaddr{laddr}
+	}
+	for _, opt := range opts {
+		opt(&srv)
+	}
 	return &srv
 }
 
 // Server provides rendezbous service over libp2p stream.
 type Server struct {
-	laddr    ma.Multiaddr
+	laddrs   []ma.Multiaddr
 	identity crypto.PrivKey
 
+	announce   []ma.Multiaddr
+	natPortMap bool
+	limits     ResourceLimits
+
+	relayResources *relay.Resources
+	relay          *relay.Relay
+	federation     *federation
+	cluster        *cluster
+
 	writeTimeout time.Duration
 	readTimeout  time.Duration
 
@@ -58,40 +127,125 @@ type Server struct {
 	cleanerPeriod time.Duration
 	networkDelay  time.Duration
 
-	h    host.Host
-	addr ma.Multiaddr
+	topics         *topicCounter
+	topicsDisabled bool
+	policies       map[string]NamespacePolicy
+	policy         Policy
+	registerLocks  topicLocks
+	private        map[string]*ecdsa.PublicKey
+	bans           *banlist
+	scores         *scores
+
+	h  host.Host
+	id ma.Multiaddr
+	// stoppedAddrs are addresses of the stopped server, so that clients can still refer to it.
+	stoppedAddrs []ma.Multiaddr
+	started      time.Time
+	// ready is set to 1 when Start is finished.
+	ready int32
+	// lastPurge is unix time in nanoseconds of the last cleaner run.
+	lastPurge int64
 
+	// wg tracks the cleaner and stream handlers.
 	wg   sync.WaitGroup
 	quit chan struct{}
+
+	streamsMu sync.Mutex
+	closing   bool
+	// streams are served streams, true if stream waits for the next request.
+	streams map[network.Stream]bool
 }
 
-// Addr returns full server multiaddr (identity included).
+// Addr returns full server multiaddr (identity included) of the best advertised address.
 func (srv *Server) Addr() ma.Multiaddr {
-	return srv.addr
+	addrs := srv.Addrs()
+	if len(addrs) == 0 {
+		return nil
+	}
+	return addrs[0]
+}
+
+// Addrs returns full server multiaddrs (identity included) of all advertised addresses.
+// Announced addresses are returned if they are configured. Otherwise, listen addresses
+// are returned with unspecified IPs expanded to interface addresses, together with addresses
+// mapped on the NAT. Public addresses go first, loopback addresses go last.
+func (srv *Server) Addrs() []ma.Multiaddr {
+	srv.streamsMu.Lock()
+	stopped := srv.stoppedAddrs
+	srv.streamsMu.Unlock()
+	if stopped != nil || srv.h == nil {
+		return stopped
+	}
+	addrs := append([]ma.Multiaddr{}, srv.h.Addrs()...)
+	sort.SliceStable(addrs, func(i, j int) bool {
+		if ri, rj := addrRank(addrs[i]), addrRank(addrs[j]); ri != rj {
+			return ri < rj
+		}
+		return addrs[i].String() < addrs[j].String()
+	})
+	rst := make([]ma.Multiaddr, len(addrs))
+	for i := range addrs {
+		rst[i] = addrs[i].Encapsulate(srv.id)
+	}
+	return rst
+}
+
+func addrRank(addr ma.Multiaddr) int {
+	switch {
+	case manet.IsPublicAddr(addr):
+		return 0
+	case manet.IsIPLoopback(addr):
+		return 2
+	default:
+		return 1
+	}
+}
+
+// advertised replaces addresses of the host with announced ones.
+func (srv *Server) advertised(addrs []ma.Multiaddr) []ma.Multiaddr {
+	if len(srv.announce) != 0 {
+		return srv.announce
+	}
+	return addrs
 }
 
 // Start creates listener.
 func (srv *Server) Start() error {
+	srv.started = time.Now()
+	if err := srv.loadBans(); err != nil {
+		return err
+	}
 	if err := srv.startListener(); err != nil {
 		return err
 	}
 	if err := srv.startCleaner(); err != nil {
 		return err
 	}
+	if err := srv.storage.IndexRegistered(); err != nil {
+		return err
+	}
 	// once server is restarted all cleaner info is lost. so we need to rebuild it
-	return srv.storage.IterateAllKeys(func(key RecordsKey, ttl time.Time) error {
+	err := srv.storage.IterateAllKeys(func(key RecordsKey, ttl time.Time) error {
 		if !srv.cleaner.Exist(key.String()) {
-			topic := TopicPart(key)
-			log.Debug("active registration with", "topic", string(topic))
-			metrics.AddActiveRegistration(string(topic))
+			srv.addActive(string(TopicPart(key)))
 		}
 		srv.cleaner.Add(ttl, key.String())
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	srv.startFederation()
+	if err := srv.startCluster(); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&srv.ready, 1)
+	return nil
 }
 
 func (srv *Server) startCleaner() error {
 	srv.quit = make(chan struct{})
+	atomic.StoreInt64(&srv.lastPurge, time.Now().UnixNano())
 	srv.wg.Add(1)
 	go func() {
 		for {
@@ -109,19 +263,86 @@ func (srv *Server) startCleaner() error {
 
 func (srv *Server) startListener() error {
 	opts := []libp2p.Option{
-		libp2p.ListenAddrStrings(srv.laddr.String()),
+		libp2p.ListenAddrs(srv.laddrs...),
 		libp2p.Identity(srv.identity),
+		libp2p.ConnectionGater(srv.bans),
+	}
+	transportOpts, err := transports(srv.laddrs)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, transportOpts...)
+	opts = append(opts, libp2p.AddrsFactory(srv.advertised))
+	resources, err := srv.resourceOptions()
+	if err != nil {
+		return err
+	}
+	opts = append(opts, resources...)
+	if srv.natPortMap {
+		opts = append(opts, libp2p.NATPortMap())
 	}
 	h, err := libp2p.New(opts...)
 	if err != nil {
 		return err
 	}
 	srv.h = h
-	srv.h.SetStreamHandler(protocol.VERSION, func(s network.Stream) {
+	for _, codec := range protocol.Codecs {
+		srv.h.SetStreamHandler(libp2pprotocol.ID(codec.ID), srv.streamHandler(codec))
+	}
+	srv.h.SetStreamHandler(pb.PROTOCOL, srv.specStreamHandler)
+	if srv.federation != nil || srv.cluster != nil {
+		srv.h.SetStreamHandler(protocol.FederationVersion, srv.federationHandler)
+	}
+	if err := srv.startRelay(); err != nil {
+		return err
+	}
+	addr, err := ma.NewMultiaddr(fmt.Sprintf("/ethv4/%s", h.ID()))
+	if err != nil {
+		return err
+	}
+	srv.id = addr
+	logger.Info("server started", "addresses", srv.Addrs())
+	return nil
+}
+
+// transports enables TCP and transports used by listen addresses. TCP is always enabled
+// so that ws addresses can be served. Listen addresses over other transports are refused,
+// otherwise libp2p would silently skip them.
+func transports(laddrs []ma.Multiaddr) ([]libp2p.Option, error) {
+	opts := []libp2p.Option{libp2p.Transport(tcp.NewTCPTransport)}
+	var quicEnabled, wsEnabled bool
+	for _, laddr := range laddrs {
+		if _, err := laddr.ValueForProtocol(ma.P_QUIC_V1); err == nil {
+			if !quicEnabled {
+				quicEnabled = true
+				opts = append(opts, libp2p.Transport(quic.NewTransport))
+			}
+			continue
+		}
+		if _, err := laddr.ValueForProtocol(ma.P_TCP); err != nil {
+			return nil, fmt.Errorf("unsupported listen address %s, only tcp, ws and quic-v1 are supported", laddr)
+		}
+		if _, err := laddr.ValueForProtocol(ma.P_WS); err == nil && !wsEnabled {
+			wsEnabled = true
+			opts = append(opts, libp2p.Transport(websocket.New))
+		}
+	}
+	return opts, nil
+}
+
+// streamHandler serves requests of the protocol version. Stream is used for several requests
+// until it is closed by the client.
+func (srv *Server) streamHandler(codec *protocol.Codec) network.StreamHandler {
+	return func(s network.Stream) {
+		if !srv.trackStream(s) {
+			s.Reset()
+			return
+		}
+		defer srv.untrackStream(s)
 		defer s.Close()
-		for {
+		for srv.setIdle(s, true) {
 			rs := rlp.NewStream(s, 0)
-			s.SetReadDeadline(time.Now().Add(srv.readTimeout))
+			s.SetReadDeadline(time.Now().Add(srv.idleTimeout()))
 			typ, err := rs.Uint()
 			if err == io.EOF {
 				return
@@ -131,8 +352,9 @@ func (srv *Server) startListener() error {
 				s.Reset()
 				return
 			}
+			srv.setIdle(s, false)
 			s.SetReadDeadline(time.Now().Add(srv.readTimeout))
-			resptype, resp, err := srv.msgParser(s, protocol.MessageType(typ), rs)
+			resptype, resp, err := srv.msgParser(s, codec, protocol.MessageType(typ), rs)
 			if err == io.EOF {
 				return
 			}
@@ -153,44 +375,46 @@ func (srv *Server) startListener() error {
 				s.Reset()
 			}
 		}
-	})
-	addr, err := ma.NewMultiaddr(fmt.Sprintf("/ethv4/%s", h.ID()))
-	if err != nil {
-		return err
 	}
-	srv.addr = srv.laddr.Encapsulate(addr)
-	logger.Info("server started", "address", srv.laddr.Encapsulate(addr))
-	return nil
 }
 
-// Stop closes listener and waits till all helper goroutines are stopped.
+// Stop closes listener and waits till all helper goroutines and stream handlers are stopped.
 func (srv *Server) Stop() {
-	if srv.quit == nil {
-		return
-	}
-	select {
-	case <-srv.quit:
-		return
-	default:
-	}
-	close(srv.quit)
-	srv.wg.Wait()
-	if srv.h != nil {
-		srv.h.Close()
-	}
+	srv.Shutdown(context.Background())
 }
 
 func (srv *Server) purgeOutdated() {
+	atomic.StoreInt64(&srv.lastPurge, time.Now().UnixNano())
 	keys := srv.cleaner.PopSince(time.Now())
 	log.Info("removed records from cleaner", "deadlines", len(srv.cleaner.deadlines), "heap", len(srv.cleaner.heap), "lth", len(keys))
 	for _, key := range keys {
 		topic := TopicPart([]byte(key))
 		log.Debug("Removing record with", "topic", string(topic))
-		metrics.RemoveActiveRegistration(string(topic))
+		srv.removeActive(string(topic))
 		if err := srv.storage.RemoveByKey(key); err != nil {
 			logger.Error("error removing key from storage", "key", key, "error", err)
 		}
 	}
+	srv.purgeBans()
+	srv.decayScores()
+	srv.purgeTombstones()
+}
+
+// requester is the client that sent the request. Requests proxied by cluster members carry
+// the client of the member.
+type requester struct {
+	peer peer.ID
+	addr ma.Multiaddr
+	// proxied requests are served locally even if topic is owned by other member.
+	proxied bool
+}
+
+// streamRequester returns the peer that opened the stream, empty if stream is not known.
+func streamRequester(s network.Stream) requester {
+	if s == nil {
+		return requester{}
+	}
+	return requester{peer: s.Conn().RemotePeer(), addr: s.Conn().RemoteMultiaddr()}
 }
 
 // Decoder is a decoder!
@@ -198,77 +422,352 @@ type Decoder interface {
 	Decode(val interface{}) error
 }
 
-func (srv *Server) msgParser(s network.Stream, typ protocol.MessageType, d Decoder) (resptype protocol.MessageType, resp interface{}, err error) {
-	switch typ {
-	case protocol.REGISTER:
-		var msg protocol.Register
+func (srv *Server) msgParser(s network.Stream, codec *protocol.Codec, typ protocol.MessageType, d Decoder) (resptype protocol.MessageType, resp interface{}, err error) {
+	return srv.parseRequest(streamRequester(s), codec, typ, d)
+}
+
+func (srv *Server) parseRequest(from requester, codec *protocol.Codec, typ protocol.MessageType, d Decoder) (resptype protocol.MessageType, resp interface{}, err error) {
+	req, known := codec.NewRequest(typ)
+	if !known {
+		metrics.CountError("unknown")
+		srv.Penalize(from.peer, PenaltyUnknownType)
+		// don't send the response
+		return 0, nil, errors.New("unknown request type")
+	}
+	switch msg := req.(type) {
+	case *protocol.Register:
 		resptype = protocol.REGISTER_RESPONSE
-		if err = d.Decode(&msg); err != nil {
+		if err = d.Decode(msg); err != nil {
 			metrics.CountError("register")
-			return resptype, protocol.RegisterResponse{Status: protocol.E_INVALID_CONTENT}, nil
+			srv.Penalize(from.peer, PenaltyInvalidContent)
+			return resptype, protocol.RegisterResponse{Status: protocol.E_INVALID_CONTENT, Message: "malformed register request"}, nil
+		}
+		if perr := srv.validateRegister(from.peer, codec, *msg); perr != nil {
+			return resptype, protocol.RegisterResponse{Status: perr.Status, Message: perr.Message}, nil
 		}
-		resp, err = srv.register(msg)
+		var proxied protocol.RegisterResponse
+		if routed, perr := srv.route(from, codec, typ, msg, msg.Topic, &proxied); perr != nil {
+			return resptype, protocol.RegisterResponse{Status: perr.Status, Message: perr.Message}, nil
+		} else if routed {
+			return resptype, proxied, nil
+		}
+		if perr := srv.checkToken(msg.Topic, msg.Token, protocol.ValidSchemes.NodeAddr(&msg.Record)); perr != nil {
+			return resptype, protocol.RegisterResponse{Status: perr.Status, Message: perr.Message}, nil
+		}
+		resp, err = srv.register(from.peer, *msg)
 		return resptype, resp, err
-	case protocol.DISCOVER:
-		var msg protocol.Discover
+	case *protocol.Discover:
 		resptype = protocol.DISCOVER_RESPONSE
-		if err = d.Decode(&msg); err != nil {
+		if err = d.Decode(msg); err != nil {
 			metrics.CountError("discover")
-			return resptype, protocol.DiscoverResponse{Status: protocol.E_INVALID_CONTENT}, nil
+			srv.Penalize(from.peer, PenaltyInvalidContent)
+			return resptype, protocol.DiscoverResponse{Status: protocol.E_INVALID_CONTENT, Message: "malformed discover request"}, nil
+		}
+		var proxied protocol.DiscoverResponse
+		if routed, perr := srv.route(from, codec, typ, msg, msg.Topic, &proxied); perr != nil {
+			return resptype, protocol.DiscoverResponse{Status: perr.Status, Message: perr.Message}, nil
+		} else if routed {
+			return resptype, proxied, nil
 		}
-		limit := msg.Limit
-		if msg.Limit > maxLimit {
-			limit = maxLimit
+		if perr := srv.checkToken(msg.Topic, msg.Token, peerNodeAddr(from.peer)); perr != nil {
+			return resptype, protocol.DiscoverResponse{Status: perr.Status, Message: perr.Message}, nil
+		}
+		stored, err := srv.discover(from.peer, msg.Topic, msg.Limit, codec == protocol.CodecV1)
+		var perr *protocol.Error
+		if errors.As(err, &perr) {
+			return resptype, protocol.DiscoverResponse{Status: perr.Status, Message: perr.Message}, nil
 		}
-		start := time.Now()
-		records, err := srv.storage.GetRandom(msg.Topic, limit)
 		if err != nil {
+			return resptype, protocol.DiscoverResponse{Status: protocol.E_INTERNAL_ERROR, Message: "failed to read records"}, err
+		}
+		return resptype, srv.discoverResponse(stored, msg.Extended), nil
+	case *protocol.DiscoverV2:
+		resptype = protocol.DISCOVER_RESPONSE
+		if err = d.Decode(msg); err != nil {
 			metrics.CountError("discover")
-			return resptype, protocol.DiscoverResponse{Status: protocol.E_INTERNAL_ERROR}, err
+			srv.Penalize(from.peer, PenaltyInvalidContent)
+			return resptype, protocol.DiscoverResponseV2{Status: protocol.E_INVALID_CONTENT, Message: "malformed discover request"}, nil
+		}
+		var proxied protocol.DiscoverResponseV2
+		if routed, perr := srv.route(from, codec, typ, msg, msg.Topic, &proxied); perr != nil {
+			return resptype, protocol.DiscoverResponseV2{Status: perr.Status, Message: perr.Message}, nil
+		} else if routed {
+			return resptype, proxied, nil
+		}
+		if perr := srv.checkToken(msg.Topic, msg.Token, peerNodeAddr(from.peer)); perr != nil {
+			return resptype, protocol.DiscoverResponseV2{Status: perr.Status, Message: perr.Message}, nil
+		}
+		stored, err := srv.discover(from.peer, msg.Topic, msg.Limit, false)
+		var perr *protocol.Error
+		if errors.As(err, &perr) {
+			return resptype, protocol.DiscoverResponseV2{Status: perr.Status, Message: perr.Message}, nil
 		}
-		metrics.ObserveDiscoveryDuration(time.Since(start).Seconds(), msg.Topic)
-		metrics.ObserveDiscoverSize(float64(len(records)), msg.Topic)
-		return resptype, protocol.DiscoverResponse{Status: protocol.OK, Records: records}, nil
-	case protocol.REMOTEIP:
-		resptype = protocol.REMOTEIP_RESPONSE
-		ip, err := s.Conn().RemoteMultiaddr().ValueForProtocol(multiaddr.P_IP4)
 		if err != nil {
+			return resptype, protocol.DiscoverResponseV2{Status: protocol.E_INTERNAL_ERROR, Message: "failed to read records"}, err
+		}
+		return resptype, srv.discoverResponseV2(stored), nil
+	case *protocol.RemoteIp:
+		resptype = protocol.REMOTEIP_RESPONSE
+		var ip string
+		if from.addr != nil {
+			ip, err = from.addr.ValueForProtocol(multiaddr.P_IP4)
+		}
+		if from.addr == nil || err != nil {
 			metrics.CountError("remoteip")
-			return resptype, protocol.RemoteIpResponse{Status: protocol.E_INTERNAL_ERROR}, err
+			return resptype, protocol.RemoteIpResponse{Status: protocol.E_INTERNAL_ERROR, Message: "remote address is not ip4"}, err
 		}
 		return resptype, protocol.RemoteIpResponse{Status: protocol.OK, IP: ip}, nil
+	case *protocol.Topics:
+		resptype = protocol.TOPICS_RESPONSE
+		if err = d.Decode(msg); err != nil {
+			metrics.CountError("topics")
+			srv.Penalize(from.peer, PenaltyInvalidContent)
+			return resptype, protocol.TopicsResponse{Status: protocol.E_INVALID_CONTENT, Message: "malformed topics request"}, nil
+		}
+		return resptype, srv.listTopics(*msg), nil
+	case *protocol.Info:
+		resptype = protocol.INFO_RESPONSE
+		if err = d.Decode(msg); err != nil {
+			metrics.CountError("info")
+			srv.Penalize(from.peer, PenaltyInvalidContent)
+			return resptype, protocol.InfoResponse{Status: protocol.E_INVALID_CONTENT, Message: "malformed info request"}, nil
+		}
+		return resptype, srv.info(codec), nil
 	default:
 		metrics.CountError("unknown")
-		// don't send the response
-		return 0, nil, errors.New("unknown request type")
+		srv.Penalize(from.peer, PenaltyUnknownType)
+		return 0, nil, fmt.Errorf("request %T is not handled", req)
 	}
 }
 
-func (srv *Server) register(msg protocol.Register) (protocol.RegisterResponse, error) {
-	if len(msg.Topic) == 0 || len(msg.Topic) > maxTopicLength {
-		return protocol.RegisterResponse{Status: protocol.E_INVALID_NAMESPACE}, nil
+// discover reads random records of the topic. If topic ends with a wildcard records are
+// sampled from all topics of the namespace. Invalid patterns of legacy clients are read as
+// topics, see validateTopic. Rejected requests return *protocol.Error.
+func (srv *Server) discover(remote peer.ID, topic string, limit uint, legacy bool) ([]StorageRecord, error) {
+	if limit > maxLimit {
+		limit = maxLimit
 	}
-	if time.Duration(msg.TTL) > longestTTL {
-		return protocol.RegisterResponse{Status: protocol.E_INVALID_TTL}, nil
+	namespace, wildcard, err := protocol.ParseWildcard(topic)
+	if err != nil && legacy {
+		wildcard, err = false, nil
+	}
+	if err != nil {
+		return nil, protocol.NewError(protocol.E_INVALID_NAMESPACE, err.Error())
 	}
-	if bytes.IndexByte([]byte(msg.Topic), TopicBodyDelimiter) != -1 {
-		return protocol.RegisterResponse{Status: protocol.E_INVALID_NAMESPACE}, nil
+	if !wildcard {
+		namespace = topic
 	}
+	if perr := srv.checkDiscover(DiscoverRequest{Topic: topic, Limit: limit, Peer: remote}, namespace, wildcard); perr != nil {
+		return nil, perr
+	}
+	start := time.Now()
+	var stored []StorageRecord
+	if wildcard {
+		stored, err = srv.storage.GetRandomRecordsUnder(namespace, limit)
+	} else {
+		stored, err = srv.storage.GetRandomRecords(topic, limit)
+	}
+	if err != nil {
+		metrics.CountError("discover")
+		return nil, err
+	}
+	metrics.ObserveDiscoveryDuration(time.Since(start).Seconds(), metricsTopic(topic))
+	metrics.ObserveDiscoverSize(float64(len(stored)), metricsTopic(topic))
+	return stored, nil
+}
+
+func (srv *Server) listTopics(msg protocol.Topics) protocol.TopicsResponse {
+	if srv.topicsDisabled {
+		return protocol.TopicsResponse{Status: protocol.E_NOT_AUTHORIZED, Message: "topics request is disabled"}
+	}
+	limit := msg.Limit
+	if limit == 0 || limit > maxTopics {
+		limit = maxTopics
+	}
+	// private topics are not exposed
+	hidden := func(topic string) bool {
+		_, private := srv.privateOwner(topic)
+		return private
+	}
+	return protocol.TopicsResponse{Status: protocol.OK, Topics: srv.topics.list(msg.Prefix, limit, hidden)}
+}
 
-	if err := msg.Record.VerifySignature(enode.ValidSchemes); err != nil {
+func (srv *Server) info(codec *protocol.Codec) protocol.InfoResponse {
+	resp := protocol.InfoResponse{
+		Status:         protocol.OK,
+		Version:        Version,
+		LongestTTL:     uint64(longestTTL),
+		MaxLimit:       maxLimit,
+		MaxTopicLength: maxTopicLength,
+		Requests:       codec.Requests(),
+		Features:       []string{protocol.FeatureLibp2pRendezvous},
+	}
+	if !srv.topicsDisabled {
+		resp.Features = append(resp.Features, protocol.FeatureTopics)
+	}
+	if srv.relayResources != nil {
+		resp.Features = append(resp.Features, protocol.FeatureRelay)
+	}
+	if !srv.started.IsZero() {
+		resp.Uptime = uint64(time.Since(srv.started) / time.Second)
+	}
+	return resp
+}
+
+// validateRegister checks the request itself before it is routed to the owner of the topic,
+// so that invalid signatures are scored where the client is connected.
+func (srv *Server) validateRegister(remote peer.ID, codec *protocol.Codec, msg protocol.Register) *protocol.Error {
+	if reason := validateTopic(msg.Topic, codec == protocol.CodecV1); len(reason) != 0 {
+		return protocol.NewError(protocol.E_INVALID_NAMESPACE, reason)
+	}
+	if time.Duration(msg.TTL) > longestTTL {
+		return protocol.NewError(protocol.E_INVALID_TTL, fmt.Sprintf("ttl %v is longer than %v", time.Duration(msg.TTL), longestTTL))
+	}
+	if err := msg.Record.VerifySignature(protocol.ValidSchemes); err != nil {
 		logger.Error("error verify signature message", "error", err)
-		return protocol.RegisterResponse{Status: protocol.E_INVALID_ENR}, nil
+		srv.Penalize(remote, PenaltyInvalidSignature)
+		return protocol.NewError(protocol.E_INVALID_ENR, "invalid enr signature: "+err.Error())
+	}
+	return nil
+}
+
+// register stores request that passed validateRegister.
+func (srv *Server) register(remote peer.ID, msg protocol.Register) (protocol.RegisterResponse, error) {
+	defer srv.registerLocks.lock(msg.Topic)()
+	req := RegisterRequest{Topic: msg.Topic, Record: msg.Record, TTL: time.Duration(msg.TTL), Peer: remote}
+	if perr := srv.checkRegister(req); perr != nil {
+		return protocol.RegisterResponse{Status: perr.Status, Message: perr.Message}, nil
 	}
-	deadline := time.Now().Add(time.Duration(msg.TTL)).Add(srv.networkDelay)
-	key, err := srv.storage.Add(msg.Topic, msg.Record, deadline)
+	if err := srv.store(msg.Topic, msg.Record, nil, time.Duration(msg.TTL)); err != nil {
+		return protocol.RegisterResponse{Status: protocol.E_INTERNAL_ERROR, Message: "failed to store record"}, err
+	}
+	return protocol.RegisterResponse{Status: protocol.OK}, nil
+}
+
+// validateTopic returns the reason why topic is invalid, empty string if topic is valid.
+// Allowed bytes don't include TopicBodyDelimiter, see protocol.ValidateTopic. Legacy topics,
+// registered over VERSION or already stored, are checked with protocol.ValidateLegacyTopic,
+// so that existing clients keep working.
+func validateTopic(topic string, legacy bool) string {
+	if len(topic) > maxTopicLength {
+		return fmt.Sprintf("topic is longer than %d bytes", maxTopicLength)
+	}
+	validate := protocol.ValidateTopic
+	if legacy {
+		validate = protocol.ValidateLegacyTopic
+	}
+	if err := validate(topic); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// store adds record to storage and schedules its removal after ttl. Envelope is nil unless
+// record is a detached peer record.
+func (srv *Server) store(topic string, record enr.Record, envelope []byte, ttl time.Duration) error {
+	deadline := time.Now().Add(ttl).Add(srv.networkDelay)
+	key, err := srv.storage.AddDetached(topic, record, envelope, deadline)
 	if err != nil {
-		return protocol.RegisterResponse{Status: protocol.E_INTERNAL_ERROR}, err
+		return err
 	}
 	if !srv.cleaner.Exist(key) {
-		log.Debug("active registration with", "topic", msg.Topic)
-		metrics.AddActiveRegistration(msg.Topic)
+		srv.addActive(topic)
 	}
-	log.Debug("updating record in the cleaner", "deadline", deadline, "topic", msg.Topic)
+	log.Debug("updating record in the cleaner", "deadline", deadline, "topic", topic)
 	srv.cleaner.Add(deadline, key)
-	return protocol.RegisterResponse{Status: protocol.OK}, nil
+	srv.pushRegistration(key)
+	return nil
+}
+
+// remove deletes registration before its deadline and pushes the removal to federated servers.
+func (srv *Server) remove(key string) error {
+	stored, err := srv.storage.Get(key)
+	if err != nil {
+		return srv.unstore(key)
+	}
+	if err := srv.unstore(key); err != nil {
+		return err
+	}
+	srv.pushExpiration(key, stored)
+	return nil
+}
+
+// unstore deletes registration from storage and cleaner.
+func (srv *Server) unstore(key string) error {
+	if !srv.cleaner.Remove(key) {
+		return nil
+	}
+	srv.removeActive(string(TopicPart([]byte(key))))
+	return srv.storage.RemoveByKey(key)
+}
+
+func (srv *Server) addActive(topic string) {
+	log.Debug("active registration with", "topic", topic)
+	metrics.AddActiveRegistration(metricsTopic(topic))
+	srv.topics.inc(topic)
+}
+
+func (srv *Server) removeActive(topic string) {
+	metrics.RemoveActiveRegistration(metricsTopic(topic))
+	srv.topics.dec(topic)
+}
+
+// metricsTopic returns label of the topic. Blinded topics are binary and would leak membership
+// if exposed one by one, so they share a single label.
+func metricsTopic(topic string) string {
+	if protocol.IsBlinded(topic) {
+		return "blinded"
+	}
+	return topic
+}
+
+// rlpRecords drops detached peer records, rlp clients can't verify them without envelopes.
+func rlpRecords(stored []StorageRecord) []StorageRecord {
+	rst := stored[:0:0]
+	for i := range stored {
+		if len(stored[i].Envelope) == 0 {
+			rst = append(rst, stored[i])
+		}
+	}
+	return rst
+}
+
+func (srv *Server) discoverResponse(stored []StorageRecord, extended bool) protocol.DiscoverResponse {
+	stored = rlpRecords(stored)
+	resp := protocol.DiscoverResponse{Status: protocol.OK, Records: make([]enr.Record, len(stored))}
+	if extended {
+		resp.TTLs = make([]uint64, len(stored))
+		resp.Registered = make([]uint64, len(stored))
+	}
+	now := time.Now()
+	for i := range stored {
+		resp.Records[i] = stored[i].ENR
+		if extended {
+			resp.TTLs[i], resp.Registered[i] = srv.recordDetails(stored[i], now)
+		}
+	}
+	return resp
+}
+
+func (srv *Server) discoverResponseV2(stored []StorageRecord) protocol.DiscoverResponseV2 {
+	stored = rlpRecords(stored)
+	resp := protocol.DiscoverResponseV2{Status: protocol.OK, Records: make([]protocol.DiscoveredRecord, len(stored))}
+	now := time.Now()
+	for i := range stored {
+		resp.Records[i].Record = stored[i].ENR
+		resp.Records[i].TTL, resp.Records[i].Registered = srv.recordDetails(stored[i], now)
+	}
+	return resp
+}
+
+// recordDetails returns remaining ttl in nanoseconds and unix time of the first registration.
+func (srv *Server) recordDetails(stored StorageRecord, now time.Time) (ttl, registered uint64) {
+	// deadline includes network delay that was added on top of the requested ttl
+	if remaining := stored.Time.Sub(now); remaining > srv.networkDelay {
+		ttl = uint64(remaining - srv.networkDelay)
+	}
+	if !stored.Registered.IsZero() {
+		registered = uint64(stored.Registered.Unix())
+	}
+	return ttl, registered
 }
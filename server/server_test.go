@@ -1,7 +1,9 @@
 package server
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"reflect"
 	"testing"
 	"time"
@@ -9,13 +11,26 @@ import (
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/rlp"
+	lcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/record"
+	ma "github.com/multiformats/go-multiaddr"
 	"github.com/status-im/rendezvous/protocol"
+	"github.com/status-im/rendezvous/protocol/pb"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/storage"
 )
 
+// newTestServer creates server with in-memory storage.
+func newTestServer(t *testing.T, opts ...ServerOption) *Server {
+	memdb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	require.NoError(t, err)
+	return NewServer(nil, nil, NewStorage(memdb), opts...)
+}
+
 func TestCleanOnRegister(t *testing.T) {
 	topic := "any"
 	type testCase struct {
@@ -44,7 +59,7 @@ func TestCleanOnRegister(t *testing.T) {
 				key, _ := crypto.GenerateKey()
 				var r enr.Record
 				require.NoError(t, enode.SignV4(&r, key))
-				resp, err := srv.register(protocol.Register{Record: r, Topic: topic, TTL: uint64(tc.ttl)})
+				resp, err := srv.register("", protocol.Register{Record: r, Topic: topic, TTL: uint64(tc.ttl)})
 				require.NoError(t, err)
 				require.Equal(t, protocol.OK, resp.Status)
 			}
@@ -140,10 +155,13 @@ func TestRegisterRPC(t *testing.T) {
 			memdb, _ := leveldb.Open(storage.NewMemStorage(), nil)
 			s := NewStorage(memdb)
 			srv := NewServer(nil, nil, s)
-			resptype, resp, err := srv.msgParser(nil, protocol.REGISTER, tc)
+			resptype, resp, err := srv.msgParser(nil, protocol.CodecV1, protocol.REGISTER, tc)
 			require.NoError(t, err)
 			assert.Equal(t, protocol.REGISTER_RESPONSE, resptype)
 			assert.Equal(t, tc.Status, resp.(protocol.RegisterResponse).Status)
+			if tc.Status != protocol.OK {
+				assert.NotEmpty(t, resp.(protocol.RegisterResponse).Message)
+			}
 		})
 	}
 }
@@ -205,12 +223,12 @@ func TestDiscoverRPC(t *testing.T) {
 				key, _ := crypto.GenerateKey()
 				var r enr.Record
 				require.NoError(t, enode.SignV4(&r, key))
-				resp, err := srv.register(protocol.Register{Record: r, Topic: topic})
+				resp, err := srv.register("", protocol.Register{Record: r, Topic: topic})
 				require.NoError(t, err)
 				require.Equal(t, protocol.OK, resp.Status)
 			}
 
-			resptype, resp, err := srv.msgParser(nil, protocol.DISCOVER, tc)
+			resptype, resp, err := srv.msgParser(nil, protocol.CodecV1, protocol.DISCOVER, tc)
 			require.NoError(t, err)
 			assert.Equal(t, protocol.DISCOVER_RESPONSE, resptype)
 			assert.Equal(t, tc.Status, resp.(protocol.DiscoverResponse).Status)
@@ -218,3 +236,450 @@ func TestDiscoverRPC(t *testing.T) {
 		})
 	}
 }
+
+func TestDiscoverExtended(t *testing.T) {
+	topic := "any"
+	srv := newTestServer(t)
+	_, r := newRecord(t)
+	resp, err := srv.register("", protocol.Register{Record: r, Topic: topic, TTL: uint64(10 * time.Second)})
+	require.NoError(t, err)
+	require.Equal(t, protocol.OK, resp.Status)
+
+	_, plain, err := srv.msgParser(nil, protocol.CodecV1, protocol.DISCOVER, discCase{Request: protocol.Discover{Topic: topic, Limit: 1}})
+	require.NoError(t, err)
+	require.Nil(t, plain.(protocol.DiscoverResponse).TTLs)
+
+	_, extended, err := srv.msgParser(nil, protocol.CodecV1, protocol.DISCOVER, discCase{Request: protocol.Discover{Topic: topic, Limit: 1, Extended: true}})
+	require.NoError(t, err)
+	ttls := extended.(protocol.DiscoverResponse).TTLs
+	require.Len(t, ttls, 1)
+	require.True(t, time.Duration(ttls[0]) <= 10*time.Second)
+	require.True(t, time.Duration(ttls[0]) > 9*time.Second)
+	registered := extended.(protocol.DiscoverResponse).Registered
+	require.Len(t, registered, 1)
+	require.InDelta(t, time.Now().Unix(), int64(registered[0]), 1)
+}
+
+func TestDiscoverV2(t *testing.T) {
+	topic := "any"
+	srv := newTestServer(t)
+	_, r := newRecord(t)
+	resp, err := srv.register("", protocol.Register{Record: r, Topic: topic, TTL: uint64(10 * time.Second)})
+	require.NoError(t, err)
+	require.Equal(t, protocol.OK, resp.Status)
+
+	data, err := rlp.EncodeToBytes(protocol.DiscoverV2{Topic: topic, Limit: 1})
+	require.NoError(t, err)
+	resptype, disc, err := srv.msgParser(nil, protocol.CodecV2, protocol.DISCOVER, rlp.NewStream(bytes.NewReader(data), 0))
+	require.NoError(t, err)
+	require.Equal(t, protocol.DISCOVER_RESPONSE, resptype)
+	records := disc.(protocol.DiscoverResponseV2).Records
+	require.Len(t, records, 1)
+	require.True(t, time.Duration(records[0].TTL) > 9*time.Second)
+	require.NotZero(t, records[0].Registered)
+}
+
+func TestDiscoverV2ForwardCompatible(t *testing.T) {
+	type discoverWithNewField struct {
+		Limit    uint
+		Topic    string
+		NewField string
+	}
+	srv := newTestServer(t)
+	data, err := rlp.EncodeToBytes(discoverWithNewField{Limit: 1, Topic: "any", NewField: "ignored"})
+	require.NoError(t, err)
+	_, disc, err := srv.msgParser(nil, protocol.CodecV2, protocol.DISCOVER, rlp.NewStream(bytes.NewReader(data), 0))
+	require.NoError(t, err)
+	require.Equal(t, protocol.OK, disc.(protocol.DiscoverResponseV2).Status)
+}
+
+func TestUnknownRequestType(t *testing.T) {
+	srv := newTestServer(t)
+	_, _, err := srv.msgParser(nil, protocol.CodecV1, protocol.REGISTER_RESPONSE, discCase{})
+	require.Error(t, err)
+}
+
+func TestTopics(t *testing.T) {
+	srv := newTestServer(t)
+	srv.networkDelay = 0
+	for _, reg := range []struct {
+		topic string
+		ttl   time.Duration
+	}{{"app/b", 10 * time.Second}, {"app/a", 10 * time.Second}, {"app/a", 10 * time.Second}, {"other", 0}} {
+		_, r := newRecord(t)
+		resp, err := srv.register("", protocol.Register{Record: r, Topic: reg.topic, TTL: uint64(reg.ttl)})
+		require.NoError(t, err)
+		require.Equal(t, protocol.OK, resp.Status)
+	}
+
+	topics := func(prefix string, limit uint) []protocol.TopicStat {
+		data, err := rlp.EncodeToBytes(protocol.Topics{Prefix: prefix, Limit: limit})
+		require.NoError(t, err)
+		resptype, resp, err := srv.msgParser(nil, protocol.CodecV2, protocol.TOPICS, rlp.NewStream(bytes.NewReader(data), 0))
+		require.NoError(t, err)
+		require.Equal(t, protocol.TOPICS_RESPONSE, resptype)
+		require.Equal(t, protocol.OK, resp.(protocol.TopicsResponse).Status)
+		return resp.(protocol.TopicsResponse).Topics
+	}
+	require.Equal(t, []protocol.TopicStat{{Topic: "app/a", Count: 2}, {Topic: "app/b", Count: 1}, {Topic: "other", Count: 1}}, topics("", 0))
+	require.Equal(t, []protocol.TopicStat{{Topic: "app/a", Count: 2}}, topics("app/", 1))
+
+	srv.purgeOutdated()
+	require.Equal(t, []protocol.TopicStat{}, topics("other", 0))
+}
+
+func TestTopicsDisabled(t *testing.T) {
+	srv := newTestServer(t, DisableTopics())
+	data, err := rlp.EncodeToBytes(protocol.Topics{})
+	require.NoError(t, err)
+	_, resp, err := srv.msgParser(nil, protocol.CodecV2, protocol.TOPICS, rlp.NewStream(bytes.NewReader(data), 0))
+	require.NoError(t, err)
+	require.Equal(t, protocol.E_NOT_AUTHORIZED, resp.(protocol.TopicsResponse).Status)
+
+	_, _, err = srv.msgParser(nil, protocol.CodecV1, protocol.TOPICS, rlp.NewStream(bytes.NewReader(data), 0))
+	require.Error(t, err)
+}
+
+func TestInfo(t *testing.T) {
+	srv := newTestServer(t, DisableTopics())
+	data, err := rlp.EncodeToBytes(protocol.Info{})
+	require.NoError(t, err)
+	resptype, resp, err := srv.msgParser(nil, protocol.CodecV2, protocol.INFO, rlp.NewStream(bytes.NewReader(data), 0))
+	require.NoError(t, err)
+	require.Equal(t, protocol.INFO_RESPONSE, resptype)
+	info := resp.(protocol.InfoResponse)
+	require.Equal(t, protocol.OK, info.Status)
+	require.Equal(t, uint64(longestTTL), info.LongestTTL)
+	require.Equal(t, maxLimit, info.MaxLimit)
+	require.Equal(t, uint(maxTopicLength), info.MaxTopicLength)
+	require.Equal(t, protocol.CodecV2.Requests(), info.Requests)
+	require.NotContains(t, info.Features, protocol.FeatureTopics)
+}
+
+func TestWildcardDiscover(t *testing.T) {
+	srv := newTestServer(t)
+	for _, topic := range []string{"/waku/2/rs/16/32", "/waku/2/rs/16/64", "/other"} {
+		_, r := newRecord(t)
+		resp, err := srv.register("", protocol.Register{Record: r, Topic: topic, TTL: uint64(10 * time.Second)})
+		require.NoError(t, err)
+		require.Equal(t, protocol.OK, resp.Status, resp.Message)
+	}
+	_, resp, err := srv.msgParser(nil, protocol.CodecV1, protocol.DISCOVER, discCase{Request: protocol.Discover{Topic: protocol.Subtopics("/waku/2"), Limit: 10}})
+	require.NoError(t, err)
+	require.Equal(t, protocol.OK, resp.(protocol.DiscoverResponse).Status)
+	require.Len(t, resp.(protocol.DiscoverResponse).Records, 2)
+
+	data, err := rlp.EncodeToBytes(protocol.DiscoverV2{Topic: "/wa*ku/*", Limit: 10})
+	require.NoError(t, err)
+	_, resp, err = srv.msgParser(nil, protocol.CodecV2, protocol.DISCOVER, rlp.NewStream(bytes.NewReader(data), 0))
+	require.NoError(t, err)
+	require.Equal(t, protocol.E_INVALID_NAMESPACE, resp.(protocol.DiscoverResponseV2).Status)
+}
+
+func TestLegacyTopics(t *testing.T) {
+	srv := newTestServer(t)
+	for _, topic := range []string{"white space", "a//b", "/wa*ku/*"} {
+		_, r := newRecord(t)
+		_, resp, err := srv.msgParser(nil, protocol.CodecV1, protocol.REGISTER, regCase{Request: protocol.Register{Record: r, Topic: topic, TTL: uint64(10 * time.Second)}})
+		require.NoError(t, err)
+		require.Equal(t, protocol.OK, resp.(protocol.RegisterResponse).Status, topic)
+
+		// invalid patterns are read as topics
+		_, resp, err = srv.msgParser(nil, protocol.CodecV1, protocol.DISCOVER, discCase{Request: protocol.Discover{Topic: topic, Limit: 10}})
+		require.NoError(t, err)
+		require.Equal(t, protocol.OK, resp.(protocol.DiscoverResponse).Status, topic)
+		require.Len(t, resp.(protocol.DiscoverResponse).Records, 1, topic)
+
+		// newer clients must use valid topics
+		_, resp, err = srv.msgParser(nil, protocol.CodecV2, protocol.REGISTER, regCase{Request: protocol.Register{Record: r, Topic: topic, TTL: uint64(10 * time.Second)}})
+		require.NoError(t, err)
+		require.Equal(t, protocol.E_INVALID_NAMESPACE, resp.(protocol.RegisterResponse).Status, topic)
+	}
+}
+
+func TestNamespacePolicy(t *testing.T) {
+	memdb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	srv := NewServer(nil, nil, NewStorage(memdb),
+		WithNamespacePolicy("/waku", NamespacePolicy{
+			Register: func(topic string, record enr.Record, ttl time.Duration) error {
+				if ttl < time.Second {
+					return protocol.NewError(protocol.E_INVALID_TTL, "ttl is too short")
+				}
+				return nil
+			},
+		}),
+		WithNamespacePolicy("/waku/private/", NamespacePolicy{
+			Discover: func(topic string, limit uint) error {
+				return errors.New("private namespace")
+			},
+		}),
+	)
+	_, r := newRecord(t)
+	resp, err := srv.register("", protocol.Register{Record: r, Topic: "/waku/2", TTL: uint64(time.Millisecond)})
+	require.NoError(t, err)
+	require.Equal(t, protocol.E_INVALID_TTL, resp.Status)
+	resp, err = srv.register("", protocol.Register{Record: r, Topic: "/waku/private/a", TTL: uint64(time.Millisecond)})
+	require.NoError(t, err)
+	require.Equal(t, protocol.OK, resp.Status)
+
+	for _, topic := range []string{"/waku/private/a", protocol.Subtopics("/waku")} {
+		_, disc, err := srv.msgParser(nil, protocol.CodecV1, protocol.DISCOVER, discCase{Request: protocol.Discover{Topic: topic, Limit: 1}})
+		require.NoError(t, err)
+		require.Equal(t, protocol.E_NOT_AUTHORIZED, disc.(protocol.DiscoverResponse).Status, topic)
+	}
+	_, disc, err := srv.msgParser(nil, protocol.CodecV1, protocol.DISCOVER, discCase{Request: protocol.Discover{Topic: "/waku/2", Limit: 1}})
+	require.NoError(t, err)
+	require.Equal(t, protocol.OK, disc.(protocol.DiscoverResponse).Status)
+}
+
+func TestPrivateTopic(t *testing.T) {
+	owner, _ := crypto.GenerateKey()
+	srv := newTestServer(t, WithPrivateTopic("/app/x", &owner.PublicKey))
+	token, err := protocol.NewToken(owner, "/app/x", time.Now().Add(time.Hour), enode.ID{})
+	require.NoError(t, err)
+	_, r := newRecord(t)
+
+	register := func(topic string, token []byte) protocol.ResponseStatus {
+		_, resp, err := srv.msgParser(nil, protocol.CodecV1, protocol.REGISTER, regCase{Request: protocol.Register{Topic: topic, Record: r, TTL: uint64(10 * time.Second), Token: token}})
+		require.NoError(t, err)
+		return resp.(protocol.RegisterResponse).Status
+	}
+	discover := func(topic string, token []byte) protocol.ResponseStatus {
+		_, resp, err := srv.msgParser(nil, protocol.CodecV1, protocol.DISCOVER, discCase{Request: protocol.Discover{Topic: topic, Limit: 1, Token: token}})
+		require.NoError(t, err)
+		return resp.(protocol.DiscoverResponse).Status
+	}
+	require.Equal(t, protocol.E_NOT_AUTHORIZED, register("/app/x/chat", nil))
+	require.Equal(t, protocol.OK, register("/app/x/chat", token))
+	require.Equal(t, protocol.OK, register("/app/y", nil))
+	require.Equal(t, protocol.E_NOT_AUTHORIZED, discover("/app/x/chat", nil))
+	require.Equal(t, protocol.OK, discover("/app/x/chat", token))
+	require.Equal(t, protocol.OK, discover(protocol.Subtopics("/app/x"), token))
+	require.Equal(t, protocol.E_NOT_AUTHORIZED, discover(protocol.Subtopics("/app"), token))
+
+	resp := srv.listTopics(protocol.Topics{})
+	require.Equal(t, []protocol.TopicStat{{Topic: "/app/y", Count: 1}}, resp.Topics)
+}
+
+func TestBlindedTopic(t *testing.T) {
+	srv := newTestServer(t)
+	topic := protocol.BlindTopic([]byte("secret"), "/app/chat", 1)
+	_, r := newRecord(t)
+	resp, err := srv.register("", protocol.Register{Record: r, Topic: topic, TTL: uint64(10 * time.Second)})
+	require.NoError(t, err)
+	require.Equal(t, protocol.OK, resp.Status, resp.Message)
+
+	_, dresp, err := srv.msgParser(nil, protocol.CodecV1, protocol.DISCOVER, discCase{Request: protocol.Discover{Topic: topic, Limit: 10}})
+	require.NoError(t, err)
+	require.Equal(t, protocol.OK, dresp.(protocol.DiscoverResponse).Status)
+	require.Len(t, dresp.(protocol.DiscoverResponse).Records, 1)
+	require.Equal(t, 1, srv.topics.count(topic))
+}
+
+func TestSpecDiscoverAllNamespaces(t *testing.T) {
+	owner, _ := crypto.GenerateKey()
+	token, err := protocol.NewToken(owner, "/app/x", time.Now().Add(time.Hour), enode.ID{})
+	require.NoError(t, err)
+	srv := newTestServer(t,
+		WithPrivateTopic("/app/x", &owner.PublicKey),
+		WithNamespacePolicy("/waku/private", NamespacePolicy{
+			Discover: func(topic string, limit uint) error {
+				return errors.New("private namespace")
+			},
+		}),
+	)
+	blinded := protocol.BlindTopic([]byte("secret"), "/app/chat", 1)
+	// only topics that libp2p clients may discover on their own are returned
+	for _, topic := range []string{"/waku/2", "/waku/private/a", blinded, "/app/x/chat", "/app/y"} {
+		priv, _, err := lcrypto.GenerateSecp256k1Key(nil)
+		require.NoError(t, err)
+		id, err := peer.IDFromPrivateKey(priv)
+		require.NoError(t, err)
+		env, err := record.Seal(peer.PeerRecordFromAddrInfo(peer.AddrInfo{ID: id}), priv)
+		require.NoError(t, err)
+		data, err := env.Marshal()
+		require.NoError(t, err)
+		r, err := protocol.WrapPeerRecord(data)
+		require.NoError(t, err)
+		_, resp, err := srv.msgParser(nil, protocol.CodecV1, protocol.REGISTER, regCase{Request: protocol.Register{Topic: topic, Record: r, TTL: uint64(10 * time.Second), Token: token}})
+		require.NoError(t, err)
+		require.Equal(t, protocol.OK, resp.(protocol.RegisterResponse).Status, topic)
+	}
+
+	disc := srv.specDiscover("", &pb.Discover{})
+	require.Equal(t, pb.OK, disc.Status, disc.StatusText)
+	var namespaces []string
+	for _, reg := range disc.Registrations {
+		namespaces = append(namespaces, reg.Ns)
+	}
+	require.Equal(t, []string{"/waku/2", "/app/y"}, namespaces)
+}
+
+func TestBan(t *testing.T) {
+	srv := newTestServer(t)
+	key, r := newRecord(t)
+	for _, topic := range []string{"a", "b"} {
+		resp, err := srv.register("", protocol.Register{Record: r, Topic: topic, TTL: uint64(10 * time.Second)})
+		require.NoError(t, err)
+		require.Equal(t, protocol.OK, resp.Status, resp.Message)
+	}
+	id := enode.PubkeyToIDV4(&key.PublicKey)
+	require.NoError(t, srv.Ban(Ban{Kind: BanNode, Target: "0x" + id.String(), Reason: "spam"}))
+	require.Equal(t, 0, srv.topics.count("a"))
+	require.Equal(t, 0, srv.topics.count("b"))
+	resp, err := srv.register("", protocol.Register{Record: r, Topic: "a", TTL: uint64(10 * time.Second)})
+	require.NoError(t, err)
+	require.Equal(t, protocol.E_NOT_AUTHORIZED, resp.Status)
+
+	require.Error(t, srv.Ban(Ban{Kind: BanIP, Target: "not an ip"}))
+	require.NoError(t, srv.Ban(Ban{Kind: BanIP, Target: "10.0.0.0/8", Expiry: time.Now().Add(-time.Second)}))
+	require.Len(t, srv.Bans(), 1)
+
+	restarted := NewServer(nil, nil, srv.storage)
+	require.NoError(t, restarted.loadBans())
+	require.Equal(t, []Ban{{Kind: BanNode, Target: id.String(), Reason: "spam"}}, restarted.Bans())
+	restarted.purgeBans()
+	stored, err := restarted.storage.Bans()
+	require.NoError(t, err)
+	require.Len(t, stored, 1)
+
+	require.NoError(t, restarted.Unban(BanNode, id.String()))
+	require.Error(t, restarted.Unban(BanNode, id.String()))
+	require.Empty(t, restarted.Bans())
+	resp, err = restarted.register("", protocol.Register{Record: r, Topic: "a", TTL: uint64(10 * time.Second)})
+	require.NoError(t, err)
+	require.Equal(t, protocol.OK, resp.Status)
+}
+
+func TestScoring(t *testing.T) {
+	priv, _, err := lcrypto.GenerateEd25519Key(nil)
+	require.NoError(t, err)
+	id, err := peer.IDFromPrivateKey(priv)
+	require.NoError(t, err)
+
+	srv := newTestServer(t, WithScoring(ScoreConfig{
+		Penalties:   map[Penalty]float64{PenaltyInvalidContent: 10},
+		Threshold:   -25,
+		BanDuration: time.Minute,
+		HalfLife:    time.Hour,
+	}))
+	srv.Penalize(id, PenaltyInvalidContent)
+	srv.Penalize(id, PenaltyInvalidContent)
+	require.InDelta(t, -20, srv.Scores()[id], 0.01)
+	require.Empty(t, srv.Bans())
+
+	srv.Penalize(id, PenaltyInvalidContent)
+	require.Empty(t, srv.Scores())
+	bans := srv.Bans()
+	require.Len(t, bans, 1)
+	require.Equal(t, BanPeer, bans[0].Kind)
+	require.Equal(t, id.String(), bans[0].Target)
+	require.WithinDuration(t, time.Now().Add(time.Minute), bans[0].Expiry, time.Second)
+}
+
+func TestScoreDecay(t *testing.T) {
+	s := newScores(ScoreConfig{Penalties: map[Penalty]float64{PenaltyUnknownType: 10}, Threshold: -100, HalfLife: time.Minute})
+	now := time.Now()
+	s.penalize("a", PenaltyUnknownType, now)
+	require.InDelta(t, -5, s.list(now.Add(time.Minute))["a"], 0.01)
+	require.Empty(t, s.decay(now.Add(2*time.Minute)))
+	require.Equal(t, []peer.ID{"a"}, s.decay(now.Add(time.Hour)))
+	require.Empty(t, s.list(now.Add(time.Hour)))
+}
+
+func TestCleanerStalled(t *testing.T) {
+	srv := newTestServer(t)
+	require.NoError(t, srv.Healthy())
+	srv.lastPurge = time.Now().Add(-cleanerStallPeriods * srv.cleanerPeriod).Add(-time.Second).UnixNano()
+	require.Error(t, srv.Healthy())
+	srv.purgeOutdated()
+	require.NoError(t, srv.Healthy())
+}
+
+func TestFederationMerge(t *testing.T) {
+	srv := newTestServer(t, WithFederation(DefaultFederationConfig))
+	key, _ := crypto.GenerateKey()
+	var r enr.Record
+	r.SetSeq(2)
+	require.NoError(t, enode.SignV4(&r, key))
+	deadline := time.Now().Add(10 * time.Second)
+	rec := protocol.FederatedRecord{Topic: "a", Record: r, Deadline: unixNano(deadline)}
+
+	k, changed, err := srv.storeReplica(rec)
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.Equal(t, 1, srv.topics.count("a"))
+	stored, err := srv.storage.Get(k)
+	require.NoError(t, err)
+	require.Equal(t, deadline.UnixNano(), stored.Time.UnixNano())
+	_, changed, err = srv.storeReplica(rec)
+	require.NoError(t, err)
+	require.False(t, changed)
+
+	// older sequence number is ignored
+	var old enr.Record
+	old.SetSeq(1)
+	require.NoError(t, enode.SignV4(&old, key))
+	_, changed, err = srv.storeReplica(protocol.FederatedRecord{Topic: "a", Record: old, Deadline: unixNano(deadline.Add(time.Second))})
+	require.NoError(t, err)
+	require.False(t, changed)
+
+	// removed registration is not brought back by sync
+	require.NoError(t, srv.remove(k))
+	require.Equal(t, 0, srv.topics.count("a"))
+	_, changed, err = srv.storeReplica(rec)
+	require.NoError(t, err)
+	require.False(t, changed)
+	rec.Deadline = unixNano(deadline.Add(time.Second))
+	_, changed, err = srv.storeReplica(rec)
+	require.NoError(t, err)
+	require.True(t, changed)
+
+	// expiration of the older registration keeps the newer one
+	_, changed, err = srv.expireReplica(protocol.FederatedExpiration{Topic: "a", Node: NodeAddrPart([]byte(k)), Seq: 2, Deadline: unixNano(deadline)})
+	require.NoError(t, err)
+	require.False(t, changed)
+	_, changed, err = srv.expireReplica(protocol.FederatedExpiration{Topic: "a", Node: NodeAddrPart([]byte(k)), Seq: 2, Deadline: rec.Deadline})
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.Equal(t, 0, srv.topics.count("a"))
+
+	_, _, err = srv.storeReplica(protocol.FederatedRecord{Topic: "a", Record: r, Deadline: unixNano(time.Now().Add(longestTTL + time.Hour))})
+	require.Error(t, err)
+}
+
+func TestClusterRing(t *testing.T) {
+	memberAddr := func() ma.Multiaddr {
+		_, pub, err := lcrypto.GenerateSecp256k1Key(nil)
+		require.NoError(t, err)
+		id, err := peer.IDFromPublicKey(pub)
+		require.NoError(t, err)
+		return ma.StringCast("/ip4/127.0.0.1/tcp/9090/ethv4/" + id.String())
+	}
+	a, b, c := memberAddr(), memberAddr(), memberAddr()
+	srv := NewServer(nil, nil, Storage{}, WithCluster(DefaultClusterConfig))
+	require.NoError(t, srv.SetClusterMembers([]ma.Multiaddr{a, b}))
+
+	topics := make([]string, 300)
+	before := map[string]peer.ID{}
+	for i := range topics {
+		topics[i] = fmt.Sprintf("/t%d", i)
+		before[topics[i]], _ = srv.cluster.owner(topics[i])
+		owner, _ := srv.cluster.owner(topics[i] + "/chat/*")
+		require.Equal(t, before[topics[i]], owner, "topics of the namespace must have the same owner")
+	}
+
+	require.NoError(t, srv.SetClusterMembers([]ma.Multiaddr{a, b, c}))
+	cid, _, err := splitServerAddr(c)
+	require.NoError(t, err)
+	moved := 0
+	for _, topic := range topics {
+		owner, _ := srv.cluster.owner(topic)
+		if owner != before[topic] {
+			require.Equal(t, cid, owner, "topics may move only to the new member")
+			moved++
+		}
+	}
+	require.Greater(t, moved, 0)
+	require.Less(t, moved, len(topics)*2/3)
+}
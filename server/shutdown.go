@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	libp2pprotocol "github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/status-im/rendezvous/protocol"
+	"github.com/status-im/rendezvous/protocol/pb"
+)
+
+// trackStream registers stream handler in the wait group. It returns false if server is
+// shutting down and stream must not be served.
+func (srv *Server) trackStream(s network.Stream) bool {
+	srv.streamsMu.Lock()
+	defer srv.streamsMu.Unlock()
+	if srv.closing {
+		return false
+	}
+	if srv.streams == nil {
+		srv.streams = map[network.Stream]bool{}
+	}
+	srv.streams[s] = true
+	srv.wg.Add(1)
+	return true
+}
+
+func (srv *Server) untrackStream(s network.Stream) {
+	srv.streamsMu.Lock()
+	delete(srv.streams, s)
+	srv.streamsMu.Unlock()
+	srv.wg.Done()
+}
+
+// setIdle marks stream as waiting for the next request. It returns false if server is
+// shutting down, then handler should return instead of reading the next request.
+func (srv *Server) setIdle(s network.Stream, idle bool) bool {
+	srv.streamsMu.Lock()
+	defer srv.streamsMu.Unlock()
+	srv.streams[s] = idle
+	return !srv.closing
+}
+
+// closeStreams closes idle streams, or all streams if force is true, so that their
+// handlers return.
+func (srv *Server) closeStreams(force bool) {
+	srv.streamsMu.Lock()
+	defer srv.streamsMu.Unlock()
+	for s, idle := range srv.streams {
+		if force {
+			s.Reset()
+		} else if idle {
+			s.Close()
+		}
+	}
+}
+
+// Shutdown stops accepting new streams, waits for in-flight requests and stops the server.
+// Streams that are still served when ctx is done are reset and ctx error is returned.
+func (srv *Server) Shutdown(ctx context.Context) (err error) {
+	if srv.quit == nil {
+		return nil
+	}
+	select {
+	case <-srv.quit:
+		return nil
+	default:
+	}
+	atomic.StoreInt32(&srv.ready, 0)
+	addrs := srv.Addrs()
+	if srv.h != nil {
+		for _, codec := range protocol.Codecs {
+			srv.h.RemoveStreamHandler(libp2pprotocol.ID(codec.ID))
+		}
+		srv.h.RemoveStreamHandler(pb.PROTOCOL)
+		srv.h.RemoveStreamHandler(protocol.FederationVersion)
+	}
+	srv.streamsMu.Lock()
+	srv.closing = true
+	srv.stoppedAddrs = addrs
+	srv.streamsMu.Unlock()
+	srv.closeStreams(false)
+	close(srv.quit)
+
+	done := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logger.Info("shutdown deadline exceeded, resetting streams")
+		srv.closeStreams(true)
+		<-done
+		err = ctx.Err()
+	}
+	if srv.relay != nil {
+		srv.relay.Close()
+	}
+	if srv.h != nil {
+		srv.h.Close()
+	}
+	return err
+}
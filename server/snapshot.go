@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/status-im/rendezvous/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// maxSnapshotLine is the longest line accepted by Import. Records are limited to 300 bytes and
+// envelopes of detached peer records to a message of the libp2p rendezvous protocol, so it
+// leaves room for base64 of the envelope, topic and times.
+const maxSnapshotLine = 2 * specMaxMessageSize
+
+// SnapshotRecord is a line of the snapshot. Blinded topics are hex encoded.
+type SnapshotRecord struct {
+	Topic   string `json:"topic"`
+	Blinded bool   `json:"blinded,omitempty"`
+	// ENR is in text encoding, "enr:" followed by base64 of the record.
+	ENR        string     `json:"enr"`
+	Deadline   time.Time  `json:"deadline"`
+	Registered *time.Time `json:"registered,omitempty"`
+	// Envelope is base64 of signed peer record of the detached ENR, see protocol.DetachPeerRecord.
+	Envelope string `json:"envelope,omitempty"`
+}
+
+// ImportStats counts lines of the imported snapshot.
+type ImportStats struct {
+	Imported int `json:"imported"`
+	// Kept are records that are older than the stored ones.
+	Kept    int `json:"kept"`
+	Expired int `json:"expired"`
+	Invalid int `json:"invalid"`
+}
+
+func encodeENR(record enr.Record) (string, error) {
+	data, err := rlp.EncodeToBytes(&record)
+	if err != nil {
+		return "", err
+	}
+	return "enr:" + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeENR(text string) (record enr.Record, err error) {
+	if !strings.HasPrefix(text, "enr:") {
+		return record, errors.New(`enr must start with "enr:"`)
+	}
+	data, err := base64.RawURLEncoding.DecodeString(text[4:])
+	if err != nil {
+		return record, err
+	}
+	return record, rlp.DecodeBytes(data, &record)
+}
+
+// Export writes registrations with deadline after now as newline-delimited JSON, see
+// SnapshotRecord. It returns the number of written records.
+func (s *Storage) Export(w io.Writer, now time.Time) (int, error) {
+	iter := s.db.NewIterator(util.BytesPrefix([]byte{RecordsPrefix}), nil)
+	defer iter.Release()
+	enc := json.NewEncoder(w)
+	count := 0
+	for iter.Next() {
+		var stored StorageRecord
+		if err := rlp.DecodeBytes(iter.Value(), &stored); err != nil {
+			return count, err
+		}
+		if !stored.Time.After(now) {
+			continue
+		}
+		text, err := encodeENR(stored.ENR)
+		if err != nil {
+			return count, err
+		}
+		line := SnapshotRecord{Topic: string(TopicPart(iter.Key())), ENR: text, Deadline: stored.Time}
+		if len(stored.Envelope) != 0 {
+			line.Envelope = base64.StdEncoding.EncodeToString(stored.Envelope)
+		}
+		if protocol.IsBlinded(line.Topic) {
+			line.Topic = hex.EncodeToString([]byte(line.Topic))
+			line.Blinded = true
+		}
+		if !stored.Registered.IsZero() {
+			registered := stored.Registered
+			line.Registered = &registered
+		}
+		if err := enc.Encode(line); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, iter.Error()
+}
+
+// Import reads snapshot written by Export. Signatures and topics are validated again, invalid
+// lines and records expired before now are skipped. Stored registrations with higher sequence
+// number or later deadline are kept. Server must not be running, it rebuilds the cleaner from
+// storage on start.
+func (s *Storage) Import(r io.Reader, now time.Time) (stats ImportStats, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), maxSnapshotLine)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		topic, stored, err := parseSnapshotLine(scanner.Bytes())
+		if err != nil {
+			logger.Warn("skipping invalid snapshot line", "line", lineno, "error", err)
+			stats.Invalid++
+			continue
+		}
+		if !stored.Time.After(now) {
+			stats.Expired++
+			continue
+		}
+		key := NewRecordsKey(topic, stored.ENR).String()
+		existing, err := s.Get(key)
+		if err == nil && !newer(stored.ENR.Seq(), stored.Time, existing) {
+			stats.Kept++
+			continue
+		} else if err != nil && !errors.Is(err, leveldb.ErrNotFound) {
+			return stats, err
+		}
+		if err := s.Put(key, stored); err != nil {
+			return stats, err
+		}
+		stats.Imported++
+	}
+	return stats, scanner.Err()
+}
+
+func parseSnapshotLine(data []byte) (string, StorageRecord, error) {
+	var line SnapshotRecord
+	if err := json.Unmarshal(data, &line); err != nil {
+		return "", StorageRecord{}, err
+	}
+	topic := line.Topic
+	if line.Blinded {
+		raw, err := hex.DecodeString(line.Topic)
+		if err != nil {
+			return "", StorageRecord{}, fmt.Errorf("invalid blinded topic: %w", err)
+		}
+		topic = string(raw)
+	}
+	if reason := validateTopic(topic, true); len(reason) != 0 {
+		return "", StorageRecord{}, errors.New(reason)
+	}
+	record, err := decodeENR(line.ENR)
+	if err != nil {
+		return "", StorageRecord{}, fmt.Errorf("invalid enr: %w", err)
+	}
+	envelope, err := base64.StdEncoding.DecodeString(line.Envelope)
+	if err != nil {
+		return "", StorageRecord{}, fmt.Errorf("invalid envelope: %w", err)
+	}
+	if len(envelope) == 0 {
+		envelope = nil
+	}
+	if err := protocol.VerifyRecord(&record, envelope); err != nil {
+		return "", StorageRecord{}, fmt.Errorf("invalid enr signature: %w", err)
+	}
+	stored := StorageRecord{ENR: record, Time: line.Deadline, Envelope: envelope}
+	if line.Registered != nil {
+		stored.Registered = *line.Registered
+	}
+	return topic, stored, nil
+}
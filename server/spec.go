@@ -0,0 +1,298 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/record"
+	"github.com/libp2p/go-msgio"
+	"github.com/status-im/rendezvous/protocol"
+	"github.com/status-im/rendezvous/protocol/pb"
+)
+
+// Limits of the libp2p rendezvous protocol. Registrations made with it are expected
+// to live longer than ones made with the rlp protocol.
+const (
+	specDefaultTTL          = 2 * time.Hour
+	specLongestTTL          = 72 * time.Hour
+	specMaxLimit       uint = 100
+	specMaxMessageSize      = 64 << 10
+)
+
+// specCookie is an opaque cookie returned to libp2p rendezvous clients. It points to the last
+// registration returned for the topic, so that next request returns only newer registrations.
+type specCookie struct {
+	Topic      string
+	Registered uint64
+	Key        []byte
+}
+
+// specStreamHandler serves libp2p rendezvous protocol. Registrations are stored as ENRs that
+// wrap signed peer records, so they are returned to rlp clients too. Signed peer records that
+// don't fit into enr are stored next to detached ENRs and are served only to libp2p clients.
+func (srv *Server) specStreamHandler(s network.Stream) {
+	if !srv.trackStream(s) {
+		s.Reset()
+		return
+	}
+	defer srv.untrackStream(s)
+	defer s.Close()
+	r := msgio.NewVarintReaderSize(s, specMaxMessageSize)
+	w := msgio.NewVarintWriter(s)
+	for srv.setIdle(s, true) {
+		s.SetReadDeadline(time.Now().Add(srv.idleTimeout()))
+		data, err := r.ReadMsg()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			logger.Debug("error reading message", "error", err)
+			s.Reset()
+			return
+		}
+		srv.setIdle(s, false)
+		var req pb.Message
+		err = req.Unmarshal(data)
+		r.ReleaseMsg(data)
+		if err != nil {
+			metrics.CountError("spec")
+			srv.Penalize(s.Conn().RemotePeer(), PenaltyInvalidContent)
+			logger.Debug("error decoding message", "error", err)
+			s.Reset()
+			return
+		}
+		resp := srv.specMsgParser(s, &req)
+		if resp == nil {
+			continue
+		}
+		s.SetWriteDeadline(time.Now().Add(srv.writeTimeout))
+		if err := w.WriteMsg(resp.Marshal()); err != nil {
+			logger.Debug("error writing response", "type", resp.Type, "error", err)
+			s.Reset()
+			return
+		}
+	}
+}
+
+// specMsgParser returns nil if request doesn't need a response.
+func (srv *Server) specMsgParser(s network.Stream, req *pb.Message) *pb.Message {
+	switch {
+	case req.Type == pb.REGISTER && req.Register != nil:
+		return &pb.Message{Type: pb.REGISTER_RESPONSE, RegisterResponse: srv.specRegister(s.Conn().RemotePeer(), req.Register)}
+	case req.Type == pb.DISCOVER:
+		// missing message has default fields, so it asks for all namespaces
+		msg := req.Discover
+		if msg == nil {
+			msg = &pb.Discover{}
+		}
+		return &pb.Message{Type: pb.DISCOVER_RESPONSE, DiscoverResponse: srv.specDiscover(s.Conn().RemotePeer(), msg)}
+	case req.Type == pb.UNREGISTER && req.Unregister != nil:
+		srv.specUnregister(s.Conn().RemotePeer(), req.Unregister)
+		return nil
+	case req.Type == pb.REGISTER:
+		metrics.CountError("register")
+		srv.Penalize(s.Conn().RemotePeer(), PenaltyInvalidContent)
+		return &pb.Message{Type: pb.REGISTER_RESPONSE, RegisterResponse: &pb.RegisterResponse{Status: pb.E_INVALID_SIGNED_PEER_RECORD, StatusText: "register message is missing"}}
+	default:
+		metrics.CountError("unknown")
+		srv.Penalize(s.Conn().RemotePeer(), PenaltyUnknownType)
+		return nil
+	}
+}
+
+func (srv *Server) specRegister(remote peer.ID, msg *pb.Register) *pb.RegisterResponse {
+	if reason := validateTopic(msg.Ns, false); len(reason) != 0 {
+		return &pb.RegisterResponse{Status: pb.E_INVALID_NAMESPACE, StatusText: reason}
+	}
+	// libp2p rendezvous clients can't follow redirects, they must ask the owner
+	if _, owner, foreign := srv.foreignOwner(msg.Ns); foreign {
+		return &pb.RegisterResponse{Status: pb.E_UNAVAILABLE, StatusText: "namespace is served by " + owner.String()}
+	}
+	ttl := time.Duration(msg.Ttl) * time.Second
+	if msg.Ttl == 0 {
+		ttl = specDefaultTTL
+	}
+	if ttl > specLongestTTL {
+		return &pb.RegisterResponse{Status: pb.E_INVALID_TTL, StatusText: fmt.Sprintf("ttl %v is longer than %v", ttl, specLongestTTL)}
+	}
+	_, rec, err := record.ConsumeEnvelope(msg.SignedPeerRecord, peer.PeerRecordEnvelopeDomain)
+	if err != nil {
+		srv.Penalize(remote, PenaltyInvalidSignature)
+		return &pb.RegisterResponse{Status: pb.E_INVALID_SIGNED_PEER_RECORD, StatusText: err.Error()}
+	}
+	if pr, ok := rec.(*peer.PeerRecord); !ok || pr.PeerID != remote {
+		return &pb.RegisterResponse{Status: pb.E_NOT_AUTHORIZED, StatusText: "signed peer record doesn't belong to the registering peer"}
+	}
+	// envelope was consumed above, so wrapping fails only if it doesn't fit into enr
+	var envelope []byte
+	wrapped, err := protocol.WrapPeerRecord(msg.SignedPeerRecord)
+	if err != nil {
+		envelope = msg.SignedPeerRecord
+		wrapped, err = protocol.DetachPeerRecord(envelope)
+	}
+	if err != nil {
+		return &pb.RegisterResponse{Status: pb.E_INVALID_SIGNED_PEER_RECORD, StatusText: err.Error()}
+	}
+	// libp2p rendezvous clients can't present tokens
+	if perr := srv.checkToken(msg.Ns, nil, nil); perr != nil {
+		return &pb.RegisterResponse{Status: specStatus(perr.Status), StatusText: perr.Message}
+	}
+	defer srv.registerLocks.lock(msg.Ns)()
+	if perr := srv.checkRegister(RegisterRequest{Topic: msg.Ns, Record: wrapped, TTL: ttl, Peer: remote}); perr != nil {
+		return &pb.RegisterResponse{Status: specStatus(perr.Status), StatusText: perr.Message}
+	}
+	if err := srv.store(msg.Ns, wrapped, envelope, ttl); err != nil {
+		logger.Error("error storing record", "error", err)
+		return &pb.RegisterResponse{Status: pb.E_INTERNAL_ERROR, StatusText: "failed to store record"}
+	}
+	return &pb.RegisterResponse{Status: pb.OK, Ttl: uint64(ttl / time.Second)}
+}
+
+// specDiscover returns registrations of the namespace, or of all namespaces if it is empty.
+func (srv *Server) specDiscover(remote peer.ID, msg *pb.Discover) *pb.DiscoverResponse {
+	limit := uint(msg.Limit)
+	if limit == 0 || limit > specMaxLimit {
+		limit = specMaxLimit
+	}
+	if len(msg.Ns) != 0 {
+		if resp := srv.checkSpecDiscover(remote, msg.Ns, limit); resp != nil {
+			return resp
+		}
+	}
+	var after Cursor
+	if len(msg.Cookie) != 0 {
+		var cookie specCookie
+		if err := rlp.DecodeBytes(msg.Cookie, &cookie); err != nil || cookie.Topic != msg.Ns {
+			return &pb.DiscoverResponse{Status: pb.E_INVALID_COOKIE, StatusText: "cookie is malformed or belongs to other namespace"}
+		}
+		after = Cursor{Registered: fromUnixNano(cookie.Registered), Key: cookie.Key}
+	}
+	start := time.Now()
+	var (
+		stored []StorageRecord
+		topics []string
+		next   Cursor
+		err    error
+	)
+	if len(msg.Ns) == 0 {
+		allowed := map[string]bool{}
+		stored, topics, next, err = srv.storage.GetAllRegisteredAfter(after, limit, func(topic string) bool {
+			ok, exist := allowed[topic]
+			if !exist {
+				// blinded topics are visible only to those who know them
+				ok = !protocol.IsBlinded(topic) && srv.checkSpecDiscover(remote, topic, limit) == nil
+				allowed[topic] = ok
+			}
+			return ok
+		})
+	} else {
+		stored, next, err = srv.storage.GetRegisteredAfter(msg.Ns, after, limit)
+	}
+	if err != nil {
+		metrics.CountError("discover")
+		logger.Error("error reading records", "error", err)
+		return &pb.DiscoverResponse{Status: pb.E_INTERNAL_ERROR, StatusText: "failed to read records"}
+	}
+	metrics.ObserveDiscoveryDuration(time.Since(start).Seconds(), metricsTopic(msg.Ns))
+	metrics.ObserveDiscoverSize(float64(len(stored)), metricsTopic(msg.Ns))
+
+	resp := &pb.DiscoverResponse{Status: pb.OK}
+	now := time.Now()
+	for i := range stored {
+		// only records that carry signed peer record can be returned to libp2p clients
+		envelope := stored[i].Envelope
+		if len(envelope) == 0 {
+			var err error
+			if envelope, _, err = protocol.ConsumePeerRecord(&stored[i].ENR); err != nil {
+				continue
+			}
+		}
+		ttl, _ := srv.recordDetails(stored[i], now)
+		ns := msg.Ns
+		if len(ns) == 0 {
+			ns = topics[i]
+		}
+		resp.Registrations = append(resp.Registrations, &pb.Register{
+			Ns:               ns,
+			SignedPeerRecord: envelope,
+			Ttl:              uint64(time.Duration(ttl) / time.Second),
+		})
+	}
+	cookie, err := rlp.EncodeToBytes(specCookie{Topic: msg.Ns, Registered: unixNano(next.Registered), Key: next.Key})
+	if err != nil {
+		return &pb.DiscoverResponse{Status: pb.E_INTERNAL_ERROR, StatusText: "failed to encode cookie"}
+	}
+	resp.Cookie = cookie
+	return resp
+}
+
+// checkSpecDiscover returns error response if registrations of the namespace can't be discovered.
+func (srv *Server) checkSpecDiscover(remote peer.ID, ns string, limit uint) *pb.DiscoverResponse {
+	if reason := validateTopic(ns, false); len(reason) != 0 {
+		return &pb.DiscoverResponse{Status: pb.E_INVALID_NAMESPACE, StatusText: reason}
+	}
+	if _, owner, foreign := srv.foreignOwner(ns); foreign {
+		return &pb.DiscoverResponse{Status: pb.E_UNAVAILABLE, StatusText: "namespace is served by " + owner.String()}
+	}
+	if perr := srv.checkToken(ns, nil, nil); perr != nil {
+		return &pb.DiscoverResponse{Status: specStatus(perr.Status), StatusText: perr.Message}
+	}
+	if perr := srv.checkDiscover(DiscoverRequest{Topic: ns, Limit: limit, Peer: remote}, ns, false); perr != nil {
+		return &pb.DiscoverResponse{Status: specStatus(perr.Status), StatusText: perr.Message}
+	}
+	return nil
+}
+
+// specStatus converts status of the rlp protocol to the closest status of libp2p rendezvous.
+func specStatus(status protocol.ResponseStatus) pb.ResponseStatus {
+	switch status {
+	case protocol.OK:
+		return pb.OK
+	case protocol.E_INVALID_NAMESPACE:
+		return pb.E_INVALID_NAMESPACE
+	case protocol.E_INVALID_ENR:
+		return pb.E_INVALID_SIGNED_PEER_RECORD
+	case protocol.E_INVALID_TTL:
+		return pb.E_INVALID_TTL
+	case protocol.E_INTERNAL_ERROR:
+		return pb.E_INTERNAL_ERROR
+	default:
+		return pb.E_NOT_AUTHORIZED
+	}
+}
+
+// specUnregister removes registration of the peer under the topic or under all topics
+// if topic is empty.
+func (srv *Server) specUnregister(remote peer.ID, msg *pb.Unregister) {
+	pub, err := remote.ExtractPublicKey()
+	if err != nil {
+		logger.Debug("can't extract public key", "peer", remote, "error", err)
+		return
+	}
+	addr := protocol.PeerNodeAddr(pub)
+	var keys []string
+	if len(msg.Ns) != 0 {
+		keys = append(keys, NewRecordsKeyForAddr(msg.Ns, addr).String())
+	} else {
+		err := srv.storage.IterateAllKeys(func(key RecordsKey, _ time.Time) error {
+			if bytes.Equal(NodeAddrPart(key), addr) {
+				keys = append(keys, key.String())
+			}
+			return nil
+		})
+		if err != nil {
+			logger.Error("error iterating keys", "error", err)
+			return
+		}
+	}
+	for _, key := range keys {
+		if err := srv.remove(key); err != nil {
+			logger.Error("error removing registration", "error", err)
+		}
+	}
+}
@@ -3,17 +3,26 @@ package server
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/binary"
+	"io"
+	mrand "math/rand"
+	"strings"
 	"time"
 
 	"github.com/ethereum/go-ethereum/p2p/enr"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/util"
-	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/status-im/rendezvous/protocol"
 )
 
 const (
 	RecordsPrefix byte = 1 + iota
+	BansPrefix
+	// RegisteredPrefix indexes records of the topic by their registration time.
+	RegisteredPrefix
+	// AllRegisteredPrefix indexes records of all topics by their registration time.
+	AllRegisteredPrefix
 
 	TopicBodyDelimiter = 0xff
 )
@@ -21,6 +30,83 @@ const (
 type StorageRecord struct {
 	ENR  enr.Record
 	Time time.Time
+	// Registered is when the record was first added under the topic.
+	Registered time.Time
+	// Envelope is signed peer record of the detached ENR, see protocol.DetachPeerRecord.
+	Envelope []byte
+}
+
+type storageRecordRLP struct {
+	ENR        enr.Record
+	Time       uint64
+	Registered uint64
+	Envelope   []byte `rlp:"optional"`
+}
+
+func unixNano(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano())
+}
+
+func fromUnixNano(t uint64) time.Time {
+	if t == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(t))
+}
+
+// EncodeRLP stores times as unix nanoseconds, time.Time has no exported fields to encode.
+func (r StorageRecord) EncodeRLP(w io.Writer) error {
+	return rlp.Encode(w, storageRecordRLP{ENR: r.ENR, Time: unixNano(r.Time), Registered: unixNano(r.Registered), Envelope: r.Envelope})
+}
+
+// DecodeRLP decodes record. Records that were stored with time encoded as an empty list
+// are decoded with zero time, records stored without registration time get zero Registered.
+func (r *StorageRecord) DecodeRLP(s *rlp.Stream) error {
+	if _, err := s.List(); err != nil {
+		return err
+	}
+	if err := s.Decode(&r.ENR); err != nil {
+		return err
+	}
+	kind, _, err := s.Kind()
+	if err != nil {
+		return err
+	}
+	r.Time = time.Time{}
+	r.Registered = time.Time{}
+	r.Envelope = nil
+	if kind == rlp.List {
+		if _, err := s.List(); err != nil {
+			return err
+		}
+		if err := s.ListEnd(); err != nil {
+			return err
+		}
+	} else {
+		t, err := s.Uint()
+		if err != nil {
+			return err
+		}
+		r.Time = fromUnixNano(t)
+	}
+	registered, err := s.Uint()
+	if err == rlp.EOL {
+		return s.ListEnd()
+	} else if err != nil {
+		return err
+	}
+	r.Registered = fromUnixNano(registered)
+	envelope, err := s.Bytes()
+	if err == rlp.EOL {
+		return s.ListEnd()
+	} else if err != nil {
+		return err
+	}
+	r.Envelope = envelope
+	return s.ListEnd()
 }
 
 // TopicPart looks for TopicBodyDelimiter and returns topic prefix from the same key.
@@ -36,14 +122,28 @@ func TopicPart(key []byte) []byte {
 type RecordsKey []byte
 
 func NewRecordsKey(topic string, record enr.Record) RecordsKey {
-	key := make(RecordsKey, 2+len([]byte(topic))+len(enode.ValidSchemes.NodeAddr(&record)))
+	return NewRecordsKeyForAddr(topic, protocol.StoredSchemes.NodeAddr(&record))
+}
+
+// NewRecordsKeyForAddr creates key for the node address, see enr.IdentityScheme.
+func NewRecordsKeyForAddr(topic string, addr []byte) RecordsKey {
+	key := make(RecordsKey, 2+len([]byte(topic))+len(addr))
 	key[0] = RecordsPrefix
 	copy(key[1:], []byte(topic))
 	key[1+len([]byte(topic))] = TopicBodyDelimiter
-	copy(key[2+len([]byte(topic)):], enode.ValidSchemes.NodeAddr(&record))
+	copy(key[2+len([]byte(topic)):], addr)
 	return key
 }
 
+// NodeAddrPart returns node address from the key.
+func NodeAddrPart(key []byte) []byte {
+	idx := bytes.IndexByte(key, TopicBodyDelimiter)
+	if idx == -1 {
+		return nil
+	}
+	return key[idx+1:]
+}
+
 func (k RecordsKey) SamePrefix(prefix []byte) bool {
 	return bytes.Equal(k[:len(prefix)], prefix)
 }
@@ -52,6 +152,41 @@ func (k RecordsKey) String() string {
 	return string(k)
 }
 
+// registeredKey is the key of the registration time index. It keeps topic and node address of
+// the records key with big endian registration time in between, so that records of the topic are
+// ordered by registration time.
+func registeredKey(key RecordsKey, registered time.Time) []byte {
+	prefix := registeredPrefix(string(TopicPart(key)))
+	rst := make([]byte, len(prefix)+8, len(prefix)+8+len(NodeAddrPart(key)))
+	copy(rst, prefix)
+	binary.BigEndian.PutUint64(rst[len(prefix):], unixNano(registered))
+	return append(rst, NodeAddrPart(key)...)
+}
+
+func registeredPrefix(topic string) []byte {
+	return append(append([]byte{RegisteredPrefix}, topic...), TopicBodyDelimiter)
+}
+
+// recordsKeyOf returns records key of the registration time index key.
+func recordsKeyOf(index []byte) RecordsKey {
+	topic := TopicPart(index)
+	return NewRecordsKeyForAddr(string(topic), index[len(topic)+2+8:])
+}
+
+// allRegisteredKey is the key of the registration time index of all topics. It keeps the records
+// key after big endian registration time.
+func allRegisteredKey(key RecordsKey, registered time.Time) []byte {
+	rst := make([]byte, 1+8, 1+8+len(key))
+	rst[0] = AllRegisteredPrefix
+	binary.BigEndian.PutUint64(rst[1:], unixNano(registered))
+	return append(rst, key...)
+}
+
+// indexKeys returns keys of the registration time indexes of the record.
+func indexKeys(key RecordsKey, registered time.Time) [][]byte {
+	return [][]byte{registeredKey(key, registered), allRegisteredKey(key, registered)}
+}
+
 // NewStorage creates instance of the storage.
 func NewStorage(db *leveldb.DB) Storage {
 	return Storage{db: db}
@@ -62,23 +197,94 @@ type Storage struct {
 	db *leveldb.DB
 }
 
-// Add stores record using specified topic.
+// Add stores record using specified topic. Time of the first registration is preserved
+// when record is updated.
 func (s Storage) Add(topic string, record enr.Record, t time.Time) (string, error) {
+	return s.AddDetached(topic, record, nil, t)
+}
+
+// AddDetached stores record with the envelope of detached peer record, see
+// protocol.DetachPeerRecord. Envelope is nil for other records.
+func (s Storage) AddDetached(topic string, record enr.Record, envelope []byte, t time.Time) (string, error) {
 	key := NewRecordsKey(topic, record)
 	stored := StorageRecord{
-		ENR:  record,
-		Time: t,
+		ENR:        record,
+		Time:       t,
+		Registered: time.Now(),
+		Envelope:   envelope,
+	}
+	existing, err := s.Get(key.String())
+	if err == nil && !existing.Registered.IsZero() {
+		stored.Registered = existing.Registered
 	}
+	return key.String(), s.Put(key.String(), stored)
+}
+
+// Put stores record under the key as is, so that deadline and registration time of the record
+// replicated from other server are preserved.
+func (s *Storage) Put(key string, stored StorageRecord) error {
 	data, err := rlp.EncodeToBytes(stored)
 	if err != nil {
-		return "", err
+		return err
+	}
+	batch := new(leveldb.Batch)
+	if existing, err := s.Get(key); err == nil && !existing.Registered.Equal(stored.Registered) {
+		for _, index := range indexKeys(RecordsKey(key), existing.Registered) {
+			batch.Delete(index)
+		}
 	}
-	return key.String(), s.db.Put(key, data, nil)
+	batch.Put([]byte(key), data)
+	for _, index := range indexKeys(RecordsKey(key), stored.Registered) {
+		batch.Put(index, nil)
+	}
+	return s.db.Write(batch, nil)
+}
+
+// Has returns true if record with the key is stored.
+func (s *Storage) Has(key string) (bool, error) {
+	return s.db.Has([]byte(key), nil)
+}
+
+// Probe checks that database can be read.
+func (s *Storage) Probe() error {
+	_, err := s.db.Has([]byte{RecordsPrefix}, nil)
+	return err
 }
 
 // RemoveBykey removes record from storage.
 func (s *Storage) RemoveByKey(key string) error {
-	return s.db.Delete([]byte(key), nil)
+	batch := new(leveldb.Batch)
+	if existing, err := s.Get(key); err == nil {
+		for _, index := range indexKeys(RecordsKey(key), existing.Registered) {
+			batch.Delete(index)
+		}
+	}
+	batch.Delete([]byte(key))
+	return s.db.Write(batch, nil)
+}
+
+// IndexRegistered adds records stored before registration time indexes were introduced to the indexes.
+func (s *Storage) IndexRegistered() error {
+	iter := s.db.NewIterator(util.BytesPrefix([]byte{RecordsPrefix}), nil)
+	defer iter.Release()
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		var stored StorageRecord
+		if err := rlp.DecodeBytes(iter.Value(), &stored); err != nil {
+			return err
+		}
+		for _, index := range indexKeys(RecordsKey(iter.Key()), stored.Registered) {
+			if exist, err := s.db.Has(index, nil); err != nil {
+				return err
+			} else if !exist {
+				batch.Put(index, nil)
+			}
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return s.db.Write(batch, nil)
 }
 
 func (s *Storage) IterateAllKeys(iterator func(key RecordsKey, ttl time.Time) error) error {
@@ -96,8 +302,69 @@ func (s *Storage) IterateAllKeys(iterator func(key RecordsKey, ttl time.Time) er
 	return nil
 }
 
+// Cursor points to the registration in the order of registration time.
+type Cursor struct {
+	Registered time.Time
+	Key        RecordsKey
+}
+
+// GetRegisteredAfter returns up to limit records of the topic that were registered after
+// the cursor, oldest first, and cursor pointing to the last returned record. Records are read
+// from the registration time index starting at the cursor.
+func (s *Storage) GetRegisteredAfter(topic string, after Cursor, limit uint) (rst []StorageRecord, next Cursor, err error) {
+	start := registeredKey(NewRecordsKeyForAddr(topic, NodeAddrPart(after.Key)), after.Registered)
+	rst, _, next, err = s.getRegisteredAfter(registeredPrefix(topic), start, recordsKeyOf, after, limit, nil)
+	return rst, next, err
+}
+
+// GetAllRegisteredAfter is GetRegisteredAfter for records of all topics. Topics of the records are
+// returned with them, records of topics that aren't accepted are skipped.
+func (s *Storage) GetAllRegisteredAfter(after Cursor, limit uint, accept func(topic string) bool) (rst []StorageRecord, topics []string, next Cursor, err error) {
+	keyOf := func(index []byte) RecordsKey { return append(RecordsKey{}, index[1+8:]...) }
+	return s.getRegisteredAfter([]byte{AllRegisteredPrefix}, allRegisteredKey(after.Key, after.Registered), keyOf, after, limit, accept)
+}
+
+func (s *Storage) getRegisteredAfter(prefix, start []byte, keyOf func([]byte) RecordsKey, after Cursor, limit uint, accept func(string) bool) (rst []StorageRecord, topics []string, next Cursor, err error) {
+	iter := s.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+	next = after
+	for ok := iter.Seek(start); ok && uint(len(rst)) < limit; ok = iter.Next() {
+		if bytes.Equal(iter.Key(), start) {
+			continue
+		}
+		key := keyOf(iter.Key())
+		topic := string(TopicPart(key))
+		if accept != nil && !accept(topic) {
+			continue
+		}
+		stored, err := s.Get(key.String())
+		if err == leveldb.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, nil, after, err
+		}
+		rst = append(rst, stored)
+		topics = append(topics, topic)
+		next = Cursor{Registered: stored.Registered, Key: key}
+	}
+	return rst, topics, next, iter.Error()
+}
+
 // GetRandom reads random records for specified topic up to specified limit.
 func (s *Storage) GetRandom(topic string, limit uint) (rst []enr.Record, err error) {
+	stored, err := s.GetRandomRecords(topic, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := range stored {
+		rst = append(rst, stored[i].ENR)
+	}
+	return rst, nil
+}
+
+// GetRandomRecords is the same as GetRandom but returns records together with their deadlines.
+func (s *Storage) GetRandomRecords(topic string, limit uint) (rst []StorageRecord, err error) {
 	prefixlen := 1 + len([]byte(topic))
 	key := make(RecordsKey, prefixlen+32)
 	key[0] = RecordsPrefix
@@ -125,10 +392,92 @@ func (s *Storage) GetRandom(topic string, limit uint) (rst []enr.Record, err err
 					continue
 				}
 				uids[string(k)] = struct{}{}
-				rst = append(rst, stored.ENR)
+				rst = append(rst, stored)
 				break
 			}
 		}
 	}
 	return rst, nil
 }
+
+// GetRandomRecordsUnder samples up to limit records registered under any topic of the namespace,
+// see protocol.InNamespace. Records of the same node registered under several topics are
+// returned once. Every matching key is visited, so it is slower than GetRandomRecords.
+func (s *Storage) GetRandomRecordsUnder(namespace string, limit uint) (rst []StorageRecord, err error) {
+	if limit == 0 {
+		return nil, nil
+	}
+	prefix := append([]byte{RecordsPrefix}, []byte(strings.TrimSuffix(namespace, protocol.TopicSeparator))...)
+	iter := s.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+	var (
+		sampled []RecordsKey
+		nodes   = map[string]int{}
+		seen    uint
+	)
+	for iter.Next() {
+		key := RecordsKey(iter.Key())
+		if !protocol.InNamespace(string(TopicPart(key)), namespace) {
+			continue
+		}
+		node := string(NodeAddrPart(key))
+		if _, exist := nodes[node]; exist {
+			continue
+		}
+		seen++
+		idx := len(sampled)
+		if seen > limit {
+			idx = mrand.Intn(int(seen))
+			if uint(idx) >= limit {
+				continue
+			}
+			delete(nodes, string(NodeAddrPart(sampled[idx])))
+			sampled[idx] = append(RecordsKey{}, key...)
+		} else {
+			sampled = append(sampled, append(RecordsKey{}, key...))
+		}
+		nodes[node] = idx
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	for _, key := range sampled {
+		data, err := s.db.Get(key, nil)
+		if err == leveldb.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var stored StorageRecord
+		if err := rlp.DecodeBytes(data, &stored); err != nil {
+			return nil, err
+		}
+		rst = append(rst, stored)
+	}
+	return rst, nil
+}
+
+// Get returns record stored under the key.
+func (s *Storage) Get(key string) (rst StorageRecord, err error) {
+	data, err := s.db.Get([]byte(key), nil)
+	if err != nil {
+		return rst, err
+	}
+	return rst, rlp.DecodeBytes(data, &rst)
+}
+
+// GetAll returns all records of the topic together with their keys.
+func (s *Storage) GetAll(topic string) (keys []RecordsKey, rst []StorageRecord, err error) {
+	iter := s.db.NewIterator(util.BytesPrefix(NewRecordsKeyForAddr(topic, nil)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var stored StorageRecord
+		if err := rlp.DecodeBytes(iter.Value(), &stored); err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, append(RecordsKey{}, iter.Key()...))
+		rst = append(rst, stored)
+	}
+	return keys, rst, iter.Error()
+}
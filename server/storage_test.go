@@ -1,20 +1,26 @@
 package server
 
 import (
+	"bytes"
 	"crypto/ecdsa"
+	"encoding/json"
 	"fmt"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
 	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/status-im/rendezvous/protocol"
 )
 
 func TestGetRandom(t *testing.T) {
@@ -170,3 +176,208 @@ func benchmarkRandomReads(b *testing.B, records int) {
 		s.GetRandom(topic, 5)
 	}
 }
+
+func TestStorageRecordTime(t *testing.T) {
+	_, r := newRecord(t)
+	deadline := time.Unix(0, time.Now().UnixNano())
+	data, err := rlp.EncodeToBytes(StorageRecord{ENR: r, Time: deadline})
+	require.NoError(t, err)
+	var decoded StorageRecord
+	require.NoError(t, rlp.DecodeBytes(data, &decoded))
+	require.True(t, deadline.Equal(decoded.Time))
+	require.True(t, decoded.Registered.IsZero())
+
+	// records stored before time was encoded explicitly
+	legacy, err := rlp.EncodeToBytes([]interface{}{r, []interface{}{}})
+	require.NoError(t, err)
+	require.NoError(t, rlp.DecodeBytes(legacy, &decoded))
+	require.True(t, decoded.Time.IsZero())
+}
+
+func TestAddPreservesRegistrationTime(t *testing.T) {
+	memdb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	s := NewStorage(memdb)
+	_, r := newRecord(t)
+	_, err := s.Add("some", r, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	first, err := s.GetRandomRecords("some", 1)
+	require.NoError(t, err)
+	require.Len(t, first, 1)
+	require.False(t, first[0].Registered.IsZero())
+
+	deadline := time.Now().Add(time.Minute)
+	_, err = s.Add("some", r, deadline)
+	require.NoError(t, err)
+	second, err := s.GetRandomRecords("some", 1)
+	require.NoError(t, err)
+	require.Len(t, second, 1)
+	require.True(t, first[0].Registered.Equal(second[0].Registered))
+	require.True(t, deadline.Equal(second[0].Time))
+}
+
+func TestGetRegisteredAfter(t *testing.T) {
+	memdb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	s := NewStorage(memdb)
+	var added []enr.Record
+	for i := 0; i < 5; i++ {
+		_, r := newRecord(t)
+		_, err := s.Add("some", r, time.Now().Add(time.Minute))
+		require.NoError(t, err)
+		added = append(added, r)
+	}
+	var (
+		all    []StorageRecord
+		cursor Cursor
+	)
+	for i := 0; i < 3; i++ {
+		records, next, err := s.GetRegisteredAfter("some", cursor, 2)
+		require.NoError(t, err)
+		all = append(all, records...)
+		cursor = next
+	}
+	require.Len(t, all, len(added))
+	for i := 1; i < len(all); i++ {
+		require.False(t, all[i].Registered.Before(all[i-1].Registered))
+	}
+	records, next, err := s.GetRegisteredAfter("some", cursor, 2)
+	require.NoError(t, err)
+	require.Empty(t, records)
+	require.Equal(t, cursor, next)
+}
+
+func TestRegisteredIndex(t *testing.T) {
+	memdb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	s := NewStorage(memdb)
+	var keys []string
+	for i := 0; i < 3; i++ {
+		_, r := newRecord(t)
+		stored, err := s.Add("some", r, time.Now().Add(time.Minute))
+		require.NoError(t, err)
+		keys = append(keys, stored)
+	}
+	require.NoError(t, s.RemoveByKey(keys[0]))
+	// replicated record moves to the end
+	stored, err := s.Get(keys[1])
+	require.NoError(t, err)
+	stored.Registered = time.Now()
+	require.NoError(t, s.Put(keys[1], stored))
+	// record stored without the index
+	legacy, err := s.Get(keys[2])
+	require.NoError(t, err)
+	require.NoError(t, memdb.Delete(registeredKey(RecordsKey(keys[2]), legacy.Registered), nil))
+
+	records, _, err := s.GetRegisteredAfter("some", Cursor{}, 10)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.NoError(t, s.IndexRegistered())
+	records, _, err = s.GetRegisteredAfter("some", Cursor{}, 10)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, NodeAddrPart([]byte(keys[2])), protocol.ValidSchemes.NodeAddr(&records[0].ENR))
+	require.Equal(t, NodeAddrPart([]byte(keys[1])), protocol.ValidSchemes.NodeAddr(&records[1].ENR))
+
+	iter := memdb.NewIterator(util.BytesPrefix([]byte{RegisteredPrefix}), nil)
+	defer iter.Release()
+	var indexed int
+	for iter.Next() {
+		indexed++
+	}
+	require.Equal(t, 2, indexed)
+}
+
+func TestGetRandomRecordsUnder(t *testing.T) {
+	memdb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	s := NewStorage(memdb)
+	add := func(topics ...string) {
+		_, r := newRecord(t)
+		for _, topic := range topics {
+			_, err := s.Add(topic, r, time.Now().Add(time.Minute))
+			require.NoError(t, err)
+		}
+	}
+	add("/waku/2/a", "/waku/2/b")
+	add("/waku/2/b")
+	add("/waku/2")
+	add("/waku/20")
+
+	records, err := s.GetRandomRecordsUnder("/waku/2", 10)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	records, err = s.GetRandomRecordsUnder("/waku/2/b", 10)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	records, err = s.GetRandomRecordsUnder("/waku", 2)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+}
+
+func TestSnapshot(t *testing.T) {
+	memdb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	s := NewStorage(memdb)
+	now := time.Now()
+	blinded := protocol.BlindTopic([]byte("secret"), "/app", 1)
+	for _, topic := range []string{"/app/chat", blinded} {
+		_, r := newRecord(t)
+		_, err := s.Add(topic, r, now.Add(time.Minute))
+		require.NoError(t, err)
+	}
+	_, expired := newRecord(t)
+	_, err := s.Add("/app/chat", expired, now.Add(-time.Second))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	count, err := s.Export(&buf, now)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	// expired and tampered records are skipped
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	var line SnapshotRecord
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &line))
+	line.Deadline = now.Add(-time.Minute)
+	stale, _ := json.Marshal(line)
+	tampered := strings.Replace(lines[1], `"enr":"enr:`, `"enr":"enr:AA`, 1)
+	snapshot := strings.Join(append(lines, string(stale), tampered, "not json"), "\n")
+
+	memdb, _ = leveldb.Open(storage.NewMemStorage(), nil)
+	imported := NewStorage(memdb)
+	stats, err := imported.Import(strings.NewReader(snapshot), now)
+	require.NoError(t, err)
+	require.Equal(t, ImportStats{Imported: 2, Expired: 1, Invalid: 2}, stats)
+	_, records, err := imported.GetAll(blinded)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	_, original, err := s.GetAll(blinded)
+	require.NoError(t, err)
+	require.Equal(t, original[0].Time.UnixNano(), records[0].Time.UnixNano())
+	require.Equal(t, original[0].Registered.UnixNano(), records[0].Registered.UnixNano())
+
+	stats, err = imported.Import(strings.NewReader(snapshot), now)
+	require.NoError(t, err)
+	require.Equal(t, 2, stats.Kept)
+}
+
+func TestGetAllRegisteredAfter(t *testing.T) {
+	memdb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	s := NewStorage(memdb)
+	var keys []string
+	for _, topic := range []string{"b", "a", "c", "a"} {
+		_, r := newRecord(t)
+		key, err := s.Add(topic, r, time.Now().Add(time.Minute))
+		require.NoError(t, err)
+		keys = append(keys, key)
+	}
+	require.NoError(t, s.RemoveByKey(keys[2]))
+
+	records, topics, next, err := s.GetAllRegisteredAfter(Cursor{}, 2, nil)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, []string{"b", "a"}, topics)
+	_, topics, _, err = s.GetAllRegisteredAfter(next, 10, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, topics)
+
+	_, topics, _, err = s.GetAllRegisteredAfter(Cursor{}, 10, func(topic string) bool { return topic != "a" })
+	require.NoError(t, err)
+	require.Equal(t, []string{"b"}, topics)
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/status-im/rendezvous/protocol"
+)
+
+const maxTopics uint = 1000
+
+// topicCounter tracks the number of active registrations per topic, so that topics can be
+// listed without scanning the storage.
+type topicCounter struct {
+	mu     sync.RWMutex
+	topics map[string]uint64
+}
+
+func newTopicCounter() *topicCounter {
+	return &topicCounter{topics: map[string]uint64{}}
+}
+
+func (c *topicCounter) inc(topic string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.topics[topic]++
+}
+
+func (c *topicCounter) dec(topic string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.topics[topic] <= 1 {
+		delete(c.topics, topic)
+		return
+	}
+	c.topics[topic]--
+}
+
+func (c *topicCounter) count(topic string) int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return int(c.topics[topic])
+}
+
+// list returns up to limit topics that start with prefix, sorted by name. Topics for which
+// hidden returns true are skipped.
+func (c *topicCounter) list(prefix string, limit uint, hidden func(topic string) bool) []protocol.TopicStat {
+	c.mu.RLock()
+	rst := []protocol.TopicStat{}
+	for topic, count := range c.topics {
+		if strings.HasPrefix(topic, prefix) && !hidden(topic) {
+			rst = append(rst, protocol.TopicStat{Topic: topic, Count: count})
+		}
+	}
+	c.mu.RUnlock()
+	sort.Slice(rst, func(i, j int) bool {
+		return rst[i].Topic < rst[j].Topic
+	})
+	if uint(len(rst)) > limit {
+		rst = rst[:limit]
+	}
+	return rst
+}
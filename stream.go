@@ -50,6 +50,10 @@ func (si InstrumentedStream) Reset() error {
 	return si.s.Reset()
 }
 
+func (si InstrumentedStream) ResetWithError(code network.StreamErrorCode) error {
+	return si.s.ResetWithError(code)
+}
+
 func (si InstrumentedStream) SetDeadline(timeout time.Time) error {
 	return si.s.SetDeadline(timeout)
 }